@@ -1,54 +1,78 @@
 package main
 
 import (
-    "bytes"
+    "context"
     "encoding/json"
+    "errors"
+    "flag"
     "fmt"
-    "io"
-    "net/http"
-    
+    "log"
+    "os"
     "strings"
     "time"
 
     "github.com/gdamore/tcell/v2"
+    "github.com/gorilla/websocket"
     "github.com/rivo/tview"
+    "x3dh-demo/internal/client"
+    "x3dh-demo/internal/config"
+    "x3dh-demo/internal/keystore"
+    "x3dh-demo/internal/user"
+    "x3dh-demo/internal/x3dh"
 )
 
-type InitialMessage struct {
-    Sender     string `json:"sender"`
-    AliceIK    string `json:"alice_ik"`
-    AliceEKa   string `json:"alice_eka"`
-    Nonce      string `json:"nonce"`
-    Ciphertext string `json:"ciphertext"`
-}
+// serverURL, keyFile, keyDir and device come from flags, X3DH_* environment
+// variables or defaults. An empty keyFile means the user's key directory
+// under keyDir, or the key file of the alice and bob programs if it exists.
+var serverURL, keyFile, keyDir, device string
 
-type ServerMessage struct {
-    Message      InitialMessage `json:"message"`
-    MessagesLeft int            `json:"messages_left"`
-}
+// passphrase unlocks encrypted key files. It comes from X3DH_PASSPHRASE or
+// the login form; with a passphrase, unencrypted key files are encrypted.
+var passphrase string
+
+// me is the logged-in user's device. It holds the identity, contacts and
+// sessions that messages are encrypted and decrypted with.
+var me *user.User
+
+// relay is the relay client; once the user has logged in it acts as their device.
+var relay *client.Client
 
 func main() {
+    cfg, err := config.Load(flag.CommandLine, os.Args[1:], "", (*config.Config).RegisterUserFlags)
+    if err != nil {
+        log.Fatal(err)
+    }
+    serverURL, keyFile, keyDir, device = cfg.ServerURL, cfg.KeyFile, cfg.KeyDir, cfg.Device
+    passphrase = cfg.Passphrase
+    relay = client.New(serverURL)
+    relay.Timeout, relay.Retries = cfg.Timeout, cfg.Retries
+
     app := tview.NewApplication()
     chatView := tview.NewTextView().
         SetDynamicColors(true).
         SetChangedFunc(func() { app.Draw() })
 
-    var username, recipient string
+    username, recipient := cfg.User, ""
     var errorText *tview.TextView
     done := make(chan struct{})
 
     errorText = tview.NewTextView().SetText("").SetTextColor(tcell.ColorRed)
 
     form := tview.NewForm().
-        AddInputField("Your name", "", 20, nil, func(text string) { username = strings.TrimSpace(strings.ToLower(text)) }).
+        AddInputField("Your name", username, 20, nil, func(text string) { username = strings.TrimSpace(strings.ToLower(text)) }).
         AddInputField("Recipient", "", 20, nil, func(text string) { recipient = strings.TrimSpace(strings.ToLower(text)) }).
+        AddPasswordField("Passphrase", passphrase, 20, '*', func(text string) { passphrase = text }).
         AddButton("Start Chat", func() {
+            if username == "" || recipient == "" || strings.Contains(username+recipient, "/") {
+                errorText.SetText("Enter two user names without '/'!")
+                return
+            }
             if username == recipient {
                 errorText.SetText("Sender and recipient must be different!")
                 return
             }
-            if !((username == "alice" && recipient == "bob") || (username == "bob" && recipient == "alice")) {
-                errorText.SetText("Only alice <-> bob chats are allowed!")
+            if err := loadIdentity(username); err != nil {
+                errorText.SetText(err.Error())
                 return
             }
             errorText.SetText("")
@@ -80,22 +104,30 @@ func buildChatUI(app *tview.Application, chatView *tview.TextView, username, rec
             if key == tcell.KeyEnter {
                 msg := input.GetText()
                 if msg != "" {
-                    sendMessage(username, recipient, msg)
-                    chatView.Write([]byte(fmt.Sprintf("%s: %s\n", username, msg)))
+                    chatView.Write([]byte(fmt.Sprintf("%s: %s\n", username, tview.Escape(msg))))
+                    if err := sendMessage(recipient, msg); err != nil {
+                        chatView.Write([]byte(fmt.Sprintf("[red]Warning: message not sent: %s[-]\n", tview.Escape(err.Error()))))
+                    }
                     input.SetText("")
                 }
             }
         })
 
     go func() {
+        show := func(msg *x3dh.InitialMessage) bool {
+            line, ok := openMessage(msg)
+            app.QueueUpdateDraw(func() {
+                chatView.Write([]byte(line + "\n"))
+            })
+            return ok
+        }
         for {
+            // The WebSocket pushes messages as they arrive; streamMessages
+            // only returns once the socket fails or cannot be opened.
+            streamMessages(show)
+            // Fall back to polling until the socket can be reopened.
             time.Sleep(2 * time.Second)
-            sender, msg, err := checkMessages(username)
-            if err == nil && msg != "" {
-                app.QueueUpdateDraw(func() {
-                    chatView.Write([]byte(fmt.Sprintf("%s: %s\n", sender, msg)))
-                })
-            }
+            checkMessages(show)
         }
     }()
 
@@ -106,30 +138,99 @@ func buildChatUI(app *tview.Application, chatView *tview.TextView, username, rec
     return flex
 }
 
-func sendMessage(sender, recipient, msg string) {
-    m := InitialMessage{
-        Sender:     sender,
-        AliceIK:    "",
-        AliceEKa:   "",
-        Nonce:      "",
-        Ciphertext: msg,
+// sendMessage encrypts msg for every device of recipient: the first message
+// to a device is an X3DH handshake against its bundle, later ones continue
+// the session it started.
+func sendMessage(recipient, msg string) error {
+    _, err := me.Send(recipient, []byte(msg))
+    return err
+}
+
+// openMessage decrypts a delivered message and returns the line to show for
+// it, or a warning if it cannot be decrypted. ok reports whether the message
+// may be acknowledged: it was decrypted, or it is a handshake that never
+// will be, because it was replayed or because its identity key is not the
+// one pinned for the sender. Any other message is delivered again once its
+// lease expires.
+func openMessage(msg *x3dh.InitialMessage) (line string, ok bool) {
+    received, err := me.Open(msg)
+    if errors.Is(err, user.ErrIdentityChanged) {
+        // Never show it as a line from the name it claims.
+        line = fmt.Sprintf("[red]Warning: rejected a message claiming to be from %s: %s[-]", tview.Escape(msg.Sender), tview.Escape(err.Error()))
+        return line, true
     }
-    data, _ := json.Marshal(m)
-    http.Post(fmt.Sprintf("http://localhost:8080/send/%s", recipient), "application/json", bytes.NewBuffer(data))
+    if err != nil {
+        line = fmt.Sprintf("[red]Warning: could not decrypt message from %s: %s[-]", tview.Escape(msg.Sender), tview.Escape(err.Error()))
+        return line, errors.Is(err, keystore.ErrUsedOneTimePreKey)
+    }
+    return fmt.Sprintf("%s: %s", tview.Escape(msg.Sender), tview.Escape(string(received.Plaintext))), true
+}
+
+// loadIdentity loads the user's keys, contacts and sessions. The Ed25519
+// key is needed to log in to their mailbox and the identity key to
+// encrypt. The key files are written by "x3dh init" or by the alice and bob
+// programs; next to the latter, contacts and sessions get files of their own.
+// Encrypted files are unlocked with the passphrase.
+func loadIdentity(username string) error {
+    me = user.New(serverURL, keyDir, username, device)
+    me.Client = relay
+    me.Passphrase = func(bool) ([]byte, error) { return []byte(passphrase), nil }
+    if keyFile != "" {
+        me.KeyFile = keyFile
+    } else {
+        legacy := username
+        if device != "" {
+            legacy += "_" + device
+        }
+        if _, err := os.Stat(legacy + "_private_keys.json"); err == nil {
+            me.KeyFile = legacy + "_private_keys.json"
+            me.ContactsFile = legacy + "_contacts.json"
+            me.SessionsFile = legacy + "_sessions.json"
+        }
+    }
+    if _, err := me.Identity(); errors.Is(err, user.ErrNoKeys) {
+        return fmt.Errorf("no keys in %s: run x3dh -user %s init first", me.KeyFile, username)
+    } else if err != nil {
+        return err
+    }
+    // Log in to the relay as this device from now on.
+    me.Relay()
+    return nil
 }
 
-func checkMessages(username string) (string, string, error) {
-    resp, err := http.Get(fmt.Sprintf("http://localhost:8080/messages/%s", username))
+// streamMessages receives messages over the server's WebSocket and passes
+// each one to deliver, acknowledging it if deliver returns true. It blocks
+// until the socket fails.
+func streamMessages(deliver func(msg *x3dh.InitialMessage) bool) error {
+    conn, err := relay.Dial(context.Background())
     if err != nil {
-        return "", "", err
+        return err
     }
-    defer resp.Body.Close()
-    if resp.StatusCode != http.StatusOK {
-        return "", "", io.EOF
+    defer conn.Close()
+    for {
+        _, data, err := conn.ReadMessage()
+        if err != nil {
+            return err
+        }
+        var delivery client.Delivery
+        if err := json.Unmarshal(data, &delivery); err == nil && deliver(&delivery.Message) {
+            ack, _ := json.Marshal(map[string]string{"ack": delivery.Message.ID})
+            conn.WriteMessage(websocket.TextMessage, ack)
+        }
+    }
+}
+
+// checkMessages fetches the oldest message in the mailbox, if there is one,
+// and passes it to deliver. Like streamMessages it acknowledges the message
+// only if deliver returns true.
+func checkMessages(deliver func(msg *x3dh.InitialMessage) bool) error {
+    ctx := context.Background()
+    delivery, err := relay.Fetch(ctx, 0)
+    if err != nil || delivery == nil {
+        return err
     }
-    var sm ServerMessage
-    if err := json.NewDecoder(resp.Body).Decode(&sm); err != nil {
-        return "", "", err
+    if !deliver(&delivery.Message) {
+        return nil
     }
-    return sm.Message.Sender, sm.Message.Ciphertext, nil
-} 
\ No newline at end of file
+    return relay.Ack(ctx, delivery.Message.ID)
+}
@@ -1,184 +1,57 @@
+// Command alice is the demo initiator: it sends one message, read from
+// stdin, to every device of bob. It is a fixed-user wrapper around the
+// same code as "x3dh -user alice send bob".
 package main
 
 import (
 	"bufio"
-	"bytes"
-	"crypto/ecdh"
-	"crypto/ed25519"
-	"crypto/rand"
 	"encoding/hex"
-	"encoding/json"
-	"io"
+	"errors"
+	"flag"
 	"log"
-	"net/http"
 	"os"
 	"strings"
 
-	"golang.org/x/crypto/chacha20poly1305"
-	"x3dh-demo/internal/x3dh"
+	"x3dh-demo/internal/client"
+	"x3dh-demo/internal/config"
+	"x3dh-demo/internal/keystore"
+	"x3dh-demo/internal/user"
 )
 
-const serverURL = "http://localhost:8080"
-
-
-// AlicePrivateKeys holds the long-term private key for Alice.
-type AlicePrivateKeys struct {
-	IKaPriv []byte `json:"ika_priv"`
-}
-
-// ──────────────────────────────────────────────────────────────
-// Вспомогательные функции
-// ──────────────────────────────────────────────────────────────
-
-// encode32(pub) → hex-string
-func encode32(pk [32]byte) string { return hex.EncodeToString(pk[:]) }
-
-// decode32(hex) → [32]byte
-func decode32(s string) (out [32]byte) {
-	raw, err := hex.DecodeString(s)
+func main() {
+	cfg, err := config.Load(flag.CommandLine, os.Args[1:], "alice_private_keys.json", (*config.Config).RegisterClientFlags)
 	if err != nil {
-		panic(err)
+		log.Fatal(err)
 	}
-	copy(out[:], raw)
-	return
-}
+	alice := &user.User{Name: "alice", Device: cfg.Device, Server: cfg.ServerURL, KeyFile: cfg.KeyFile}
+	alice.Client = client.New(cfg.ServerURL)
+	alice.Client.Timeout, alice.Client.Retries = cfg.Timeout, cfg.Retries
+	alice.Passphrase = keystore.Source(cfg.Passphrase, alice.KeyFile)
 
-func main() {
-	// 1. Load or generate Alice's Identity Key
-	var alicePriv *ecdh.PrivateKey
-	var alicePub [32]byte
-
-	keyFile := "alice_private_keys.json"
-	privateKeyBlob, err := os.ReadFile(keyFile)
-	if os.IsNotExist(err) {
+	// 1. Load or generate Alice's identity key
+	if _, err := alice.Identity(); errors.Is(err, user.ErrNoKeys) {
 		log.Println("Generating Alice's identity key...")
-		priv, pub, err := x3dh.GenKeyPair()
-		if err != nil {
-			log.Fatalf("Failed to generate Alice's key pair: %v", err)
-		}
-		alicePriv = priv
-		alicePub = pub
-
-		// Save the private key
-		keysToSave := AlicePrivateKeys{IKaPriv: alicePriv.Bytes()}
-		blob, _ := json.MarshalIndent(keysToSave, "", "  ")
-		if err := os.WriteFile(keyFile, blob, 0600); err != nil {
-			log.Fatalf("Failed to save Alice's private key: %v", err)
+		if err := alice.Init(); err != nil {
+			log.Fatalf("Failed to generate Alice's keys: %v", err)
 		}
-		log.Printf("Alice's identity key saved to %s", keyFile)
+		log.Printf("Alice's identity key saved to %s", alice.KeyFile)
 	} else if err != nil {
-		log.Fatalf("Failed to read %s: %v", keyFile, err)
+		log.Fatalf("Failed to load Alice's keys: %v", err)
 	} else {
-		// Load the private key
-		var loadedKeys AlicePrivateKeys
-		if err := json.Unmarshal(privateKeyBlob, &loadedKeys); err != nil {
-			log.Fatalf("Failed to unmarshal Alice's private key: %v", err)
-		}
-		curve := ecdh.X25519()
-		priv, err := curve.NewPrivateKey(loadedKeys.IKaPriv)
-		if err != nil {
-			log.Fatalf("Failed to load Alice's private key: %v", err)
-		}
-		alicePriv = priv
-		pubBytes := alicePriv.PublicKey().Bytes()
-		copy(alicePub[:], pubBytes)
 		log.Println("Loaded Alice's identity key.")
 	}
 
-	// 2. Fetch Bob's bundle from the server
-	resp, err := http.Get(serverURL + "/bundle/bob")
-	if err != nil {
-		log.Fatalf("Failed to fetch Bob's bundle: %v", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		log.Fatalf("Server returned an error for bundle request: %s - %s", resp.Status, string(body))
-	}
-
-	var bobBundle x3dh.Bundle
-	if err := json.NewDecoder(resp.Body).Decode(&bobBundle); err != nil {
-		log.Fatalf("Failed to decode Bob's bundle: %v", err)
-	}
-
-	// 3. Verify the signature on Bob's Signed Pre-key
-	edPub, _ := hex.DecodeString(bobBundle.Ed25519)
-	sig, _ := hex.DecodeString(bobBundle.Sig)
-	spkBytes := decode32(bobBundle.SPK)
-	if !ed25519.Verify(edPub, spkBytes[:], sig) {
-		log.Fatal("SPK signature verification failed!")
-	}
-
-	// 4. Generate Alice's EPHEMERAL keys
-	privEKa, pubEKa, err := x3dh.GenKeyPair()
-	if err != nil {
-		log.Fatalf("Failed to generate ephemeral key pair: %v", err)
-	}
-
-	// 5. Decode Bob's public keys
-	IKbPub32 := decode32(bobBundle.IK)
-	SPKbPub32 := decode32(bobBundle.SPK)
-	OTKbPub32 := decode32(bobBundle.OTK)
-
-	// 6. Calculate the shared secret (X3DH)
-	// DH1 = DH(IKa, SPKb)
-	DH1, err := x3dh.DH(alicePriv, &SPKbPub32)
-	if err != nil {
-		log.Fatalf("DH1 failed: %v", err)
-	}
-	// DH2 = DH(EKa, IKb)
-	DH2, err := x3dh.DH(privEKa, &IKbPub32)
-	if err != nil {
-		log.Fatalf("DH2 failed: %v", err)
-	}
-	// DH3 = DH(EKa, SPKb)
-	DH3, err := x3dh.DH(privEKa, &SPKbPub32)
-	if err != nil {
-		log.Fatalf("DH3 failed: %v", err)
-	}
-	// DH4 = DH(EKa, OTKb)
-	DH4, err := x3dh.DH(privEKa, &OTKbPub32)
-	if err != nil {
-		log.Fatalf("DH4 failed: %v", err)
-	}
-
-	master := x3dh.KDF(DH1, DH2, DH3, DH4)
-	log.Println("Session key derived " + hex.EncodeToString(master[:]))
-
-	// 7. Get message from user and encrypt it
+	// 2. Get message from user
 	log.Print("Enter a message to send to Bob: ")
-	reader := bufio.NewReader(os.Stdin)
-	input, _ := reader.ReadString('\n')
-	plaintext := []byte(strings.TrimSpace(input))
-
-	key := master[:]
-	aead, _ := chacha20poly1305.New(key)
-	nonce := make([]byte, aead.NonceSize())
-	rand.Read(nonce)
-	ciphertext := aead.Seal(nil, nonce, plaintext, nil)
+	input, _ := bufio.NewReader(os.Stdin).ReadString('\n')
 
-	// 8. Send the initial message to the server for Bob
-	initialMessage := x3dh.InitialMessage{
-		AliceIK:    encode32(alicePub),
-		AliceEKa:   encode32(pubEKa),
-		Nonce:      hex.EncodeToString(nonce),
-		Ciphertext: hex.EncodeToString(ciphertext),
-		Sender:     "alice",
+	// 3. Run X3DH against each of Bob's devices and send each its own initial message
+	sent, err := alice.Send("bob", []byte(strings.TrimSpace(input)))
+	for _, s := range sent {
+		log.Printf("Session key for device %s derived %s", s.Device, hex.EncodeToString(s.Session.Key[:]))
 	}
-
-	msgJSON, _ := json.Marshal(initialMessage)
-	resp, err = http.Post(serverURL+"/send/bob", "application/json", bytes.NewBuffer(msgJSON))
 	if err != nil {
-		log.Fatalf("Failed to send message to server: %v", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		log.Fatalf("Server returned an error during send: %s - %s", resp.Status, string(body))
+		log.Fatalf("Failed to send message to Bob: %v", err)
 	}
-
-	log.Println("Encrypted message was sent")
+	log.Printf("Encrypted message was sent to %d device(s)", len(sent))
 }
-
@@ -1,233 +1,166 @@
+// Command bob is the demo responder. It is a fixed-user wrapper around the
+// same code as the x3dh command: -action register, check, replenish,
+// rotate-spk, approve and passphrase correspond to "x3dh -user bob" init
+// plus register, recv, replenish, rotate-spk, approve and passphrase.
 package main
 
 import (
-	"bytes"
-	"crypto/ecdh"
-	"crypto/ed25519"
-	"crypto/rand"
 	"encoding/hex"
-	"encoding/json"
+	"errors"
 	"flag"
-	"io"
 	"log"
-	"net/http"
 	"os"
+	"time"
 
-	"golang.org/x/crypto/chacha20poly1305"
-	"x3dh-demo/internal/x3dh"
+	"x3dh-demo/internal/client"
+	"x3dh-demo/internal/config"
+	"x3dh-demo/internal/keystore"
+	"x3dh-demo/internal/user"
 )
 
-const serverURL = "http://localhost:8080"
-
-
-
-// BobPrivateKeys holds the long-term private keys for Bob.
-type BobPrivateKeys struct {
-	IKbPriv  []byte `json:"ikb_priv"`
-	SPKbPriv []byte `json:"spkb_priv"`
-	EdPriv   []byte `json:"ed_priv"`
-	OTKbPriv []byte `json:"otkb_priv"`
-}
-
-// --- Helper Functions ---
-
-// encode32(pub) → hex-string
-func encode32(pk [32]byte) string { return hex.EncodeToString(pk[:]) }
-
-// decode32(hex) → [32]byte
-func decode32(s string) (out [32]byte) {
-	raw, err := hex.DecodeString(s)
+func main() {
+	action := flag.String("action", "check", "Action to perform: 'register', 'check', 'replenish', 'rotate-spk', 'approve <device> <ed25519-key>' or 'passphrase'")
+	numOTKs := flag.Int("otks", 20, "Number of one-time prekeys to upload (0 forces the 3-DH handshake)")
+	minOTKs := flag.Int("min-otks", 10, "Replenish when fewer than this many one-time prekeys are left on the server")
+	grace := flag.Duration("spk-grace", 7*24*time.Hour, "How long a rotated-out signed prekey is kept to decrypt in-flight messages")
+	cfg, err := config.Load(flag.CommandLine, os.Args[1:], "bob_private_keys.json", (*config.Config).RegisterClientFlags)
 	if err != nil {
-		panic(err)
+		log.Fatal(err)
 	}
-	copy(out[:], raw)
-	return
-}
-
-func loadEd25519PrivateKey(keyBytes []byte) ed25519.PrivateKey {
-	if len(keyBytes) != ed25519.PrivateKeySize {
-		panic("invalid Ed25519 private key size")
+	bob := &user.User{Name: "bob", Device: cfg.Device, Server: cfg.ServerURL, KeyFile: cfg.KeyFile}
+	bob.Client = client.New(cfg.ServerURL)
+	bob.Client.Timeout, bob.Client.Retries = cfg.Timeout, cfg.Retries
+	// Devices never share keys; keep each one's in its own file.
+	if cfg.Device != "" && bob.KeyFile == "bob_private_keys.json" {
+		bob.KeyFile = "bob_" + cfg.Device + "_private_keys.json"
 	}
-	return ed25519.PrivateKey(keyBytes)
-}
-
-// --- Main Application Logic ---
-
-func main() {
-	action := flag.String("action", "check", "Action to perform: 'register' or 'check'")
-	flag.Parse()
+	bob.Passphrase = keystore.Source(cfg.Passphrase, bob.KeyFile)
 
 	switch *action {
 	case "register":
-		register()
+		register(bob, *numOTKs)
 	case "check":
-		checkMessages()
+		checkMessages(bob)
+	case "replenish":
+		replenish(bob, *numOTKs, *minOTKs)
+	case "rotate-spk":
+		rotateSPK(bob, *grace)
+	case "approve":
+		approve(bob, flag.Args())
+	case "passphrase":
+		changePassphrase(bob)
 	default:
-		log.Fatalf("Invalid action: %s. Use 'register' or 'check'.", *action)
+		log.Fatalf("Invalid action: %s. Use 'register', 'check', 'replenish', 'rotate-spk', 'approve' or 'passphrase'.", *action)
 	}
 }
 
-func register() {
-	// 1. Load or Generate Bob's keys
-	_, err := os.ReadFile("bob_private_keys.json")
-	if os.IsNotExist(err) {
-		log.Println("Generating keys...")
-
-		// Generate X25519 key pairs
-		IKbPriv, IKbPub, err := x3dh.GenKeyPair()
-		if err != nil {
-			log.Fatalf("Failed to generate IKb key pair: %v", err)
-		}
-		SPKbPriv, SPKbPub, err := x3dh.GenKeyPair()
-		if err != nil {
-			log.Fatalf("Failed to generate SPKb key pair: %v", err)
-		}
-		OTKbPriv, OTKbPub, err := x3dh.GenKeyPair()
-		if err != nil {
-			log.Fatalf("Failed to generate OTKb key pair: %v", err)
-		}
-
-		// Generate Ed25519 key pair manually
-		seed := make([]byte, ed25519.SeedSize)
-		if _, err := rand.Read(seed); err != nil {
-			log.Fatalf("Failed to generate Ed25519 seed: %v", err)
-		}
-		edPriv := ed25519.NewKeyFromSeed(seed)
-		edPub := edPriv.Public().(ed25519.PublicKey)
-
-		log.Println("Saving keys...")
-		// Save all private keys
-		keysToSave := BobPrivateKeys{
-			IKbPriv:  IKbPriv.Bytes(),
-			SPKbPriv: SPKbPriv.Bytes(),
-			EdPriv:   []byte(edPriv), // Convert ed25519.PrivateKey to []byte
-			OTKbPriv: OTKbPriv.Bytes(),
-		}
-		blob, _ := json.MarshalIndent(keysToSave, "", "  ")
-		_ = os.WriteFile("bob_private_keys.json", blob, 0600)
-
-		// Sign the SPK with the Ed25519 private key
-		sig := ed25519.Sign(edPriv, SPKbPub[:])
-
-		// Create the bundle to upload
-		bundle := x3dh.Bundle{
-			IK:      encode32(IKbPub),
-			SPK:     encode32(SPKbPub),
-			OTK:     encode32(OTKbPub),
-			Ed25519: hex.EncodeToString(edPub), // edPub is the public key
-			Sig:     hex.EncodeToString(sig),
-		}
-
-		log.Println("Registering with server...")
-		// Upload bundle to server
-		bundleJSON, _ := json.Marshal(bundle)
-		resp, err := http.Post(serverURL+"/register/bob", "application/json", bytes.NewBuffer(bundleJSON))
-		if err != nil {
-			log.Fatalf("Failed to register with server: %v", err)
-		}
-		defer resp.Body.Close()
-
-		if resp.StatusCode != http.StatusOK {
-			body, _ := io.ReadAll(resp.Body)
-			log.Fatalf("Server returned an error during registration: %s - %s", resp.Status, string(body))
-		}
-		log.Println("Registration successful.")
-
-	} else if err == nil {
-		log.Fatal("Keys already exist. Registration should only happen once. To re-register, delete bob_private_keys.json")
-	} else {
-		panic(err)
+// loadKeys stops with a hint when Bob has not registered yet.
+func loadKeys(bob *user.User) {
+	if _, err := bob.Identity(); errors.Is(err, user.ErrNoKeys) {
+		log.Fatal("Private keys not found. Please run with -action=register first.")
+	} else if err != nil {
+		log.Fatalf("Failed to load keys: %v", err)
 	}
 }
 
-func checkMessages() {
-	// 1. Load Bob's private keys. He can't decrypt without them.
-	privateKeyBlob, err := os.ReadFile("bob_private_keys.json")
-	if os.IsNotExist(err) {
-		log.Fatal("Private keys not found. Please run with -action=register first.")
+func register(bob *user.User, numOTKs int) {
+	log.Println("Generating keys...")
+	if err := bob.Init(); errors.Is(err, user.ErrKeysExist) {
+		log.Fatalf("Keys already exist. Registration should only happen once. To re-register, delete %s", bob.KeyFile)
 	} else if err != nil {
-		panic(err)
+		log.Fatalf("Failed to generate keys: %v", err)
 	}
 
-	var loadedKeys BobPrivateKeys
-	if err := json.Unmarshal(privateKeyBlob, &loadedKeys); err != nil {
-		panic(err)
-	}
-	curve := ecdh.X25519()
-	IKbPriv, _ := curve.NewPrivateKey(loadedKeys.IKbPriv)
-	SPKbPriv, _ := curve.NewPrivateKey(loadedKeys.SPKbPriv)
-	OTKbPriv, _ := curve.NewPrivateKey(loadedKeys.OTKbPriv)
+	log.Println("Registering with server...")
+	count, err := bob.Register(numOTKs)
+	if err != nil && bob.Device != "" {
+		// Only Bob's first device may log in without approval.
+		key, _ := bob.SigningKey()
+		log.Printf("If Bob has other devices, approve this one from one of them with -action approve %s %s", bob.Device, key)
+		log.Fatalf("%v (once approved, run -action rotate-spk and -action replenish)", err)
+	} else if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("Registration successful.")
+	if numOTKs > 0 {
+		log.Printf("Uploaded %d one-time prekeys (%d available on server).", numOTKs, count)
+	}
+}
 
-	// 2. Poll the server for new messages
-	resp, err := http.Get(serverURL + "/messages/bob")
-	if err != nil {
-		log.Fatalf("Failed to check for messages: %v", err)
+func approve(bob *user.User, args []string) {
+	loadKeys(bob)
+	if len(args) != 2 {
+		log.Fatal("Usage: -action approve <device> <ed25519-key>")
+	}
+	if err := bob.ApproveDevice(args[0], args[1]); err != nil {
+		log.Fatal(err)
 	}
-	defer resp.Body.Close()
+	log.Printf("Approved device %s.", args[0])
+}
 
-	if resp.StatusCode == http.StatusNotFound {
+func checkMessages(bob *user.User) {
+	loadKeys(bob)
+	received, err := bob.Receive()
+	if err != nil {
+		// Had decryption failed the message is delivered again after its lease
+		// expires; a replayed handshake whose OTK was already used is dropped.
+		log.Fatal(err)
+	}
+	if received == nil {
 		log.Println("No new messages found.")
 		return
 	}
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		log.Fatalf("Server returned an error: %s - %s", resp.Status, string(body))
-	}
 
-	// 3. Decode the message from Alice (new response format)
-	var respData struct {
-		Message      x3dh.InitialMessage `json:"message"`
-		MessagesLeft int            `json:"messages_left"`
+	log.Printf("Received an initial message from %s.", received.Message.Sender)
+	if received.Message.OTKID == 0 {
+		log.Println("No one-time prekey was used; falling back to 3-DH.")
 	}
-	if err := json.NewDecoder(resp.Body).Decode(&respData); err != nil {
-		log.Fatalf("Failed to decode message from server: %v", err)
+	log.Println("Session key derived " + hex.EncodeToString(received.Session.Key[:]))
+	log.Printf("Decrypted message from %s: %s", received.Message.Sender, received.Plaintext)
+	if received.Left > 0 {
+		log.Printf("You still have %d messages left.", received.Left)
 	}
-	msg := respData.Message
-
-	log.Println("Received an initial message from Alice.")
-
-	// 4. Derive the session key
-	IKaPub32 := decode32(msg.AliceIK)
-	EKaPub32 := decode32(msg.AliceEKa)
+}
 
-	// The order of these DH operations must match the order Alice uses
-	// to ensure the KDF produces the same session key.
-	// DH1 = DH(SPKb, IKa)
-	DH1, err := x3dh.DH(SPKbPriv, &IKaPub32)
-	if err != nil {
-		log.Fatalf("DH1 failed: %v", err)
-	}
-	// DH2 = DH(IKb, EKa)
-	DH2, err := x3dh.DH(IKbPriv, &EKaPub32)
+// replenish tops up Bob's one-time prekey pool on the server when it runs low.
+func replenish(bob *user.User, batch, threshold int) {
+	loadKeys(bob)
+	uploaded, count, err := bob.Replenish(batch, threshold)
 	if err != nil {
-		log.Fatalf("DH2 failed: %v", err)
+		log.Fatal(err)
 	}
-	// DH3 = DH(SPKb, EKa)
-	DH3, err := x3dh.DH(SPKbPriv, &EKaPub32)
-	if err != nil {
-		log.Fatalf("DH3 failed: %v", err)
+	if uploaded == 0 {
+		log.Printf("%d one-time prekeys left on server, no need to replenish.", count)
+		return
 	}
-	// DH4 = DH(OTKb, EKa)
-	DH4, err := x3dh.DH(OTKbPriv, &EKaPub32)
+	log.Printf("Uploaded %d one-time prekeys (%d available on server).", uploaded, count)
+}
+
+// rotateSPK replaces Bob's signed prekey. The previous SPK is kept for the
+// grace period so initial messages that reference it can still be read.
+func rotateSPK(bob *user.User, grace time.Duration) {
+	loadKeys(bob)
+	oldID, newID, err := bob.RotateSPK(grace)
 	if err != nil {
-		log.Fatalf("DH4 failed: %v", err)
+		log.Fatal(err)
 	}
+	log.Printf("Rotated signed prekey %d -> %d; old key kept until %s.", oldID, newID, time.Now().Add(grace).Format(time.RFC3339))
+}
 
-	master := x3dh.KDF(DH1, DH2, DH3, DH4)
-	log.Println("Session key derived " + hex.EncodeToString(master[:]))
-
-	// 5. Decrypt the message
-	key := master[:]
-	aead, _ := chacha20poly1305.New(key)
-	nonce, _ := hex.DecodeString(msg.Nonce)
-	ciphertext, _ := hex.DecodeString(msg.Ciphertext)
-	plaintext, err := aead.Open(nil, nonce, ciphertext, nil)
+// changePassphrase encrypts Bob's keys with a new passphrase, or stores
+// them unencrypted if it is empty.
+func changePassphrase(bob *user.User) {
+	loadKeys(bob)
+	pass, err := keystore.NewPassphrase(bob.KeyFile)
 	if err != nil {
-		log.Fatalf("DECRYPTION FAILED: %v", err)
+		log.Fatal(err)
 	}
-	log.Println("Decrypted message from Alice:", string(plaintext))
-
-	if respData.MessagesLeft > 0 {
-		log.Printf("You still have %d messages left.", respData.MessagesLeft)
+	if err := bob.ChangePassphrase(pass); err != nil {
+		log.Fatal(err)
+	}
+	if len(pass) == 0 {
+		log.Printf("Keys in %s are stored unencrypted.", bob.KeyFile)
+		return
 	}
+	log.Printf("Keys in %s are encrypted with the new passphrase.", bob.KeyFile)
 }
@@ -0,0 +1,48 @@
+package main
+
+import "strings"
+
+// defaultDevice is the device a user has when none is named. Its address is
+// the bare user name, so data stored before devices existed stays reachable.
+const defaultDevice = "default"
+
+// Everything the server keeps per device — bundle, OTK pool, mailbox, pinned
+// identity and tokens — is keyed by a mailbox address: "bob" for Bob's
+// default device and "bob/phone" for his device "phone". The Store calls
+// this address "user".
+
+// deviceAddress returns the mailbox address of a user's device.
+func deviceAddress(user, device string) string {
+	if device == "" || device == defaultDevice {
+		return user
+	}
+	return user + "/" + device
+}
+
+// splitAddress splits a mailbox address into its user and device.
+func splitAddress(addr string) (user, device string) {
+	user, device, ok := strings.Cut(addr, "/")
+	if !ok {
+		return addr, defaultDevice
+	}
+	return user, device
+}
+
+// parseAddress reads "{user}" or "{user}/{device}" after prefix in a request
+// path and returns the mailbox address. It reports false if the user is
+// missing or there are extra path segments.
+func parseAddress(path, prefix string) (string, bool) {
+	parts := strings.Split(strings.TrimPrefix(path, prefix), "/")
+	for _, p := range parts {
+		if p == "" {
+			return "", false
+		}
+	}
+	switch len(parts) {
+	case 1:
+		return parts[0], true
+	case 2:
+		return deviceAddress(parts[0], parts[1]), true
+	}
+	return "", false
+}
@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestParseAddress(t *testing.T) {
+	tests := map[string]string{
+		"/send/bob":         "bob",
+		"/send/bob/phone":   "bob/phone",
+		"/send/bob/default": "bob",
+	}
+	for path, want := range tests {
+		if got, ok := parseAddress(path, "/send/"); !ok || got != want {
+			t.Errorf("parseAddress(%q) = %q, %v; want %q", path, got, ok, want)
+		}
+	}
+	for _, path := range []string{"/send/", "/send/bob/", "/send//phone", "/send/bob/phone/x"} {
+		if _, ok := parseAddress(path, "/send/"); ok {
+			t.Errorf("parseAddress(%q) should fail", path)
+		}
+	}
+	if user, device := splitAddress("bob"); user != "bob" || device != defaultDevice {
+		t.Errorf("splitAddress(bob) = %q, %q", user, device)
+	}
+	if user, device := splitAddress("bob/phone"); user != "bob" || device != "phone" {
+		t.Errorf("splitAddress(bob/phone) = %q, %q", user, device)
+	}
+}
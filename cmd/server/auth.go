@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"x3dh-demo/internal/x3dh"
+)
+
+const (
+	// challengeTTL is how long a client has to answer a challenge.
+	challengeTTL = 2 * time.Minute
+	// tokenTTL is how long an issued bearer token stays valid.
+	tokenTTL = 10 * time.Minute
+)
+
+var (
+	// ErrBadChallenge is returned when a nonce is unknown, expired, already
+	// used or was issued for a different user.
+	ErrBadChallenge = errors.New("unknown or expired challenge")
+	// ErrBadSignature is returned when the challenge signature does not verify.
+	ErrBadSignature = errors.New("invalid challenge signature")
+	// ErrIdentityMismatch is returned when a user authenticates with an
+	// Ed25519 key other than the one pinned for that user.
+	ErrIdentityMismatch = errors.New("identity key does not match the registered key")
+	// ErrDeviceNotApproved is returned when a new device of a user who
+	// already has devices logs in before one of them approved its key.
+	ErrDeviceNotApproved = errors.New("device has not been approved by another device of the user")
+)
+
+// authGrant is what a challenge or token was issued for.
+type authGrant struct {
+	user    string
+	ed25519 string // pinned Ed25519 key the token was issued for
+	expires time.Time
+}
+
+// Authenticator issues challenges and short-lived bearer tokens. Both live
+// only in process memory: a restart simply forces clients to log in again.
+type Authenticator struct {
+	mu         sync.Mutex
+	challenges map[string]authGrant // by nonce
+	tokens     map[string]authGrant // by token
+	now        func() time.Time
+}
+
+// NewAuthenticator creates an empty authenticator.
+func NewAuthenticator() *Authenticator {
+	return &Authenticator{
+		challenges: make(map[string]authGrant),
+		tokens:     make(map[string]authGrant),
+		now:        time.Now,
+	}
+}
+
+func randomHex(n int) string {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+// prune drops expired challenges and tokens. The caller holds a.mu.
+func (a *Authenticator) prune(now time.Time) {
+	for nonce, g := range a.challenges {
+		if now.After(g.expires) {
+			delete(a.challenges, nonce)
+		}
+	}
+	for token, g := range a.tokens {
+		if now.After(g.expires) {
+			delete(a.tokens, token)
+		}
+	}
+}
+
+// Challenge issues a fresh nonce for user.
+func (a *Authenticator) Challenge(user string) x3dh.AuthChallenge {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := a.now()
+	a.prune(now)
+	nonce := randomHex(32)
+	a.challenges[nonce] = authGrant{user: user, expires: now.Add(challengeTTL)}
+	return x3dh.AuthChallenge{Nonce: nonce, ExpiresIn: int(challengeTTL / time.Second)}
+}
+
+// consumeChallenge removes a nonce, reporting whether it was valid for user.
+// A nonce can be answered only once, successful or not.
+func (a *Authenticator) consumeChallenge(user, nonce string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	g, ok := a.challenges[nonce]
+	delete(a.challenges, nonce)
+	return ok && g.user == user && !a.now().After(g.expires)
+}
+
+// issueToken records a new bearer token for user and its pinned key.
+func (a *Authenticator) issueToken(user, edKey string) x3dh.AuthToken {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	token := randomHex(32)
+	a.tokens[token] = authGrant{user: user, ed25519: edKey, expires: a.now().Add(tokenTTL)}
+	return x3dh.AuthToken{Token: token, ExpiresIn: int(tokenTTL / time.Second)}
+}
+
+// Lookup returns the grant behind a bearer token, if it is still valid.
+func (a *Authenticator) Lookup(token string) (authGrant, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	g, ok := a.tokens[token]
+	if !ok || a.now().After(g.expires) {
+		return authGrant{}, false
+	}
+	return g, true
+}
+
+// Authenticate checks a signed challenge and issues a token. The first key
+// a user's first device authenticates with is pinned (trust on first use);
+// the keys of later devices must have been pinned by ApproveDevice, so
+// nobody can add a device to someone else's account and receive copies of
+// their messages. Users registered before pinning existed are pinned to the
+// key in their current bundle.
+func (s *ServerState) Authenticate(ctx context.Context, user string, resp x3dh.AuthResponse) (x3dh.AuthToken, error) {
+	if !s.auth.consumeChallenge(user, resp.Nonce) {
+		return x3dh.AuthToken{}, ErrBadChallenge
+	}
+	pub, err := hex.DecodeString(resp.Ed25519)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return x3dh.AuthToken{}, ErrBadSignature
+	}
+	sig, err := hex.DecodeString(resp.Signature)
+	if err != nil || !ed25519.Verify(pub, x3dh.AuthPayload(user, resp.Nonce), sig) {
+		return x3dh.AuthToken{}, ErrBadSignature
+	}
+
+	var pinned string
+	if bundle, exists := s.GetBundle(ctx, user); exists {
+		candidate := resp.Ed25519
+		if bundle.Ed25519 != "" {
+			candidate = bundle.Ed25519
+		}
+		pinned, err = s.store.PinIdentity(ctx, user, candidate)
+	} else {
+		pinned, err = s.store.ClaimIdentity(ctx, user, resp.Ed25519)
+	}
+	if err != nil {
+		return x3dh.AuthToken{}, err
+	}
+	if pinned == "" {
+		return x3dh.AuthToken{}, ErrDeviceNotApproved
+	}
+	if pinned != resp.Ed25519 {
+		return x3dh.AuthToken{}, ErrIdentityMismatch
+	}
+	s.touch(ctx, user)
+	return s.auth.issueToken(user, pinned), nil
+}
+
+// ApproveDevice pins edKey for the device at user so it can log in although
+// the user already has other devices. A device keeps the key it has.
+func (s *ServerState) ApproveDevice(ctx context.Context, user, edKey string) error {
+	pinned, err := s.store.PinIdentity(ctx, user, edKey)
+	if err != nil {
+		return err
+	}
+	if pinned != edKey {
+		return ErrIdentityMismatch
+	}
+	return nil
+}
+
+// requireAuth checks the request's bearer token against the mailbox address
+// user and writes a 401 or 403 response if it does not grant access. The
+// grant is returned so handlers can check the authenticated key.
+func requireAuth(w http.ResponseWriter, r *http.Request, user string) (authGrant, bool) {
+	return checkAuth(w, r, user, func(g authGrant) bool { return g.user == user })
+}
+
+// requireAccount is requireAuth for a token of any of user's devices.
+func requireAccount(w http.ResponseWriter, r *http.Request, user string) (authGrant, bool) {
+	return checkAuth(w, r, user, func(g authGrant) bool {
+		owner, _ := splitAddress(g.user)
+		return owner == user
+	})
+}
+
+func checkAuth(w http.ResponseWriter, r *http.Request, user string, match func(authGrant) bool) (authGrant, bool) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Authentication required", http.StatusUnauthorized)
+		return authGrant{}, false
+	}
+	grant, ok := serverState.auth.Lookup(token)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+		return authGrant{}, false
+	}
+	if !match(grant) {
+		http.Error(w, "Token does not grant access to user: "+user, http.StatusForbidden)
+		return authGrant{}, false
+	}
+	return grant, true
+}
+
+// challengeHandler issues a nonce for POST /auth/challenge/{user}[/{device}].
+func challengeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	user, ok := parseAddress(r.URL.Path, "/auth/challenge/")
+	if !ok {
+		http.Error(w, "Invalid user or device", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(serverState.auth.Challenge(user))
+}
+
+// tokenHandler exchanges a signed challenge for a bearer token at
+// POST /auth/token/{user}[/{device}]. The challenge is signed for the
+// mailbox address, e.g. "bob/phone".
+func tokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	user, ok := parseAddress(r.URL.Path, "/auth/token/")
+	if !ok {
+		http.Error(w, "Invalid user or device", http.StatusBadRequest)
+		return
+	}
+	var resp x3dh.AuthResponse
+	if err := json.NewDecoder(r.Body).Decode(&resp); err != nil {
+		http.Error(w, "Failed to decode challenge response: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	token, err := serverState.Authenticate(r.Context(), user, resp)
+	switch {
+	case errors.Is(err, ErrBadChallenge), errors.Is(err, ErrBadSignature):
+		http.Error(w, "Authentication failed: "+err.Error(), http.StatusUnauthorized)
+		return
+	case errors.Is(err, ErrIdentityMismatch):
+		http.Error(w, "Authentication failed: "+err.Error(), http.StatusForbidden)
+		return
+	case errors.Is(err, ErrDeviceNotApproved):
+		writeError(w, http.StatusForbidden, codeDeviceNotApproved, "", "Authentication failed: "+err.Error())
+		return
+	case err != nil:
+		http.Error(w, "Failed to authenticate: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(token)
+}
+
+// approveHandler pins the Ed25519 key of a new device at
+// POST /devices/{user}/{device}. It takes a token of another device of the
+// same user; the key in the body must be hex.
+func approveHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := parseAddress(r.URL.Path, "/devices/")
+	if !ok {
+		http.Error(w, "Invalid user or device", http.StatusBadRequest)
+		return
+	}
+	owner, _ := splitAddress(user)
+	if _, ok := requireAccount(w, r, owner); !ok {
+		return
+	}
+	var approval x3dh.DeviceApproval
+	if err := json.NewDecoder(r.Body).Decode(&approval); err != nil {
+		writeError(w, http.StatusBadRequest, codeMalformedRequest, "", "Failed to decode device approval: "+err.Error())
+		return
+	}
+	if key, err := hex.DecodeString(approval.Ed25519); err != nil || len(key) != ed25519.PublicKeySize {
+		writeError(w, http.StatusUnprocessableEntity, codeMalformedKey, "ed25519", "Invalid Ed25519 key")
+		return
+	}
+	err := serverState.ApproveDevice(r.Context(), user, approval.Ed25519)
+	switch {
+	case errors.Is(err, ErrIdentityMismatch):
+		writeError(w, http.StatusForbidden, codeIdentityMismatch, "ed25519", "Device is already pinned to another key: "+user)
+		return
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, codeInternal, "", "Failed to approve device: "+err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
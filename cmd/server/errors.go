@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"x3dh-demo/internal/x3dh"
+)
+
+// Error codes returned in structured error responses. Clients should branch
+// on the code; the message is for humans and may change.
+const (
+	codeMalformedRequest   = "malformed_request"
+	codeMalformedKey       = "malformed_key"
+	codeLowOrderKey        = "low_order_key"
+	codeMalformedSignature = "malformed_signature"
+	codeInvalidSignature   = "invalid_signature"
+	codeMissingOTKID       = "missing_otk_id"
+	codeIdentityMismatch   = "identity_mismatch"
+	codeDeviceNotApproved  = "device_not_approved"
+	codeTooManyWaiters     = "too_many_waiters"
+	codeMailboxFull        = "mailbox_full"
+	codeInternal           = "internal_error"
+)
+
+// apiError is the JSON body of a structured error response.
+type apiError struct {
+	Code    string `json:"code"`
+	Field   string `json:"field,omitempty"`
+	Message string `json:"error"`
+}
+
+// writeError sends a structured error response. field names the offending
+// JSON field and may be empty.
+func writeError(w http.ResponseWriter, status int, code, field, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(apiError{Code: code, Field: field, Message: message})
+}
+
+// validationCode maps an x3dh validation error to its error code.
+func validationCode(err error) string {
+	switch {
+	case errors.Is(err, x3dh.ErrLowOrderPoint):
+		return codeLowOrderKey
+	case errors.Is(err, x3dh.ErrMalformedKey):
+		return codeMalformedKey
+	case errors.Is(err, x3dh.ErrMalformedSignature):
+		return codeMalformedSignature
+	case errors.Is(err, x3dh.ErrInvalidSignature):
+		return codeInvalidSignature
+	case errors.Is(err, x3dh.ErrMissingOTKID):
+		return codeMissingOTKID
+	default:
+		return codeMalformedRequest
+	}
+}
+
+// writeValidationError reports a failed x3dh validation as 422 Unprocessable Entity.
+func writeValidationError(w http.ResponseWriter, err error) {
+	var field string
+	var be *x3dh.BundleError
+	if errors.As(err, &be) {
+		field = be.Field
+	}
+	writeError(w, http.StatusUnprocessableEntity, validationCode(err), field, err.Error())
+}
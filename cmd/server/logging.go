@@ -0,0 +1,29 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+
+	"x3dh-demo/internal/config"
+)
+
+// The server logs through one logger per level. setupLogging discards the
+// levels the configuration leaves out; errors that stop the server are
+// always printed by log.Fatal.
+var (
+	debugLog = log.New(io.Discard, "", log.LstdFlags)
+	infoLog  = log.New(os.Stderr, "", log.LstdFlags)
+	warnLog  = log.New(os.Stderr, "Warning: ", log.LstdFlags|log.Lmsgprefix)
+)
+
+// setupLogging applies X3DH_LOG_LEVEL and X3DH_ENABLE_LOGGING.
+func setupLogging(cfg *config.Config) {
+	for level, l := range map[string]*log.Logger{"debug": debugLog, "info": infoLog, "warn": warnLog} {
+		if cfg.Logs(level) {
+			l.SetOutput(os.Stderr)
+		} else {
+			l.SetOutput(io.Discard)
+		}
+	}
+}
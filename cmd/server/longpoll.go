@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"x3dh-demo/internal/x3dh"
+)
+
+const (
+	// maxWait caps the ?wait= duration of a long-poll.
+	maxWait = 60 * time.Second
+)
+
+// ErrTooManyWaiters is returned when a user already has the maximum number
+// of long-polls and WebSockets open.
+var ErrTooManyWaiters = errors.New("too many concurrent waiters")
+
+// waiterLimit counts the long-polls and WebSockets each user has open, so
+// one client cannot tie up the server with idle connections.
+type waiterLimit struct {
+	mu    sync.Mutex
+	max   int
+	count map[string]int
+}
+
+func newWaiterLimit(max int) *waiterLimit {
+	return &waiterLimit{max: max, count: make(map[string]int)}
+}
+
+// acquire takes a waiter slot for user; the returned func gives it back.
+func (l *waiterLimit) acquire(user string) (func(), error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.count[user] >= l.max {
+		return nil, ErrTooManyWaiters
+	}
+	l.count[user]++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			if l.count[user]--; l.count[user] == 0 {
+				delete(l.count, user)
+			}
+		})
+	}, nil
+}
+
+// parseDurationParam reads a query parameter given as a Go duration ("30s")
+// or a plain number of seconds ("30"). Negative values are rejected.
+func parseDurationParam(name, v string) (time.Duration, error) {
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		secs, serr := strconv.Atoi(v)
+		if serr != nil {
+			return 0, fmt.Errorf("invalid %s %q", name, v)
+		}
+		d = time.Duration(secs) * time.Second
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("invalid %s %q", name, v)
+	}
+	return d, nil
+}
+
+// parseWait reads the ?wait= parameter. Longer waits are capped at maxWait.
+func parseWait(v string) (time.Duration, error) {
+	if v == "" {
+		return 0, nil
+	}
+	d, err := parseDurationParam("wait", v)
+	if err != nil {
+		return 0, err
+	}
+	if d > maxWait {
+		d = maxWait
+	}
+	return d, nil
+}
+
+// WaitForMessage leases the oldest message for a user, waiting up to
+// timeout for one to arrive. It returns ErrNotFound on timeout and gives up
+// early, without leasing anything, when ctx is cancelled (for example
+// because the client disconnected).
+func (s *ServerState) WaitForMessage(ctx context.Context, userID string, timeout time.Duration) (*x3dh.InitialMessage, int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	// Subscribe before checking the queue so no push in between is missed.
+	wake, err := s.store.Subscribe(ctx, userID)
+	if err != nil {
+		return nil, 0, err
+	}
+	for {
+		if ctx.Err() != nil {
+			return nil, 0, ErrNotFound
+		}
+		msg, left, err := s.LeaseMessage(ctx, userID)
+		if !errors.Is(err, ErrNotFound) {
+			return msg, left, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, 0, ErrNotFound
+		case <-wake:
+		}
+	}
+}
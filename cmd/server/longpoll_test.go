@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"x3dh-demo/internal/x3dh"
+)
+
+// waiterCount reports how many waiter slots user holds.
+func waiterCount(user string) int {
+	serverState.waiters.mu.Lock()
+	defer serverState.waiters.mu.Unlock()
+	return serverState.waiters.count[user]
+}
+
+// waitForWaiters polls until user holds n waiter slots.
+func waitForWaiters(t *testing.T, user string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for waiterCount(user) != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d waiters for %s, have %d", n, user, waiterCount(user))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestLongPoll(t *testing.T) {
+	ts := newTestServer(t)
+	token := login(t, ts.URL, "bob", testEdKey(1))
+
+	start := time.Now()
+	if code := authGet(t, ts.URL+"/messages/bob?wait=200ms", token, nil); code != http.StatusNotFound {
+		t.Fatalf("timed-out wait returned %d", code)
+	}
+	if time.Since(start) < 200*time.Millisecond {
+		t.Fatal("wait returned before the timeout")
+	}
+	if code := authGet(t, ts.URL+"/messages/bob?wait=soon", token, nil); code != http.StatusBadRequest {
+		t.Fatalf("invalid wait returned %d", code)
+	}
+
+	done := make(chan string)
+	go func() {
+		var got struct {
+			Message x3dh.InitialMessage `json:"message"`
+		}
+		authGet(t, ts.URL+"/messages/bob?wait=5", token, &got)
+		done <- got.Message.Ciphertext
+	}()
+	waitForWaiters(t, "bob", 1)
+	postJSON(t, ts.URL+"/send/bob", x3dh.InitialMessage{Sender: "alice", Ciphertext: "hello"}).Body.Close()
+	select {
+	case got := <-done:
+		if got != "hello" {
+			t.Fatalf("long-poll returned %q", got)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("long-poll was not woken by the new message")
+	}
+	waitForWaiters(t, "bob", 0)
+}
+
+func TestLongPollWaiterLimit(t *testing.T) {
+	ts := newTestServer(t)
+	serverState.waiters = newWaiterLimit(1)
+	token := login(t, ts.URL, "bob", testEdKey(1))
+
+	// A client that disconnects gives its slot back.
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+"/messages/bob?wait=30s", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	errc := make(chan error, 1)
+	go func() {
+		_, err := http.DefaultClient.Do(req)
+		errc <- err
+	}()
+	waitForWaiters(t, "bob", 1)
+
+	if code := authGet(t, ts.URL+"/messages/bob?wait=1s", token, nil); code != http.StatusTooManyRequests {
+		t.Fatalf("second waiter returned %d", code)
+	}
+	// Without ?wait= the limit does not apply.
+	if code := authGet(t, ts.URL+"/messages/bob", token, nil); code != http.StatusNotFound {
+		t.Fatalf("plain fetch returned %d", code)
+	}
+
+	cancel()
+	<-errc
+	waitForWaiters(t, "bob", 0)
+}
+
+func TestParseWait(t *testing.T) {
+	tests := map[string]time.Duration{
+		"":      0,
+		"30s":   30 * time.Second,
+		"15":    15 * time.Second,
+		"500ms": 500 * time.Millisecond,
+		"10m":   maxWait,
+	}
+	for in, want := range tests {
+		if got, err := parseWait(in); err != nil || got != want {
+			t.Errorf("parseWait(%q) = %v, %v; want %v", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"-1s", "soon"} {
+		if _, err := parseWait(in); err == nil {
+			t.Errorf("parseWait(%q) should fail", in)
+		}
+	}
+}
@@ -3,119 +3,321 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
 	"net/http"
-	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/redis/go-redis/v9"
+	"x3dh-demo/internal/config"
 	"x3dh-demo/internal/x3dh"
 )
 
-var (
-	rdb = redis.NewClient(&redis.Options{
-		Addr: "localhost:6379",
-	})
-	ctx = context.Background()
+// Names of the persisted counters behind the Total* statistics.
+const (
+	counterBundlesRegistered = "bundles_registered"
+	counterMessagesReceived  = "messages_received"
+	counterMessagesDelivered = "messages_delivered"
+	counterMessagesExpired   = "messages_expired"
+	counterBundlesExpired    = "bundles_expired"
 )
 
-// ServerStats tracks server statistics
+// ServerStats is a snapshot of the server statistics. The totals are
+// persisted by the store and survive restarts; the rest is counted from the
+// store when the snapshot is taken.
 type ServerStats struct {
-	TotalBundlesRegistered int64         `json:"total_bundles_registered"`
-	TotalMessagesReceived  int64         `json:"total_messages_received"`
-	TotalMessagesDelivered int64         `json:"total_messages_delivered"`
-	ActiveBundles          int           `json:"active_bundles"`
-	PendingMessages        int           `json:"pending_messages"`
-	Uptime                 time.Duration `json:"uptime"`
-	StartTime              time.Time     `json:"start_time"`
+	TotalBundlesRegistered int64                `json:"total_bundles_registered"`
+	TotalMessagesReceived  int64                `json:"total_messages_received"`
+	TotalMessagesDelivered int64                `json:"total_messages_delivered"`
+	TotalMessagesExpired   int64                `json:"total_messages_expired"`
+	TotalBundlesExpired    int64                `json:"total_bundles_expired"`
+	ActiveBundles          int                  `json:"active_bundles"`
+	PendingMessages        int                  `json:"pending_messages"`
+	Users                  map[string]UserStats `json:"users,omitempty"`
+	Uptime                 time.Duration        `json:"uptime"`
+	StartTime              time.Time            `json:"start_time"`
 }
 
-// ServerState manages the in-memory storage
+// UserStats is the per-user part of ServerStats.
+type UserStats struct {
+	PendingMessages int64 `json:"pending_messages"`
+	OneTimePreKeys  int64 `json:"one_time_prekeys"`
+}
+
+// ServerState ties the HTTP handlers to the storage backend
 type ServerState struct {
-	stats    *ServerStats
+	store   Store
+	started time.Time
+	auth    *Authenticator
+	metrics *Metrics
+	// waiters limits concurrent long-polls and WebSockets per user
+	waiters *waiterLimit
+	// lease is how long a fetched message waits for its acknowledgement
+	lease time.Duration
+	// messageTTL caps how long a message waits for delivery
+	messageTTL time.Duration
+	// mailboxSize caps the messages held per user, 0 for no limit
+	mailboxSize int
+
+	touchMu sync.Mutex
+	// touched is when each user's activity was last recorded by touch
+	touched map[string]time.Time
 }
 
-// NewServerState creates a new server state instance
-func NewServerState() *ServerState {
+// NewServerState creates a new server state instance backed by store
+func NewServerState(store Store) *ServerState {
+	metrics := NewMetrics()
+	defaults := config.Default("")
 	state := &ServerState{
-		stats: &ServerStats{
-			StartTime: time.Now(),
-		},
+		store:       meteredStore{store: store, metrics: metrics},
+		started:     time.Now(),
+		auth:        NewAuthenticator(),
+		metrics:     metrics,
+		waiters:     newWaiterLimit(defaults.MaxWaiters),
+		lease:       defaults.LeaseTimeout,
+		messageTTL:  defaults.MessageTTL,
+		mailboxSize: defaults.MailboxSize,
+		touched:     make(map[string]time.Time),
 	}
 	return state
 }
 
-// updateStats updates server statistics
-func (s *ServerState) updateStats() {
-	s.stats.Uptime = time.Since(s.stats.StartTime)
-	s.stats.ActiveBundles = 0 
-	s.stats.PendingMessages = 0 // Redis 
+// count adds delta to a persisted counter. A failure only skews /stats, so
+// it is logged rather than returned.
+func (s *ServerState) count(ctx context.Context, name string, delta int64) {
+	if delta == 0 {
+		return
+	}
+	if err := s.store.IncrCounter(ctx, name, delta); err != nil {
+		warnLog.Printf("Failed to update %s counter: %v", name, err)
+	}
+}
+
+// touch records that a user is active so their bundle does not expire. It
+// writes to the store at most once per touchInterval per user; a failure only
+// brings the expiry closer, so it is logged rather than returned.
+func (s *ServerState) touch(ctx context.Context, user string) {
+	now := time.Now()
+	s.touchMu.Lock()
+	if now.Sub(s.touched[user]) < touchInterval {
+		s.touchMu.Unlock()
+		return
+	}
+	s.touched[user] = now
+	s.touchMu.Unlock()
+	if err := s.store.TouchBundle(ctx, user, now); err != nil {
+		warnLog.Printf("Failed to record activity for %s: %v", user, err)
+	}
+}
+
+// forgetTouches drops the touch times older than touchInterval, which no
+// longer hold back a write.
+func (s *ServerState) forgetTouches(now time.Time) {
+	s.touchMu.Lock()
+	defer s.touchMu.Unlock()
+	for user, t := range s.touched {
+		if now.Sub(t) >= touchInterval {
+			delete(s.touched, user)
+		}
+	}
 }
 
 // GetStats returns current server statistics
-func (s *ServerState) GetStats() ServerStats {
-	s.updateStats()
-	return *s.stats
+func (s *ServerState) GetStats(ctx context.Context) (ServerStats, error) {
+	stats := ServerStats{
+		Uptime:    time.Since(s.started),
+		StartTime: s.started,
+		Users:     make(map[string]UserStats),
+	}
+	counters, err := s.store.Counters(ctx)
+	if err != nil {
+		return stats, err
+	}
+	stats.TotalBundlesRegistered = counters[counterBundlesRegistered]
+	stats.TotalMessagesReceived = counters[counterMessagesReceived]
+	stats.TotalMessagesDelivered = counters[counterMessagesDelivered]
+	stats.TotalMessagesExpired = counters[counterMessagesExpired]
+	stats.TotalBundlesExpired = counters[counterBundlesExpired]
+
+	bundles, err := s.store.CountBundles(ctx)
+	if err != nil {
+		return stats, err
+	}
+	stats.ActiveBundles = int(bundles)
+	mailboxes, err := s.store.MailboxSizes(ctx)
+	if err != nil {
+		return stats, err
+	}
+	for user, n := range mailboxes {
+		stats.PendingMessages += int(n)
+		stats.Users[user] = UserStats{PendingMessages: n}
+	}
+	pools, err := s.store.OTKPoolSizes(ctx)
+	if err != nil {
+		return stats, err
+	}
+	for user, n := range pools {
+		u := stats.Users[user]
+		u.OneTimePreKeys = n
+		stats.Users[user] = u
+	}
+	return stats, nil
 }
 
-// RegisterBundle registers a new bundle for a user
-func (s *ServerState) RegisterBundle(userID string, bundle x3dh.Bundle) error {
-	data, _ := json.Marshal(bundle)
-	if err := rdb.Set(ctx, "bundle:"+userID, data, 0).Err(); err != nil {
+// RegisterBundle registers a new bundle for a user. A one-time prekey sent
+// inline with the bundle is moved into the user's OTK pool. If the identity
+// key changed, OTKs published under the old identity are discarded.
+func (s *ServerState) RegisterBundle(ctx context.Context, userID string, bundle x3dh.Bundle) error {
+	if old, exists := s.GetBundle(ctx, userID); exists && old.IK != bundle.IK {
+		if err := s.store.ClearOneTimePreKeys(ctx, userID); err != nil {
+			return err
+		}
+	}
+	if bundle.OTK != "" {
+		otk := x3dh.OneTimePreKey{ID: bundle.OTKID, Key: bundle.OTK}
+		if err := s.AddOneTimePreKeys(ctx, userID, []x3dh.OneTimePreKey{otk}); err != nil {
+			return err
+		}
+	}
+	bundle.OTK, bundle.OTKID = "", 0
+	bundle.Device = ""
+	if err := s.store.PutBundle(ctx, userID, bundle); err != nil {
 		return err
 	}
-	s.stats.TotalBundlesRegistered++
+	s.count(ctx, counterBundlesRegistered, 1)
 	return nil
 }
 
-// GetBundle retrieves a bundle for a user
-func (s *ServerState) GetBundle(userID string) (*x3dh.Bundle, bool) {
-	data, err := rdb.Get(ctx, "bundle:"+userID).Result()
-	if err == redis.Nil {
+// GetBundle retrieves a bundle for a user, without a one-time prekey
+func (s *ServerState) GetBundle(ctx context.Context, userID string) (*x3dh.Bundle, bool) {
+	bundle, err := s.store.GetBundle(ctx, userID)
+	if errors.Is(err, ErrNotFound) {
 		return nil, false
 	} else if err != nil {
-		log.Printf("Warning: Failed to fetch bundle: %v", err)
+		warnLog.Printf("Failed to fetch bundle: %v", err)
 		return nil, false
 	}
-	var bundle x3dh.Bundle
-	if err := json.Unmarshal([]byte(data), &bundle); err != nil {
-		log.Printf("Warning: Failed to decode bundle: %v", err)
+	return bundle, true
+}
+
+// FetchBundle retrieves a bundle for a user and atomically pops one OTK from
+// the pool into it, so no two initiators are handed the same one-time key.
+// When the pool is empty the bundle is returned without an OTK.
+func (s *ServerState) FetchBundle(ctx context.Context, userID string) (*x3dh.Bundle, bool) {
+	bundle, exists := s.GetBundle(ctx, userID)
+	if !exists {
 		return nil, false
 	}
-	return &bundle, true
+	_, bundle.Device = splitAddress(userID)
+	otk, err := s.store.PopOneTimePreKey(ctx, userID)
+	if errors.Is(err, ErrNotFound) {
+		warnLog.Printf("OTK pool for %s is empty", userID)
+		s.metrics.BundleFetched(userID, false)
+		return bundle, true
+	} else if err != nil {
+		warnLog.Printf("Failed to pop OTK: %v", err)
+		s.metrics.BundleFetched(userID, false)
+		return bundle, true
+	}
+	bundle.OTK, bundle.OTKID = otk.Key, otk.ID
+	s.metrics.BundleFetched(userID, true)
+	return bundle, true
 }
 
-// StoreMessage stores a message for a user
-func (s *ServerState) StoreMessage(userID string, message x3dh.InitialMessage) error {
-	data, _ := json.Marshal(message)
-	if err := rdb.RPush(ctx, "messages:"+userID, data).Err(); err != nil {
+// ListDevices returns the devices of a user that have a bundle
+func (s *ServerState) ListDevices(ctx context.Context, user string) ([]string, error) {
+	return s.store.ListDevices(ctx, user)
+}
+
+// FetchBundles fetches a bundle, each with its own one-time prekey, for
+// every device of a user
+func (s *ServerState) FetchBundles(ctx context.Context, user string) ([]*x3dh.Bundle, error) {
+	devices, err := s.store.ListDevices(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	var bundles []*x3dh.Bundle
+	for _, device := range devices {
+		// A device may have expired since it was listed.
+		if bundle, exists := s.FetchBundle(ctx, deviceAddress(user, device)); exists {
+			bundles = append(bundles, bundle)
+		}
+	}
+	return bundles, nil
+}
+
+// AddOneTimePreKeys adds a batch of one-time prekeys to a user's pool
+func (s *ServerState) AddOneTimePreKeys(ctx context.Context, userID string, otks []x3dh.OneTimePreKey) error {
+	if err := s.store.AddOneTimePreKeys(ctx, userID, otks); err != nil {
 		return err
 	}
-	s.stats.TotalMessagesReceived++
+	s.touch(ctx, userID)
 	return nil
 }
 
-// GetAndDeleteMessage retrieves and deletes a message for a user
-func (s *ServerState) GetAndDeleteMessage(userID string) (*x3dh.InitialMessage, int, bool) {
-	data, err := rdb.LPop(ctx, "messages:"+userID).Result()
-	if err == redis.Nil {
-		return nil, 0, false
-	} else if err != nil {
-		log.Printf("Warning: Failed to fetch message: %v", err)
-		return nil, 0, false
+// CountOneTimePreKeys returns the number of unused OTKs left for a user
+func (s *ServerState) CountOneTimePreKeys(ctx context.Context, userID string) (int64, error) {
+	return s.store.CountOneTimePreKeys(ctx, userID)
+}
+
+// StoreMessage stores a message for a user under a fresh message id. The
+// message is discarded if it is not delivered within ttl. ErrMailboxFull is
+// returned if the user's mailbox is at its limit.
+func (s *ServerState) StoreMessage(ctx context.Context, userID string, message x3dh.InitialMessage, ttl time.Duration) error {
+	message.ID = newMessageID()
+	message.ExpiresAt = time.Now().Add(ttl).Unix()
+	if err := s.store.PushMessage(ctx, userID, message, s.mailboxSize); err != nil {
+		return err
 	}
-	var msg x3dh.InitialMessage
-	if err := json.Unmarshal([]byte(data), &msg); err != nil {
-		log.Printf("Warning: Failed to decode message: %v", err)
-		return nil, 0, false
+	s.count(ctx, counterMessagesReceived, 1)
+	return nil
+}
+
+// LeaseMessage hands out the oldest message for a user, reporting how many
+// are left. The message stays in flight until it is acknowledged with
+// AckMessage; if that does not happen within the lease it is delivered again.
+// Fetching counts as activity, even when the mailbox is empty.
+func (s *ServerState) LeaseMessage(ctx context.Context, userID string) (*x3dh.InitialMessage, int64, error) {
+	s.touch(ctx, userID)
+	return s.store.LeaseMessage(ctx, userID, s.lease)
+}
+
+// AckMessage confirms delivery of an in-flight message and deletes it
+func (s *ServerState) AckMessage(ctx context.Context, userID, id string) error {
+	if err := s.store.AckMessage(ctx, userID, id); err != nil {
+		return err
 	}
-	s.stats.TotalMessagesDelivered++
-	return &msg, 0, true
+	s.count(ctx, counterMessagesDelivered, 1)
+	return nil
+}
+
+// GetMessages returns all queued messages for a user without deleting them
+func (s *ServerState) GetMessages(ctx context.Context, userID string) ([]x3dh.InitialMessage, error) {
+	return s.store.ListMessages(ctx, userID)
 }
 
+// touchInterval is how often a user's activity is written to the store at
+// most, so clients that poll do not rewrite their bundle on every fetch.
+const touchInterval = time.Minute
+
+// mailboxRetryAfter is when a sender turned away by a full mailbox is asked
+// to try again; the mailbox drains as its owner fetches messages.
+const mailboxRetryAfter = time.Minute
+
+// shutdownTimeout is how long the server waits for requests in progress
+// when it is told to stop.
+const shutdownTimeout = 5 * time.Second
+
 // --- Global server state ---
-var serverState = NewServerState()
+var serverState *ServerState
 
 // --- HTTP Handlers ---
 
@@ -124,55 +326,180 @@ func registerHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 		return
 	}
-	user := strings.TrimPrefix(r.URL.Path, "/register/")
-	if user == "" {
-		http.Error(w, "User not specified", http.StatusBadRequest)
+	user, ok := parseAddress(r.URL.Path, "/register/")
+	if !ok {
+		http.Error(w, "Invalid user or device", http.StatusBadRequest)
+		return
+	}
+	grant, ok := requireAuth(w, r, user)
+	if !ok {
 		return
 	}
 
 	var bundle x3dh.Bundle
 	if err := json.NewDecoder(r.Body).Decode(&bundle); err != nil {
-		http.Error(w, "Failed to decode bundle: "+err.Error(), http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, codeMalformedRequest, "", "Failed to decode bundle: "+err.Error())
+		return
+	}
+	// Reject malformed keys and bad signatures so a broken or compromised
+	// device cannot publish a bundle nobody can safely use.
+	if err := x3dh.ValidateBundle(&bundle); err != nil {
+		writeValidationError(w, err)
+		return
+	}
+	// Fetchers verify the SPK signature with this key, so it must be the one
+	// the user authenticated with.
+	if bundle.Ed25519 != grant.ed25519 {
+		writeError(w, http.StatusForbidden, codeIdentityMismatch, "ed25519", "Bundle Ed25519 key does not match the authenticated key")
 		return
 	}
 
-	if err := serverState.RegisterBundle(user, bundle); err != nil {
-		http.Error(w, "Failed to register bundle: "+err.Error(), http.StatusInternalServerError)
+	if err := serverState.RegisterBundle(r.Context(), user, bundle); err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "", "Failed to register bundle: "+err.Error())
 		return
 	}
 
 	w.WriteHeader(http.StatusOK)
 }
 
+// bundleHandler hands out prekey bundles. GET /bundle/{user} returns a list
+// with one bundle per device, each carrying that device's own OTK, so the
+// sender can start a session with every device. GET /bundle/{user}/{device}
+// returns a single device's bundle.
 func bundleHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 		return
 	}
-	user := strings.TrimPrefix(r.URL.Path, "/bundle/")
-	if user == "" {
-		http.Error(w, "User not specified", http.StatusBadRequest)
+	user, ok := parseAddress(r.URL.Path, "/bundle/")
+	if !ok {
+		http.Error(w, "Invalid user or device", http.StatusBadRequest)
 		return
 	}
 
-	bundle, exists := serverState.GetBundle(user)
-	if !exists {
-		http.Error(w, "Bundle not found for user: "+user, http.StatusNotFound)
-		return
+	var result interface{}
+	if strings.Contains(strings.TrimPrefix(r.URL.Path, "/bundle/"), "/") {
+		bundle, exists := serverState.FetchBundle(r.Context(), user)
+		if !exists {
+			http.Error(w, "Bundle not found for device: "+user, http.StatusNotFound)
+			return
+		}
+		result = bundle
+	} else {
+		bundles, err := serverState.FetchBundles(r.Context(), user)
+		if err != nil {
+			http.Error(w, "Failed to fetch bundles: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(bundles) == 0 {
+			http.Error(w, "Bundle not found for user: "+user, http.StatusNotFound)
+			return
+		}
+		result = bundles
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(bundle)
+	json.NewEncoder(w).Encode(result)
 }
 
+// devicesHandler lists the devices of a user that have a bundle, at
+// GET /devices/{user}. Unlike a bundle fetch it does not use up OTKs. POST
+// /devices/{user}/{device} approves a new device (see approveHandler).
+func devicesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		approveHandler(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	user := strings.TrimPrefix(r.URL.Path, "/devices/")
+	if user == "" || strings.Contains(user, "/") {
+		http.Error(w, "Invalid user", http.StatusBadRequest)
+		return
+	}
+	devices, err := serverState.ListDevices(r.Context(), user)
+	if err != nil {
+		http.Error(w, "Failed to list devices: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(devices) == 0 {
+		http.Error(w, "No devices for user: "+user, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]string{"devices": devices})
+}
+
+// otkHandler uploads a batch of one-time prekeys (POST) or reports how many
+// are left in the pool (GET), so clients know when to replenish.
+func otkHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := parseAddress(r.URL.Path, "/otks/")
+	if !ok {
+		http.Error(w, "Invalid user or device", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		if _, ok := requireAuth(w, r, user); !ok {
+			return
+		}
+		if _, exists := serverState.GetBundle(r.Context(), user); !exists {
+			http.Error(w, "Bundle not found for user: "+user, http.StatusNotFound)
+			return
+		}
+		var otks []x3dh.OneTimePreKey
+		if err := json.NewDecoder(r.Body).Decode(&otks); err != nil {
+			writeError(w, http.StatusBadRequest, codeMalformedRequest, "", "Failed to decode one-time prekeys: "+err.Error())
+			return
+		}
+		for i, otk := range otks {
+			if otk.ID == 0 {
+				writeError(w, http.StatusUnprocessableEntity, codeMissingOTKID, fmt.Sprintf("[%d].id", i), "One-time prekey id must not be 0")
+				return
+			}
+			if err := x3dh.ValidatePublicKey(otk.Key); err != nil {
+				writeError(w, http.StatusUnprocessableEntity, validationCode(err), fmt.Sprintf("[%d].key", i), fmt.Sprintf("Invalid one-time prekey %d: %v", otk.ID, err))
+				return
+			}
+		}
+		if err := serverState.AddOneTimePreKeys(r.Context(), user, otks); err != nil {
+			http.Error(w, "Failed to store one-time prekeys: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fallthrough
+	case http.MethodGet:
+		count, err := serverState.CountOneTimePreKeys(r.Context(), user)
+		if err != nil {
+			http.Error(w, "Failed to count one-time prekeys: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int64{"count": count})
+	default:
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+	}
+}
+
+// sendMessageHandler queues a message at POST /send/{user}[/{device}], in
+// the mailbox of that one device. Senders reach a user's other devices by
+// sending each of them its own message. The optional ?ttl= shortens how
+// long it may wait for delivery.
 func sendMessageHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 		return
 	}
-	user := strings.TrimPrefix(r.URL.Path, "/send/")
-	if user == "" {
-		http.Error(w, "User not specified", http.StatusBadRequest)
+	user, ok := parseAddress(r.URL.Path, "/send/")
+	if !ok {
+		http.Error(w, "Invalid user or device", http.StatusBadRequest)
+		return
+	}
+	ttl, err := parseTTL(r.URL.Query().Get("ttl"), serverState.messageTTL)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 	var msg x3dh.InitialMessage
@@ -180,44 +507,104 @@ func sendMessageHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to decode message: "+err.Error(), http.StatusBadRequest)
 		return
 	}
-	data, _ := json.Marshal(msg)
-	if err := rdb.RPush(ctx, "messages:"+user, data).Err(); err != nil {
+	// Anyone may drop mail for a user, but a message claiming to come from
+	// the mailbox owner must be sent by one of the owner's devices.
+	if owner, _ := splitAddress(user); msg.Sender == owner {
+		if _, ok := requireAccount(w, r, owner); !ok {
+			return
+		}
+	}
+	err = serverState.StoreMessage(r.Context(), user, msg, ttl)
+	if errors.Is(err, ErrMailboxFull) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(mailboxRetryAfter.Seconds())))
+		writeError(w, http.StatusTooManyRequests, codeMailboxFull, "", "Mailbox is full for user: "+user)
+		return
+	} else if err != nil {
 		http.Error(w, "Failed to store message: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
 }
 
-func getMessageHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+// messagesHandler fetches the next message (GET /messages/{user}[/{device}])
+// or acknowledges a delivered one (DELETE /messages/{user}[/{device}]/{id}).
+func messagesHandler(w http.ResponseWriter, r *http.Request) {
+	path, id := r.URL.Path, ""
+	if r.Method == http.MethodDelete {
+		if i := strings.LastIndex(path, "/"); i >= len("/messages/") {
+			path, id = path[:i], path[i+1:]
+		}
+	}
+	user, ok := parseAddress(path, "/messages/")
+	if !ok {
+		http.Error(w, "Invalid user or device", http.StatusBadRequest)
 		return
 	}
-	user := strings.TrimPrefix(r.URL.Path, "/messages/")
-	if user == "" {
-		http.Error(w, "User not specified", http.StatusBadRequest)
+	switch {
+	case r.Method == http.MethodGet && id == "":
+		if _, ok := requireAuth(w, r, user); ok {
+			fetchMessage(w, r, user)
+		}
+	case r.Method == http.MethodDelete && id != "":
+		if _, ok := requireAuth(w, r, user); ok {
+			ackMessage(w, r, user, id)
+		}
+	default:
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+	}
+}
+
+// fetchMessage leases the next message for user. ?wait= turns an empty
+// mailbox into a long-poll instead of a 404.
+func fetchMessage(w http.ResponseWriter, r *http.Request, user string) {
+	wait, err := parseWait(r.URL.Query().Get("wait"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeMalformedRequest, "wait", err.Error())
 		return
 	}
-	data, err := rdb.LPop(ctx, "messages:"+user).Result()
-	if err == redis.Nil {
+	msg, left, err := serverState.LeaseMessage(r.Context(), user)
+	if errors.Is(err, ErrNotFound) && wait > 0 {
+		release, lerr := serverState.waiters.acquire(user)
+		if lerr != nil {
+			writeError(w, http.StatusTooManyRequests, codeTooManyWaiters, "", "Too many concurrent waits for user: "+user)
+			return
+		}
+		msg, left, err = serverState.WaitForMessage(r.Context(), user, wait)
+		release()
+	}
+	if errors.Is(err, ErrNotFound) {
 		http.Error(w, "No new messages for user: "+user, http.StatusNotFound)
 		return
 	} else if err != nil {
 		http.Error(w, "Failed to fetch message: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
-	left, _ := rdb.LLen(ctx, "messages:"+user).Result()
-	var msg x3dh.InitialMessage
-	if err := json.Unmarshal([]byte(data), &msg); err != nil {
-		http.Error(w, "Failed to decode message: "+err.Error(), http.StatusInternalServerError)
-		return
-	}
 	w.Header().Set("Content-Type", "application/json")
-	response := map[string]interface{}{
-		"message":      msg,
+	json.NewEncoder(w).Encode(deliveryFrame(msg, left))
+}
+
+// deliveryFrame is the body of a fetched message, also used for WebSocket frames.
+func deliveryFrame(msg *x3dh.InitialMessage, left int64) map[string]interface{} {
+	return map[string]interface{}{
+		"message":       msg,
 		"messages_left": left,
+		"lease_seconds": int(serverState.lease / time.Second),
 	}
-	json.NewEncoder(w).Encode(response)
+}
+
+// ackMessage deletes a delivered message. The id is only known while the
+// message is in flight; acknowledging after the lease expired may fail with
+// 404, and the message is then delivered again.
+func ackMessage(w http.ResponseWriter, r *http.Request, user, id string) {
+	err := serverState.AckMessage(r.Context(), user, id)
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "No message in flight with id: "+id, http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to acknowledge message: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
 }
 
 // statsHandler returns server statistics
@@ -226,7 +613,11 @@ func statsHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 		return
 	}
-	stats := serverState.GetStats()
+	stats, err := serverState.GetStats(r.Context())
+	if err != nil {
+		http.Error(w, "Failed to collect statistics: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(stats)
 }
@@ -240,7 +631,7 @@ func healthHandler(w http.ResponseWriter, r *http.Request) {
 	health := map[string]interface{}{
 		"status":    "healthy",
 		"timestamp": time.Now().UTC(),
-		"uptime":    serverState.GetStats().Uptime.String(),
+		"uptime":    time.Since(serverState.started).String(),
 	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(health)
@@ -252,37 +643,135 @@ func historyHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 		return
 	}
-	user := strings.TrimPrefix(r.URL.Path, "/history/")
-	if user == "" {
-		http.Error(w, "User not specified", http.StatusBadRequest)
+	user, ok := parseAddress(r.URL.Path, "/history/")
+	if !ok {
+		http.Error(w, "Invalid user or device", http.StatusBadRequest)
+		return
+	}
+	if _, ok := requireAuth(w, r, user); !ok {
 		return
 	}
-	data, err := rdb.LRange(ctx, "messages:"+user, 0, -1).Result()
+	messages, err := serverState.GetMessages(r.Context(), user)
 	if err != nil {
 		http.Error(w, "Failed to fetch messages: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
-	var messages []x3dh.InitialMessage
-	for _, item := range data {
-		var msg x3dh.InitialMessage
-		if err := json.Unmarshal([]byte(item), &msg); err == nil {
-			messages = append(messages, msg)
-		}
-	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(messages)
 }
 
+// newMux registers all HTTP handlers on a fresh ServeMux. Every handler
+// but /metrics itself is instrumented under its pattern.
+func newMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	handle := func(pattern string, h http.HandlerFunc) {
+		mux.HandleFunc(pattern, instrument(pattern, h))
+	}
+	handle("/register/", registerHandler)
+	handle("/bundle/", bundleHandler)
+	handle("/devices/", devicesHandler)
+	handle("/otks/", otkHandler)
+	handle("/send/", sendMessageHandler)
+	handle("/messages/", messagesHandler)
+	handle("/stats", statsHandler)
+	handle("/health", healthHandler)
+	handle("/history/", historyHandler)
+	handle("/auth/challenge/", challengeHandler)
+	handle("/auth/token/", tokenHandler)
+	handle("/ws/", wsHandler)
+	mux.HandleFunc("/metrics", metricsHandler)
+	return mux
+}
+
+// openStore creates the storage backend selected in cfg
+func openStore(cfg *config.Config) (Store, error) {
+	switch cfg.Store {
+	case "redis":
+		rdb := redis.NewClient(&redis.Options{
+			Addr:     cfg.RedisAddr,
+			Password: cfg.RedisPassword,
+			DB:       cfg.RedisDB,
+		})
+		if err := rdb.Ping(context.Background()).Err(); err != nil {
+			return nil, fmt.Errorf("failed to connect to Redis at %s: %v", cfg.RedisAddr, err)
+		}
+		return NewRedisStore(rdb), nil
+	case "memory":
+		return NewMemoryStore(), nil
+	case "file":
+		return NewFileStore(cfg.DataDir)
+	default:
+		return nil, fmt.Errorf("unknown store %q (use redis, memory or file)", cfg.Store)
+	}
+}
+
+// limitBody caps request bodies; low-memory devices get a much smaller cap.
+func limitBody(next http.Handler, limit int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// logRequests logs every request with its duration (debug log level)
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		next.ServeHTTP(w, r)
+		debugLog.Printf("%s %s (%s)", r.Method, r.URL.Path, time.Since(start))
+	})
+}
+
 func main() {
-	http.HandleFunc("/register/", registerHandler)
-	http.HandleFunc("/bundle/", bundleHandler)
-	http.HandleFunc("/send/", sendMessageHandler)
-	http.HandleFunc("/messages/", getMessageHandler)
-	http.HandleFunc("/stats", statsHandler)
-	http.HandleFunc("/health", healthHandler)
-	http.HandleFunc("/history/", historyHandler)
-
-	port := "8080"
-	fmt.Printf("Server started on port %s\n", port)
-	log.Fatal(http.ListenAndServe(":"+port, nil))
-} 
\ No newline at end of file
+	cfg, err := config.Load(flag.CommandLine, os.Args[1:], "", (*config.Config).RegisterServerFlags)
+	if err != nil {
+		log.Fatal(err)
+	}
+	setupLogging(cfg)
+
+	store, err := openStore(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	serverState = NewServerState(store)
+	serverState.waiters = newWaiterLimit(cfg.MaxWaiters)
+	serverState.lease = cfg.LeaseTimeout
+	serverState.messageTTL = cfg.MessageTTL
+	serverState.mailboxSize = cfg.MailboxSize
+	go serverState.RunSweeper(ctx, cfg.SweepInterval, cfg.BundleTTL)
+
+	var handler http.Handler = newMux()
+	bodyLimit := int64(1 << 20)
+	if cfg.LowMemory {
+		bodyLimit = 64 << 10
+	}
+	handler = limitBody(handler, bodyLimit)
+	if cfg.Logs("debug") {
+		handler = logRequests(handler)
+	}
+
+	srv := &http.Server{Addr: cfg.ListenAddr, Handler: handler, ErrorLog: warnLog}
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		<-ctx.Done()
+		// Give requests in progress a moment, then close the store either way.
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	infoLog.Printf("Server started on %s (store: %s)", cfg.ListenAddr, cfg.Store)
+	err = srv.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		store.Close()
+		log.Fatal(err)
+	}
+	<-stopped
+	if err := store.Close(); err != nil {
+		log.Fatalf("failed to close the store: %v", err)
+	}
+	infoLog.Println("Server stopped.")
+}
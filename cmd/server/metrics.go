@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the request latency
+// histogram. They match the Prometheus client defaults.
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// requestKey identifies one request series.
+type requestKey struct {
+	handler string
+	code    int
+}
+
+// histogram is a latency histogram. counts[i] holds the observations that
+// fell into bucket i only; they are summed up when written.
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func (h *histogram) observe(v float64) {
+	for i, le := range latencyBuckets {
+		if v <= le {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// fetchKey identifies one bundle fetch series.
+type fetchKey struct {
+	user string
+	otk  bool
+}
+
+// Metrics holds the counters exported at /metrics that only this process
+// knows about. Everything the store can count is read at scrape time.
+type Metrics struct {
+	mu        sync.Mutex
+	requests  map[requestKey]*histogram
+	fetches   map[fetchKey]uint64
+	storeErrs map[string]uint64 // by Store method
+}
+
+// NewMetrics creates an empty set of metrics.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requests:  make(map[requestKey]*histogram),
+		fetches:   make(map[fetchKey]uint64),
+		storeErrs: make(map[string]uint64),
+	}
+}
+
+// ObserveRequest records a finished request.
+func (m *Metrics) ObserveRequest(handler string, code int, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := requestKey{handler, code}
+	h, ok := m.requests[key]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		m.requests[key] = h
+	}
+	h.observe(d.Seconds())
+}
+
+// BundleFetched records a bundle handed out for user, with or without an OTK.
+func (m *Metrics) BundleFetched(user string, otk bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.fetches[fetchKey{user, otk}]++
+}
+
+// StoreError records a failed Store call.
+func (m *Metrics) StoreError(op string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.storeErrs[op]++
+}
+
+// labelEscaper escapes a label value for the text exposition format.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labels formats name/value pairs as {name="value",...}.
+func labels(pairs ...string) string {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `%s="%s"`, pairs[i], labelEscaper.Replace(pairs[i+1]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// header writes the HELP and TYPE lines of a metric family.
+func header(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// writeUserGauge writes a gauge family with one sample per user, in user order.
+func writeUserGauge(w io.Writer, name, help string, values map[string]int64) {
+	header(w, name, "gauge", help)
+	users := make([]string, 0, len(values))
+	for user := range values {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	for _, user := range users {
+		fmt.Fprintf(w, "%s%s %d\n", name, labels("user", user), values[user])
+	}
+}
+
+// WriteText writes the in-process metrics in the Prometheus text format.
+func (m *Metrics) WriteText(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := make([]requestKey, 0, len(m.requests))
+	for key := range m.requests {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].handler != keys[j].handler {
+			return keys[i].handler < keys[j].handler
+		}
+		return keys[i].code < keys[j].code
+	})
+	header(w, "x3dh_http_requests_total", "counter", "HTTP requests by handler and status code.")
+	for _, key := range keys {
+		fmt.Fprintf(w, "x3dh_http_requests_total%s %d\n",
+			labels("handler", key.handler, "code", strconv.Itoa(key.code)), m.requests[key].count)
+	}
+	header(w, "x3dh_http_request_duration_seconds", "histogram", "HTTP request latency by handler and status code.")
+	for _, key := range keys {
+		h := m.requests[key]
+		code := strconv.Itoa(key.code)
+		var cumulative uint64
+		for i, le := range latencyBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "x3dh_http_request_duration_seconds_bucket%s %d\n",
+				labels("handler", key.handler, "code", code, "le", formatFloat(le)), cumulative)
+		}
+		fmt.Fprintf(w, "x3dh_http_request_duration_seconds_bucket%s %d\n",
+			labels("handler", key.handler, "code", code, "le", "+Inf"), h.count)
+		fmt.Fprintf(w, "x3dh_http_request_duration_seconds_sum%s %s\n",
+			labels("handler", key.handler, "code", code), formatFloat(h.sum))
+		fmt.Fprintf(w, "x3dh_http_request_duration_seconds_count%s %d\n",
+			labels("handler", key.handler, "code", code), h.count)
+	}
+
+	fetches := make([]fetchKey, 0, len(m.fetches))
+	for key := range m.fetches {
+		fetches = append(fetches, key)
+	}
+	sort.Slice(fetches, func(i, j int) bool {
+		if fetches[i].user != fetches[j].user {
+			return fetches[i].user < fetches[j].user
+		}
+		return !fetches[i].otk && fetches[j].otk
+	})
+	header(w, "x3dh_bundle_fetches_total", "counter", "Bundles handed out by user and whether they carried a one-time prekey.")
+	for _, key := range fetches {
+		fmt.Fprintf(w, "x3dh_bundle_fetches_total%s %d\n",
+			labels("user", key.user, "otk", strconv.FormatBool(key.otk)), m.fetches[key])
+	}
+
+	ops := make([]string, 0, len(m.storeErrs))
+	for op := range m.storeErrs {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+	header(w, "x3dh_store_errors_total", "counter", "Failed storage operations by operation.")
+	for _, op := range ops {
+		fmt.Fprintf(w, "x3dh_store_errors_total%s %d\n", labels("op", op), m.storeErrs[op])
+	}
+}
+
+// statusRecorder remembers the status code a handler wrote. It passes
+// Hijack through so WebSocket upgrades keep working.
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.code == 0 {
+		r.code = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.code == 0 {
+		r.code = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response does not support hijacking")
+	}
+	if r.code == 0 {
+		r.code = http.StatusSwitchingProtocols
+	}
+	return hj.Hijack()
+}
+
+// instrument records the count and latency of every request to h under the
+// given handler name.
+func instrument(name string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		h(rec, r)
+		if rec.code == 0 {
+			rec.code = http.StatusOK
+		}
+		serverState.metrics.ObserveRequest(name, rec.code, time.Since(start))
+	}
+}
+
+// metricsHandler serves GET /metrics in the Prometheus text exposition
+// format. Store-backed values are skipped if the store cannot be read, and
+// the failure shows up in x3dh_store_errors_total.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := r.Context()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	if counters, err := serverState.store.Counters(ctx); err == nil {
+		for _, c := range []struct{ name, counter, help string }{
+			{"x3dh_bundles_registered_total", counterBundlesRegistered, "Bundles registered."},
+			{"x3dh_messages_received_total", counterMessagesReceived, "Messages accepted for delivery."},
+			{"x3dh_messages_delivered_total", counterMessagesDelivered, "Messages acknowledged by their recipient."},
+			{"x3dh_messages_expired_total", counterMessagesExpired, "Messages discarded undelivered after their TTL."},
+			{"x3dh_bundles_expired_total", counterBundlesExpired, "Abandoned bundles removed."},
+		} {
+			header(w, c.name, "counter", c.help)
+			fmt.Fprintf(w, "%s %d\n", c.name, counters[c.counter])
+		}
+	}
+	if n, err := serverState.store.CountBundles(ctx); err == nil {
+		header(w, "x3dh_bundles", "gauge", "Registered bundles.")
+		fmt.Fprintf(w, "x3dh_bundles %d\n", n)
+	}
+	if sizes, err := serverState.store.MailboxSizes(ctx); err == nil {
+		writeUserGauge(w, "x3dh_mailbox_messages", "Queued and in-flight messages by user.", sizes)
+	}
+	if sizes, err := serverState.store.OTKPoolSizes(ctx); err == nil {
+		writeUserGauge(w, "x3dh_otk_pool_size", "One-time prekeys left by user; 0 means bundles go out without one.", sizes)
+	}
+	serverState.metrics.WriteText(w)
+}
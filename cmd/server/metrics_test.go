@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"x3dh-demo/internal/x3dh"
+)
+
+// brokenStore fails every PushMessage.
+type brokenStore struct {
+	*MemoryStore
+}
+
+func (brokenStore) PushMessage(ctx context.Context, user string, msg x3dh.InitialMessage, limit int) error {
+	return errors.New("disk on fire")
+}
+
+func scrape(t *testing.T, url string) string {
+	t.Helper()
+	resp, err := http.Get(url + "/metrics")
+	if err != nil {
+		t.Fatalf("GET /metrics failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatalf("unexpected content type %q", ct)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	return string(body)
+}
+
+func TestMetrics(t *testing.T) {
+	ts := newTestServer(t)
+	ed := testEdKey(1)
+	token := login(t, ts.URL, "bob", ed)
+	authPost(t, ts.URL+"/register/bob", token, testBundle(ed)).Body.Close()
+	authPost(t, ts.URL+"/otks/bob", token, []x3dh.OneTimePreKey{{ID: 1, Key: testKey(10)}}).Body.Close()
+	getJSON(t, ts.URL+"/bundle/bob", nil)
+	getJSON(t, ts.URL+"/bundle/bob", nil)
+	getJSON(t, ts.URL+"/bundle/nobody", nil)
+	postJSON(t, ts.URL+"/send/bob", x3dh.InitialMessage{Sender: "alice"}).Body.Close()
+
+	body := scrape(t, ts.URL)
+	for _, want := range []string{
+		"# TYPE x3dh_http_requests_total counter",
+		`x3dh_http_requests_total{handler="/bundle/",code="200"} 2`,
+		`x3dh_http_requests_total{handler="/bundle/",code="404"} 1`,
+		`x3dh_http_request_duration_seconds_bucket{handler="/send/",code="200",le="+Inf"} 1`,
+		`x3dh_http_request_duration_seconds_count{handler="/send/",code="200"} 1`,
+		`x3dh_bundle_fetches_total{user="bob",otk="false"} 1`,
+		`x3dh_bundle_fetches_total{user="bob",otk="true"} 1`,
+		`x3dh_mailbox_messages{user="bob"} 1`,
+		`x3dh_otk_pool_size{user="bob"} 0`,
+		"x3dh_messages_received_total 1",
+		"x3dh_bundles 1",
+	} {
+		if !strings.Contains(body, want+"\n") {
+			t.Errorf("metrics missing %q", want)
+		}
+	}
+	if strings.Contains(body, "x3dh_store_errors_total{") {
+		t.Error("not-found results must not count as store errors")
+	}
+}
+
+func TestMetricsCountStoreErrors(t *testing.T) {
+	ts := newTestServer(t)
+	serverState = NewServerState(brokenStore{NewMemoryStore()})
+	resp := postJSON(t, ts.URL+"/send/bob", x3dh.InitialMessage{Sender: "alice"})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("send returned %s", resp.Status)
+	}
+	body := scrape(t, ts.URL)
+	for _, want := range []string{
+		`x3dh_store_errors_total{op="PushMessage"} 1`,
+		`x3dh_http_requests_total{handler="/send/",code="500"} 1`,
+	} {
+		if !strings.Contains(body, want+"\n") {
+			t.Errorf("metrics missing %q", want)
+		}
+	}
+}
+
+func TestLabelsEscape(t *testing.T) {
+	if got := labels("user", "a\"b\\c\nd"); got != `{user="a\"b\\c\nd"}` {
+		t.Fatalf("labels escaped to %s", got)
+	}
+}
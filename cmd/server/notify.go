@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// broker is the in-process message notifier shared by the memory and file
+// stores. Notifications carry no data: subscribers are woken up and read the
+// queue themselves, so a burst of pushes collapses into a single wakeup.
+type broker struct {
+	mu   sync.Mutex
+	subs map[string]map[chan struct{}]struct{}
+}
+
+func newBroker() *broker {
+	return &broker{subs: make(map[string]map[chan struct{}]struct{})}
+}
+
+// Subscribe returns a channel that receives a value after each push to
+// user's queue. It is closed once ctx is done.
+func (b *broker) Subscribe(ctx context.Context, user string) (<-chan struct{}, error) {
+	ch := make(chan struct{}, 1)
+	b.mu.Lock()
+	if b.subs[user] == nil {
+		b.subs[user] = make(map[chan struct{}]struct{})
+	}
+	b.subs[user][ch] = struct{}{}
+	b.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		b.mu.Lock()
+		delete(b.subs[user], ch)
+		if len(b.subs[user]) == 0 {
+			delete(b.subs, user)
+		}
+		close(ch)
+		b.mu.Unlock()
+	}()
+	return ch, nil
+}
+
+// Notify wakes every subscriber of user without blocking.
+func (b *broker) Notify(user string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs[user] {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
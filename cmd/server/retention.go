@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// parseTTL reads the ?ttl= parameter of a send. An empty value means the
+// server maximum; longer TTLs are capped at max. Expiry is kept to the
+// second, so shorter TTLs are rejected.
+func parseTTL(v string, max time.Duration) (time.Duration, error) {
+	if v == "" {
+		return max, nil
+	}
+	d, err := parseDurationParam("ttl", v)
+	if err != nil {
+		return 0, err
+	}
+	if d < time.Second {
+		return 0, fmt.Errorf("ttl %q is shorter than one second", v)
+	}
+	if d > max {
+		d = max
+	}
+	return d, nil
+}
+
+// Sweep deletes messages that have expired at now and, if bundleTTL is
+// positive, the bundles of users who have not registered, authenticated,
+// fetched messages or uploaded one-time prekeys for that long.
+func (s *ServerState) Sweep(ctx context.Context, now time.Time, bundleTTL time.Duration) error {
+	s.forgetTouches(now)
+	n, err := s.store.ExpireMessages(ctx, now)
+	s.count(ctx, counterMessagesExpired, n)
+	if err != nil {
+		return fmt.Errorf("failed to expire messages: %v", err)
+	}
+	if bundleTTL <= 0 {
+		return nil
+	}
+	users, err := s.store.ExpireBundles(ctx, now.Add(-bundleTTL))
+	s.count(ctx, counterBundlesExpired, int64(len(users)))
+	if err != nil {
+		return fmt.Errorf("failed to expire bundles: %v", err)
+	}
+	for _, user := range users {
+		infoLog.Printf("Removed abandoned bundle for %s", user)
+	}
+	return nil
+}
+
+// RunSweeper calls Sweep every interval until ctx is done.
+func (s *ServerState) RunSweeper(ctx context.Context, interval, bundleTTL time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if err := s.Sweep(ctx, now, bundleTTL); err != nil {
+				warnLog.Print(err)
+			}
+		}
+	}
+}
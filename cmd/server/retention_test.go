@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTTL(t *testing.T) {
+	tests := map[string]time.Duration{
+		"":    time.Hour,
+		"30s": 30 * time.Second,
+		"90":  90 * time.Second,
+		"48h": time.Hour,
+	}
+	for in, want := range tests {
+		if got, err := parseTTL(in, time.Hour); err != nil || got != want {
+			t.Errorf("parseTTL(%q) = %v, %v; want %v", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"0", "500ms", "-1s", "soon"} {
+		if _, err := parseTTL(in, time.Hour); err == nil {
+			t.Errorf("parseTTL(%q) should fail", in)
+		}
+	}
+}
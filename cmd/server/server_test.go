@@ -0,0 +1,579 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"x3dh-demo/internal/x3dh"
+)
+
+// newTestServer starts the relay on an in-memory store.
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	serverState = NewServerState(NewMemoryStore())
+	ts := httptest.NewServer(newMux())
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func postJSON(t *testing.T, url string, v interface{}) *http.Response {
+	t.Helper()
+	return authPost(t, url, "", v)
+}
+
+// authPost is postJSON with a bearer token.
+func authPost(t *testing.T, url, token string, v interface{}) *http.Response {
+	t.Helper()
+	data, _ := json.Marshal(v)
+	req, _ := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(data))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("POST %s failed: %v", url, err)
+	}
+	return resp
+}
+
+func getJSON(t *testing.T, url string, v interface{}) int {
+	t.Helper()
+	return authGet(t, url, "", v)
+}
+
+// authGet is getJSON with a bearer token.
+func authGet(t *testing.T, url, token string, v interface{}) int {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET %s failed: %v", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK && v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("decode %s failed: %v", url, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func testKey(b byte) string {
+	return x3dh.EncodePublicKey([32]byte{b, 1, 2, 3})
+}
+
+// authDelete sends a DELETE with a bearer token and returns the status code.
+func authDelete(t *testing.T, url, token string) int {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodDelete, url, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("DELETE %s failed: %v", url, err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// testEdKey derives a deterministic Ed25519 identity key from b.
+func testEdKey(b byte) ed25519.PrivateKey {
+	seed := make([]byte, ed25519.SeedSize)
+	seed[0] = b
+	return ed25519.NewKeyFromSeed(seed)
+}
+
+func edPublic(priv ed25519.PrivateKey) string {
+	return hex.EncodeToString(priv.Public().(ed25519.PublicKey))
+}
+
+// testBundle returns a bundle whose SPK is properly signed with ed.
+func testBundle(ed ed25519.PrivateKey) x3dh.Bundle {
+	spk := [32]byte{2, 1, 2, 3}
+	return x3dh.Bundle{
+		IK:      testKey(1),
+		SPK:     x3dh.EncodePublicKey(spk),
+		SPKID:   1,
+		Ed25519: edPublic(ed),
+		Sig:     hex.EncodeToString(ed25519.Sign(ed, spk[:])),
+	}
+}
+
+// answerChallenge runs the challenge-response login and returns the
+// response to the token request.
+func answerChallenge(t *testing.T, url, user string, priv ed25519.PrivateKey) *http.Response {
+	t.Helper()
+	resp := postJSON(t, url+"/auth/challenge/"+user, nil)
+	defer resp.Body.Close()
+	var challenge x3dh.AuthChallenge
+	if err := json.NewDecoder(resp.Body).Decode(&challenge); err != nil {
+		t.Fatalf("decode challenge failed: %v", err)
+	}
+	return postJSON(t, url+"/auth/token/"+user, x3dh.SignChallenge(priv, user, challenge.Nonce))
+}
+
+// login authenticates user with priv and returns a bearer token.
+func login(t *testing.T, url, user string, priv ed25519.PrivateKey) string {
+	t.Helper()
+	resp := answerChallenge(t, url, user, priv)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("login as %s returned %s", user, resp.Status)
+	}
+	var token x3dh.AuthToken
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		t.Fatalf("decode token failed: %v", err)
+	}
+	return token.Token
+}
+
+// approveDevice lets the device at addr log in with priv, using the token
+// of another device of the same user.
+func approveDevice(t *testing.T, url, addr, token string, priv ed25519.PrivateKey) {
+	t.Helper()
+	resp := authPost(t, url+"/devices/"+addr, token, x3dh.DeviceApproval{Ed25519: edPublic(priv)})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("approving %s returned %s", addr, resp.Status)
+	}
+}
+
+func TestBundleAndOTKPool(t *testing.T) {
+	ts := newTestServer(t)
+	ed := testEdKey(1)
+	token := login(t, ts.URL, "bob", ed)
+	bundle := testBundle(ed)
+	if resp := authPost(t, ts.URL+"/register/bob", token, bundle); resp.StatusCode != http.StatusOK {
+		t.Fatalf("register returned %s", resp.Status)
+	}
+	otks := []x3dh.OneTimePreKey{{ID: 1, Key: testKey(10)}, {ID: 2, Key: testKey(11)}}
+	if resp := authPost(t, ts.URL+"/otks/bob", token, otks); resp.StatusCode != http.StatusOK {
+		t.Fatalf("otk upload returned %s", resp.Status)
+	}
+
+	seen := map[uint32]bool{}
+	for i := 0; i < 3; i++ {
+		var list []x3dh.Bundle
+		if code := getJSON(t, ts.URL+"/bundle/bob", &list); code != http.StatusOK || len(list) != 1 {
+			t.Fatalf("bundle fetch returned %d bundles (status %d)", len(list), code)
+		}
+		got := list[0]
+		if got.Device != defaultDevice {
+			t.Fatalf("expected the default device, got %q", got.Device)
+		}
+		if i < 2 {
+			if got.OTK == "" || seen[got.OTKID] {
+				t.Fatalf("fetch %d should hand out a fresh OTK, got id %d", i, got.OTKID)
+			}
+			seen[got.OTKID] = true
+		} else if got.OTK != "" {
+			t.Fatal("exhausted pool should yield a bundle without OTK")
+		}
+	}
+
+	var count struct {
+		Count int64 `json:"count"`
+	}
+	if code := getJSON(t, ts.URL+"/otks/bob", &count); code != http.StatusOK || count.Count != 0 {
+		t.Fatalf("expected empty pool, got %d (status %d)", count.Count, code)
+	}
+
+	var stats ServerStats
+	getJSON(t, ts.URL+"/stats", &stats)
+	if stats.TotalBundlesRegistered != 1 || stats.ActiveBundles != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if u, ok := stats.Users["bob"]; !ok || u.OneTimePreKeys != 0 {
+		t.Fatalf("an exhausted pool should be reported, got %+v", stats.Users)
+	}
+}
+
+func TestMultiDevice(t *testing.T) {
+	ts := newTestServer(t)
+	phone, gateway := testEdKey(1), testEdKey(2)
+	phoneToken := login(t, ts.URL, "bob/phone", phone)
+	approveDevice(t, ts.URL, "bob/gateway", phoneToken, gateway)
+	gatewayToken := login(t, ts.URL, "bob/gateway", gateway)
+	if resp := authPost(t, ts.URL+"/register/bob/phone", phoneToken, testBundle(phone)); resp.StatusCode != http.StatusOK {
+		t.Fatalf("register phone returned %s", resp.Status)
+	}
+	if resp := authPost(t, ts.URL+"/register/bob/gateway", gatewayToken, testBundle(gateway)); resp.StatusCode != http.StatusOK {
+		t.Fatalf("register gateway returned %s", resp.Status)
+	}
+	// A device's token is no good for another device of the same user.
+	if resp := authPost(t, ts.URL+"/register/bob/gateway", phoneToken, testBundle(phone)); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("cross-device register returned %s", resp.Status)
+	}
+	authPost(t, ts.URL+"/otks/bob/phone", phoneToken, []x3dh.OneTimePreKey{{ID: 1, Key: testKey(10)}}).Body.Close()
+
+	var devices struct {
+		Devices []string `json:"devices"`
+	}
+	if code := getJSON(t, ts.URL+"/devices/bob", &devices); code != http.StatusOK || len(devices.Devices) != 2 ||
+		devices.Devices[0] != "gateway" || devices.Devices[1] != "phone" {
+		t.Fatalf("unexpected devices %v (status %d)", devices.Devices, code)
+	}
+	var list []x3dh.Bundle
+	if code := getJSON(t, ts.URL+"/bundle/bob", &list); code != http.StatusOK || len(list) != 2 {
+		t.Fatalf("expected 2 bundles, got %d (status %d)", len(list), code)
+	}
+	if list[0].Device != "gateway" || list[0].OTK != "" || list[1].Device != "phone" || list[1].OTKID != 1 {
+		t.Fatalf("each device should get its own OTK, got %+v", list)
+	}
+	var one x3dh.Bundle
+	if code := getJSON(t, ts.URL+"/bundle/bob/phone", &one); code != http.StatusOK || one.Device != "phone" || one.Ed25519 != edPublic(phone) {
+		t.Fatalf("single device fetch returned %+v (status %d)", one, code)
+	}
+	if code := getJSON(t, ts.URL+"/bundle/bob/tablet", nil); code != http.StatusNotFound {
+		t.Fatalf("unknown device returned %d", code)
+	}
+
+	// Each device has its own mailbox.
+	postJSON(t, ts.URL+"/send/bob/phone", x3dh.InitialMessage{Sender: "alice", Ciphertext: "to phone"}).Body.Close()
+	postJSON(t, ts.URL+"/send/bob/gateway", x3dh.InitialMessage{Sender: "alice", Ciphertext: "to gateway"}).Body.Close()
+	var got struct {
+		Message x3dh.InitialMessage `json:"message"`
+	}
+	if code := authGet(t, ts.URL+"/messages/bob/phone", phoneToken, &got); code != http.StatusOK || got.Message.Ciphertext != "to phone" {
+		t.Fatalf("phone fetched %+v (status %d)", got.Message, code)
+	}
+	if code := authGet(t, ts.URL+"/messages/bob/phone", gatewayToken, nil); code != http.StatusForbidden {
+		t.Fatalf("gateway read the phone's mailbox (status %d)", code)
+	}
+	if code := authDelete(t, ts.URL+"/messages/bob/phone/"+got.Message.ID, phoneToken); code != http.StatusNoContent {
+		t.Fatalf("ack returned %d", code)
+	}
+	if code := authGet(t, ts.URL+"/messages/bob/gateway", gatewayToken, &got); code != http.StatusOK || got.Message.Ciphertext != "to gateway" {
+		t.Fatalf("gateway fetched %+v (status %d)", got.Message, code)
+	}
+
+	// Any of bob's devices may send as bob.
+	resp := authPost(t, ts.URL+"/send/bob/gateway", phoneToken, x3dh.InitialMessage{Sender: "bob", Ciphertext: "note"})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("send as bob from the phone returned %s", resp.Status)
+	}
+	if resp := postJSON(t, ts.URL+"/send/bob/a/b", x3dh.InitialMessage{Sender: "alice"}); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("extra path segment returned %s", resp.Status)
+	}
+}
+
+func TestMessageQueue(t *testing.T) {
+	ts := newTestServer(t)
+	token := login(t, ts.URL, "bob", testEdKey(1))
+	if code := authGet(t, ts.URL+"/messages/bob", token, nil); code != http.StatusNotFound {
+		t.Fatalf("empty mailbox should return 404, got %d", code)
+	}
+	for _, text := range []string{"one", "two"} {
+		msg := x3dh.InitialMessage{Sender: "alice", Ciphertext: text}
+		if resp := postJSON(t, ts.URL+"/send/bob", msg); resp.StatusCode != http.StatusOK {
+			t.Fatalf("send returned %s", resp.Status)
+		}
+	}
+
+	var history []x3dh.InitialMessage
+	if code := authGet(t, ts.URL+"/history/bob", token, &history); code != http.StatusOK || len(history) != 2 {
+		t.Fatalf("history should list 2 messages, got %d (status %d)", len(history), code)
+	}
+
+	var got struct {
+		Message      x3dh.InitialMessage `json:"message"`
+		MessagesLeft int                 `json:"messages_left"`
+	}
+	if code := authGet(t, ts.URL+"/messages/bob", token, &got); code != http.StatusOK {
+		t.Fatalf("fetch returned %d", code)
+	}
+	if got.Message.Ciphertext != "one" || got.MessagesLeft != 1 {
+		t.Fatalf("unexpected message %+v", got)
+	}
+	if code := authDelete(t, ts.URL+"/messages/bob/"+got.Message.ID, token); code != http.StatusNoContent {
+		t.Fatalf("ack returned %d", code)
+	}
+
+	var stats ServerStats
+	getJSON(t, ts.URL+"/stats", &stats)
+	if stats.TotalMessagesReceived != 2 || stats.TotalMessagesDelivered != 1 || stats.PendingMessages != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if stats.Users["bob"].PendingMessages != 1 {
+		t.Fatalf("unexpected per-user stats %+v", stats.Users)
+	}
+}
+
+func TestMessageLease(t *testing.T) {
+	ts := newTestServer(t)
+	serverState.lease = 100 * time.Millisecond
+	token := login(t, ts.URL, "bob", testEdKey(1))
+	postJSON(t, ts.URL+"/send/bob", x3dh.InitialMessage{Sender: "alice", Ciphertext: "one", ID: "forged"}).Body.Close()
+
+	var got struct {
+		Message x3dh.InitialMessage `json:"message"`
+	}
+	authGet(t, ts.URL+"/messages/bob", token, &got)
+	if got.Message.ID == "" || got.Message.ID == "forged" {
+		t.Fatalf("the relay must assign the message id, got %q", got.Message.ID)
+	}
+	// Not acknowledged: invisible while leased, back once the lease expires.
+	if code := authGet(t, ts.URL+"/messages/bob", token, nil); code != http.StatusNotFound {
+		t.Fatalf("leased message fetched twice (status %d)", code)
+	}
+	time.Sleep(150 * time.Millisecond)
+	var again struct {
+		Message x3dh.InitialMessage `json:"message"`
+	}
+	if code := authGet(t, ts.URL+"/messages/bob", token, &again); code != http.StatusOK || again.Message.ID != got.Message.ID {
+		t.Fatalf("expired lease not redelivered: %+v (status %d)", again, code)
+	}
+
+	url := ts.URL + "/messages/bob/" + again.Message.ID
+	if code := authDelete(t, url, login(t, ts.URL, "mallory", testEdKey(2))); code != http.StatusForbidden {
+		t.Fatalf("ack with another user's token returned %d", code)
+	}
+	if code := authDelete(t, ts.URL+"/messages/bob/unknown", token); code != http.StatusNotFound {
+		t.Fatalf("ack of unknown id returned %d", code)
+	}
+	if code := authDelete(t, url, token); code != http.StatusNoContent {
+		t.Fatalf("ack returned %d", code)
+	}
+	time.Sleep(150 * time.Millisecond)
+	if code := authGet(t, ts.URL+"/messages/bob", token, nil); code != http.StatusNotFound {
+		t.Fatalf("acknowledged message came back (status %d)", code)
+	}
+}
+
+func TestMessageRetention(t *testing.T) {
+	ts := newTestServer(t)
+	serverState.messageTTL = time.Hour
+	serverState.mailboxSize = 2
+	token := login(t, ts.URL, "bob", testEdKey(1))
+
+	msg := x3dh.InitialMessage{Sender: "alice", Ciphertext: "one", ExpiresAt: 1}
+	if resp := postJSON(t, ts.URL+"/send/bob?ttl=5m", msg); resp.StatusCode != http.StatusOK {
+		t.Fatalf("send returned %s", resp.Status)
+	}
+	if resp := postJSON(t, ts.URL+"/send/bob?ttl=48h", msg); resp.StatusCode != http.StatusOK {
+		t.Fatalf("send returned %s", resp.Status)
+	}
+	var history []x3dh.InitialMessage
+	authGet(t, ts.URL+"/history/bob", token, &history)
+	start := time.Now()
+	if len(history) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(history))
+	}
+	if d := time.Unix(history[0].ExpiresAt, 0).Sub(start); d < 4*time.Minute || d > 5*time.Minute {
+		t.Fatalf("sender TTL not applied, expires in %s", d)
+	}
+	if d := time.Unix(history[1].ExpiresAt, 0).Sub(start); d > time.Hour {
+		t.Fatalf("TTL not capped at the server maximum, expires in %s", d)
+	}
+
+	resp := postJSON(t, ts.URL+"/send/bob", msg)
+	var apiErr apiError
+	json.NewDecoder(resp.Body).Decode(&apiErr)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests || apiErr.Code != codeMailboxFull || resp.Header.Get("Retry-After") != "60" {
+		t.Fatalf("full mailbox returned %s %+v, Retry-After %q", resp.Status, apiErr, resp.Header.Get("Retry-After"))
+	}
+	if resp := postJSON(t, ts.URL+"/send/bob?ttl=soon", msg); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("invalid ttl returned %s", resp.Status)
+	}
+
+	if err := serverState.Sweep(context.Background(), start.Add(10*time.Minute), 0); err != nil {
+		t.Fatalf("Sweep failed: %v", err)
+	}
+	var stats ServerStats
+	getJSON(t, ts.URL+"/stats", &stats)
+	if stats.TotalMessagesExpired != 1 || stats.PendingMessages != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if resp := postJSON(t, ts.URL+"/send/bob", msg); resp.StatusCode != http.StatusOK {
+		t.Fatalf("send after sweep returned %s", resp.Status)
+	}
+}
+
+func TestAuthRequired(t *testing.T) {
+	ts := newTestServer(t)
+	bob, mallory := testEdKey(1), testEdKey(2)
+	bundle := testBundle(bob)
+
+	for _, path := range []string{"/messages/bob", "/history/bob"} {
+		if code := getJSON(t, ts.URL+path, nil); code != http.StatusUnauthorized {
+			t.Fatalf("GET %s without token returned %d", path, code)
+		}
+		if code := authGet(t, ts.URL+path, "bogus", nil); code != http.StatusUnauthorized {
+			t.Fatalf("GET %s with unknown token returned %d", path, code)
+		}
+	}
+	if resp := postJSON(t, ts.URL+"/register/bob", bundle); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("register without token returned %s", resp.Status)
+	}
+	self := x3dh.InitialMessage{Sender: "bob", Ciphertext: "forged"}
+	if resp := postJSON(t, ts.URL+"/send/bob", self); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("send-to-self without token returned %s", resp.Status)
+	}
+
+	// The first key to log in is pinned; another key cannot take over.
+	bobToken := login(t, ts.URL, "bob", bob)
+	if resp := answerChallenge(t, ts.URL, "bob", mallory); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("login with a different key returned %s", resp.Status)
+	}
+	malloryToken := login(t, ts.URL, "mallory", mallory)
+	if code := authGet(t, ts.URL+"/messages/bob", malloryToken, nil); code != http.StatusForbidden {
+		t.Fatalf("another user's token returned %d", code)
+	}
+
+	forged := testBundle(mallory)
+	if resp := authPost(t, ts.URL+"/register/bob", bobToken, forged); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("bundle with a foreign Ed25519 key returned %s", resp.Status)
+	}
+	if resp := authPost(t, ts.URL+"/register/bob", bobToken, bundle); resp.StatusCode != http.StatusOK {
+		t.Fatalf("authenticated register returned %s", resp.Status)
+	}
+	if resp := authPost(t, ts.URL+"/send/bob", bobToken, self); resp.StatusCode != http.StatusOK {
+		t.Fatalf("authenticated send-to-self returned %s", resp.Status)
+	}
+}
+
+func TestDeviceApproval(t *testing.T) {
+	ts := newTestServer(t)
+	bob, phone, mallory := testEdKey(1), testEdKey(2), testEdKey(3)
+	bobToken := login(t, ts.URL, "bob", bob)
+	if resp := authPost(t, ts.URL+"/register/bob", bobToken, testBundle(bob)); resp.StatusCode != http.StatusOK {
+		t.Fatalf("register returned %s", resp.Status)
+	}
+
+	// An unused device name of bob's cannot be claimed by anyone, so
+	// nobody can have copies of bob's messages sent to a device of theirs.
+	resp := answerChallenge(t, ts.URL, "bob/evil", mallory)
+	var apiErr apiError
+	json.NewDecoder(resp.Body).Decode(&apiErr)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden || apiErr.Code != codeDeviceNotApproved {
+		t.Fatalf("login as an unapproved device returned %s %+v", resp.Status, apiErr)
+	}
+	var devices struct {
+		Devices []string `json:"devices"`
+	}
+	if getJSON(t, ts.URL+"/devices/bob", &devices); len(devices.Devices) != 1 {
+		t.Fatalf("the rejected device must not be listed, got %v", devices.Devices)
+	}
+
+	// Only a device of bob's may approve one.
+	malloryToken := login(t, ts.URL, "mallory", mallory)
+	approval := x3dh.DeviceApproval{Ed25519: edPublic(mallory)}
+	if resp := postJSON(t, ts.URL+"/devices/bob/evil", approval); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("approval without token returned %s", resp.Status)
+	}
+	if resp := authPost(t, ts.URL+"/devices/bob/evil", malloryToken, approval); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("approval by another user returned %s", resp.Status)
+	}
+	if resp := authPost(t, ts.URL+"/devices/bob/phone", bobToken, x3dh.DeviceApproval{Ed25519: "zz"}); resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("approval of a malformed key returned %s", resp.Status)
+	}
+
+	approveDevice(t, ts.URL, "bob/phone", bobToken, phone)
+	phoneToken := login(t, ts.URL, "bob/phone", phone)
+	if resp := authPost(t, ts.URL+"/register/bob/phone", phoneToken, testBundle(phone)); resp.StatusCode != http.StatusOK {
+		t.Fatalf("register approved device returned %s", resp.Status)
+	}
+	// Approving again is harmless, but cannot replace a device's key.
+	approveDevice(t, ts.URL, "bob/phone", phoneToken, phone)
+	if resp := authPost(t, ts.URL+"/devices/bob/phone", bobToken, approval); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("re-approval with another key returned %s", resp.Status)
+	}
+	if resp := answerChallenge(t, ts.URL, "bob/phone", mallory); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("login as the phone with another key returned %s", resp.Status)
+	}
+}
+
+func TestAuthChallengeSingleUse(t *testing.T) {
+	ts := newTestServer(t)
+	ed := testEdKey(1)
+	resp := postJSON(t, ts.URL+"/auth/challenge/bob", nil)
+	var challenge x3dh.AuthChallenge
+	json.NewDecoder(resp.Body).Decode(&challenge)
+	resp.Body.Close()
+
+	answer := x3dh.SignChallenge(ed, "bob", challenge.Nonce)
+	if resp := postJSON(t, ts.URL+"/auth/token/alice", x3dh.SignChallenge(ed, "alice", challenge.Nonce)); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("nonce issued for bob accepted for alice: %s", resp.Status)
+	}
+	// The failed attempt above burned the nonce.
+	if resp := postJSON(t, ts.URL+"/auth/token/bob", answer); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("reused nonce returned %s", resp.Status)
+	}
+
+	bad := x3dh.SignChallenge(testEdKey(2), "bob", "")
+	bad.Ed25519 = edPublic(ed)
+	resp = postJSON(t, ts.URL+"/auth/challenge/bob", nil)
+	json.NewDecoder(resp.Body).Decode(&challenge)
+	resp.Body.Close()
+	bad.Nonce = challenge.Nonce
+	if resp := postJSON(t, ts.URL+"/auth/token/bob", bad); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("bad signature returned %s", resp.Status)
+	}
+}
+
+func TestAuthTokenExpiry(t *testing.T) {
+	ts := newTestServer(t)
+	token := login(t, ts.URL, "bob", testEdKey(1))
+	serverState.auth.now = func() time.Time { return time.Now().Add(tokenTTL + time.Second) }
+	if code := authGet(t, ts.URL+"/history/bob", token, nil); code != http.StatusUnauthorized {
+		t.Fatalf("expired token returned %d", code)
+	}
+}
+
+func TestRegisterValidation(t *testing.T) {
+	ts := newTestServer(t)
+	ed := testEdKey(1)
+	token := login(t, ts.URL, "bob", ed)
+	lowOrder := "0000000000000000000000000000000000000000000000000000000000000000"
+
+	tests := []struct {
+		name   string
+		mutate func(b *x3dh.Bundle)
+		code   string
+		field  string
+	}{
+		{"empty ik", func(b *x3dh.Bundle) { b.IK = "" }, codeMalformedKey, "ik"},
+		{"low-order spk", func(b *x3dh.Bundle) { b.SPK = lowOrder }, codeLowOrderKey, "spk"},
+		{"inline otk without id", func(b *x3dh.Bundle) { b.OTK = testKey(9) }, codeMissingOTKID, "otk_id"},
+		{"garbled sig", func(b *x3dh.Bundle) { b.Sig = "sig" }, codeMalformedSignature, "sig"},
+		{"sig over another spk", func(b *x3dh.Bundle) { b.SPK = testKey(3) }, codeInvalidSignature, "sig"},
+	}
+	for _, tc := range tests {
+		bundle := testBundle(ed)
+		tc.mutate(&bundle)
+		resp := authPost(t, ts.URL+"/register/bob", token, bundle)
+		var got apiError
+		json.NewDecoder(resp.Body).Decode(&got)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnprocessableEntity || got.Code != tc.code || got.Field != tc.field {
+			t.Errorf("%s: got %s %+v, want %s on %s", tc.name, resp.Status, got, tc.code, tc.field)
+		}
+	}
+	if _, exists := serverState.GetBundle(context.Background(), "bob"); exists {
+		t.Fatal("an invalid bundle was stored")
+	}
+
+	resp := authPost(t, ts.URL+"/register/bob", token, testBundle(ed))
+	resp.Body.Close()
+	otks := []x3dh.OneTimePreKey{{ID: 1, Key: testKey(10)}, {ID: 2, Key: lowOrder}}
+	resp = authPost(t, ts.URL+"/otks/bob", token, otks)
+	var got apiError
+	json.NewDecoder(resp.Body).Decode(&got)
+	resp.Body.Close()
+	if got.Code != codeLowOrderKey || got.Field != "[1].key" {
+		t.Fatalf("low-order OTK upload returned %s %+v", resp.Status, got)
+	}
+}
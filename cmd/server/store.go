@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"x3dh-demo/internal/x3dh"
+)
+
+// ErrNotFound is returned by a Store when the requested bundle, one-time
+// prekey or message does not exist.
+var ErrNotFound = errors.New("not found")
+
+// ErrMailboxFull is returned by PushMessage when the user's mailbox is at
+// its size limit.
+var ErrMailboxFull = errors.New("mailbox full")
+
+// Store is the storage backend behind the relay server. Implementations
+// must be safe for concurrent use by multiple handlers. Apart from
+// ListDevices, the user a method takes is a mailbox address (see
+// deviceAddress).
+type Store interface {
+	// PutBundle stores or replaces a user's bundle (without OTK) and records
+	// when it was stored.
+	PutBundle(ctx context.Context, user string, bundle x3dh.Bundle) error
+	// GetBundle returns a user's bundle or ErrNotFound.
+	GetBundle(ctx context.Context, user string) (*x3dh.Bundle, error)
+	// ListDevices returns the sorted device names of user (a plain user
+	// name) that have a bundle.
+	ListDevices(ctx context.Context, user string) ([]string, error)
+
+	// PinIdentity records edKey as the user's Ed25519 identity key unless
+	// one is already pinned, and returns the key that is pinned afterwards.
+	PinIdentity(ctx context.Context, user, edKey string) (string, error)
+	// ClaimIdentity is PinIdentity for a device that has not been approved:
+	// if user has no pinned key, edKey is only pinned when no other device
+	// of the same user has a pinned key or a bundle. Otherwise it returns "".
+	ClaimIdentity(ctx context.Context, user, edKey string) (string, error)
+
+	// AddOneTimePreKeys adds a batch of one-time prekeys to a user's pool.
+	AddOneTimePreKeys(ctx context.Context, user string, otks []x3dh.OneTimePreKey) error
+	// PopOneTimePreKey atomically removes and returns one OTK, or ErrNotFound if the pool is empty.
+	PopOneTimePreKey(ctx context.Context, user string) (*x3dh.OneTimePreKey, error)
+	// CountOneTimePreKeys returns the size of a user's OTK pool.
+	CountOneTimePreKeys(ctx context.Context, user string) (int64, error)
+	// ClearOneTimePreKeys discards a user's whole OTK pool.
+	ClearOneTimePreKeys(ctx context.Context, user string) error
+
+	// TouchBundle records that user was active at t, which keeps the bundle
+	// from expiring. It does nothing if the user has no bundle.
+	TouchBundle(ctx context.Context, user string, t time.Time) error
+	// ExpireBundles deletes the bundle and OTK pool of every user whose
+	// bundle was last stored or touched before cutoff, and returns those
+	// users. Pinned identities are kept so an abandoned name cannot be taken
+	// over.
+	ExpireBundles(ctx context.Context, cutoff time.Time) ([]string, error)
+
+	// PushMessage appends a message to a user's queue, or returns
+	// ErrMailboxFull if the user already has limit queued and in-flight
+	// messages. A limit of 0 means no limit.
+	PushMessage(ctx context.Context, user string, msg x3dh.InitialMessage, limit int) error
+	// LeaseMessage moves the oldest queued message in flight until now+lease
+	// and reports how many are left in the queue, or returns ErrNotFound if
+	// the queue is empty. In-flight messages whose lease has expired are first
+	// put back at the head of the queue in their original order. A message
+	// queued without an id is given one. Expired messages are dropped
+	// rather than leased and counted in the messages_expired counter.
+	LeaseMessage(ctx context.Context, user string, lease time.Duration) (*x3dh.InitialMessage, int64, error)
+	// AckMessage deletes an in-flight message, or returns ErrNotFound if no
+	// message with that id is in flight.
+	AckMessage(ctx context.Context, user, id string) error
+	// ExpireMessages deletes every queued and in-flight message whose
+	// expiry is not after now, and returns how many were deleted.
+	ExpireMessages(ctx context.Context, now time.Time) (int64, error)
+	// ListMessages returns a user's in-flight and queued messages without
+	// removing them.
+	ListMessages(ctx context.Context, user string) ([]x3dh.InitialMessage, error)
+	// Subscribe returns a channel that receives a value whenever a message
+	// is pushed to user's queue, possibly by another server process. Wakeups
+	// may be coalesced. The channel is closed once ctx is done.
+	Subscribe(ctx context.Context, user string) (<-chan struct{}, error)
+
+	// CountBundles returns the number of registered bundles.
+	CountBundles(ctx context.Context) (int64, error)
+	// MailboxSizes returns the number of queued and in-flight messages of
+	// every user that has any.
+	MailboxSizes(ctx context.Context) (map[string]int64, error)
+	// OTKPoolSizes returns the OTK pool size of every user that has a
+	// bundle or a non-empty pool.
+	OTKPoolSizes(ctx context.Context) (map[string]int64, error)
+
+	// IncrCounter atomically adds delta to a named statistics counter that
+	// survives restarts.
+	IncrCounter(ctx context.Context, name string, delta int64) error
+	// Counters returns every statistics counter by name.
+	Counters(ctx context.Context) (map[string]int64, error)
+
+	// Close releases the backend's resources.
+	Close() error
+}
+
+// LeasedMessage is a message handed out for delivery but not acknowledged yet.
+type LeasedMessage struct {
+	Message x3dh.InitialMessage `json:"message"`
+	Until   time.Time           `json:"until"`
+}
+
+// devicesOf returns the sorted devices of user among the given addresses.
+func devicesOf(user string, addrs []string) []string {
+	var devices []string
+	for _, addr := range addrs {
+		if u, device := splitAddress(addr); u == user {
+			devices = append(devices, device)
+		}
+	}
+	sort.Strings(devices)
+	return devices
+}
+
+// newMessageID returns a random id for a queued message.
+func newMessageID() string {
+	return randomHex(16)
+}
+
+// messageExpired reports whether msg has expired at now. Messages without
+// an expiry never do.
+func messageExpired(msg x3dh.InitialMessage, now time.Time) bool {
+	return msg.ExpiresAt != 0 && now.Unix() >= msg.ExpiresAt
+}
+
+// dropExpired returns queue and inflight without the messages that have
+// expired at now, and how many were dropped. It does not modify its
+// arguments.
+func dropExpired(queue []x3dh.InitialMessage, inflight []LeasedMessage, now time.Time) ([]x3dh.InitialMessage, []LeasedMessage, int64) {
+	var n int64
+	keptQueue := make([]x3dh.InitialMessage, 0, len(queue))
+	for _, msg := range queue {
+		if messageExpired(msg, now) {
+			n++
+		} else {
+			keptQueue = append(keptQueue, msg)
+		}
+	}
+	keptInflight := make([]LeasedMessage, 0, len(inflight))
+	for _, l := range inflight {
+		if messageExpired(l.Message, now) {
+			n++
+		} else {
+			keptInflight = append(keptInflight, l)
+		}
+	}
+	return keptQueue, keptInflight, n
+}
+
+// leaseNext implements LeaseMessage for the in-process stores. It does not
+// modify its arguments; it returns the leased message (nil if there is none),
+// the new queue and in-flight list, and how many expired messages it dropped.
+func leaseNext(queue []x3dh.InitialMessage, inflight []LeasedMessage, now time.Time, lease time.Duration) (*x3dh.InitialMessage, []x3dh.InitialMessage, []LeasedMessage, int64) {
+	queue, inflight, dropped := dropExpired(queue, inflight, now)
+	var expired []x3dh.InitialMessage
+	kept := make([]LeasedMessage, 0, len(inflight)+1)
+	for _, l := range inflight {
+		if now.After(l.Until) {
+			expired = append(expired, l.Message)
+		} else {
+			kept = append(kept, l)
+		}
+	}
+	queue = append(expired, queue...)
+	if len(queue) == 0 {
+		return nil, queue, kept, dropped
+	}
+	msg := queue[0]
+	if msg.ID == "" {
+		msg.ID = newMessageID()
+	}
+	kept = append(kept, LeasedMessage{Message: msg, Until: now.Add(lease)})
+	return &msg, queue[1:], kept, dropped
+}
+
+// ackFrom removes the message with the given id from an in-flight list,
+// reporting whether it was there. It does not modify inflight.
+func ackFrom(inflight []LeasedMessage, id string) ([]LeasedMessage, bool) {
+	for i, l := range inflight {
+		if l.Message.ID == id {
+			kept := append([]LeasedMessage(nil), inflight[:i]...)
+			return append(kept, inflight[i+1:]...), true
+		}
+	}
+	return inflight, false
+}
@@ -0,0 +1,581 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"x3dh-demo/internal/x3dh"
+)
+
+const (
+	bundlesFile  = "bundles.json"
+	messagesFile = "messages.json"
+	otksFile     = "otks.json"
+	identsFile   = "identities.json"
+	inflightFile = "inflight.json"
+	countersFile = "counters.json"
+)
+
+// bundleRecord is the on-disk form of a bundle in bundles.json.
+type bundleRecord struct {
+	Bundle    x3dh.Bundle `json:"bundle"`
+	CreatedAt time.Time   `json:"created_at"`
+	UpdatedAt time.Time   `json:"updated_at"`
+	ActiveAt  time.Time   `json:"active_at,omitzero"`
+	UserID    string      `json:"user_id"`
+}
+
+// lastActive returns when the bundle was last stored or touched.
+func (rec *bundleRecord) lastActive() time.Time {
+	if rec.ActiveAt.After(rec.UpdatedAt) {
+		return rec.ActiveAt
+	}
+	return rec.UpdatedAt
+}
+
+// FileStore persists bundles, pinned identities, message queues, OTK pools
+// and statistics counters as JSON files in a data directory (the server_data layout).
+// Everything is held in memory
+// and each mutation rewrites the affected file atomically, so a crash leaves
+// either the old or the new version on disk, never a torn one.
+type FileStore struct {
+	dir      string
+	mu       sync.Mutex
+	bundles  map[string]*bundleRecord
+	idents   map[string]string
+	messages map[string][]x3dh.InitialMessage
+	inflight map[string][]LeasedMessage
+	otks     map[string][]x3dh.OneTimePreKey
+	counters map[string]int64
+	notify   *broker
+}
+
+// NewFileStore opens (creating if needed) a file-backed store in dir.
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %v", err)
+	}
+	f := &FileStore{
+		dir:      dir,
+		bundles:  make(map[string]*bundleRecord),
+		idents:   make(map[string]string),
+		messages: make(map[string][]x3dh.InitialMessage),
+		inflight: make(map[string][]LeasedMessage),
+		otks:     make(map[string][]x3dh.OneTimePreKey),
+		counters: make(map[string]int64),
+		notify:   newBroker(),
+	}
+	if err := f.load(bundlesFile, &f.bundles); err != nil {
+		return nil, err
+	}
+	if err := f.load(identsFile, &f.idents); err != nil {
+		return nil, err
+	}
+	if err := f.load(messagesFile, &f.messages); err != nil {
+		return nil, err
+	}
+	if err := f.load(inflightFile, &f.inflight); err != nil {
+		return nil, err
+	}
+	if err := f.load(otksFile, &f.otks); err != nil {
+		return nil, err
+	}
+	if err := f.load(countersFile, &f.counters); err != nil {
+		return nil, err
+	}
+	if err := f.migrateInlineOTKs(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// legacyOTKID is the id of the single OTK that bundles held inline before
+// OTKs had ids. The bob program's key file migration gives its private
+// half the same id.
+const legacyOTKID = 1
+
+// migrateInlineOTKs moves the single OTK that older files kept inline in a
+// bundle into the user's pool, and saves both files so that it is neither
+// lost nor migrated twice.
+func (f *FileStore) migrateInlineOTKs() error {
+	migrated := false
+	for user, rec := range f.bundles {
+		if rec.Bundle.OTK == "" && rec.Bundle.OTKID == 0 {
+			continue
+		}
+		otk := x3dh.OneTimePreKey{ID: rec.Bundle.OTKID, Key: rec.Bundle.OTK}
+		if otk.ID == 0 {
+			otk.ID = legacyOTKID
+		}
+		if otk.Key == "" || slices.ContainsFunc(f.otks[user], func(o x3dh.OneTimePreKey) bool { return o.ID == otk.ID }) {
+			warnLog.Printf("Discarding the inline one-time prekey %d of %s: it is empty or already pooled", otk.ID, user)
+		} else {
+			f.otks[user] = append(f.otks[user], otk)
+		}
+		rec.Bundle.OTK, rec.Bundle.OTKID = "", 0
+		migrated = true
+	}
+	if !migrated {
+		return nil
+	}
+	if err := f.save(otksFile, f.otks); err != nil {
+		return err
+	}
+	return f.save(bundlesFile, f.bundles)
+}
+
+// load reads a JSON file into v; a missing file leaves v untouched.
+func (f *FileStore) load(name string, v interface{}) error {
+	data, err := os.ReadFile(filepath.Join(f.dir, name))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to read %s: %v", name, err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("failed to decode %s: %v", name, err)
+	}
+	return nil
+}
+
+// save atomically replaces a JSON file: the data is written and fsynced to a
+// temporary file, renamed over the target, and the directory is fsynced so
+// the rename itself survives a crash.
+func (f *FileStore) save(name string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(f.dir, name+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write %s: %v", name, err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync %s: %v", name, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(f.dir, name)); err != nil {
+		return fmt.Errorf("failed to replace %s: %v", name, err)
+	}
+	dir, err := os.Open(f.dir)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+func (f *FileStore) PutBundle(ctx context.Context, user string, bundle x3dh.Bundle) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	old := f.bundles[user]
+	rec := &bundleRecord{Bundle: bundle, CreatedAt: now, UpdatedAt: now, UserID: user}
+	if old != nil {
+		rec.CreatedAt = old.CreatedAt
+	}
+	f.bundles[user] = rec
+	if err := f.save(bundlesFile, f.bundles); err != nil {
+		f.restoreBundle(user, old)
+		return err
+	}
+	return nil
+}
+
+func (f *FileStore) TouchBundle(ctx context.Context, user string, t time.Time) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	old := f.bundles[user]
+	if old == nil || !t.After(old.lastActive()) {
+		return nil
+	}
+	rec := *old
+	rec.ActiveAt = t
+	f.bundles[user] = &rec
+	if err := f.save(bundlesFile, f.bundles); err != nil {
+		f.restoreBundle(user, old)
+		return err
+	}
+	return nil
+}
+
+func (f *FileStore) ExpireBundles(ctx context.Context, cutoff time.Time) ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var users []string
+	for user, rec := range f.bundles {
+		if rec.lastActive().Before(cutoff) {
+			users = append(users, user)
+		}
+	}
+	if len(users) == 0 {
+		return nil, nil
+	}
+	oldBundles, oldOTKs := f.bundles, f.otks
+	f.bundles = make(map[string]*bundleRecord, len(oldBundles))
+	for user, rec := range oldBundles {
+		f.bundles[user] = rec
+	}
+	f.otks = make(map[string][]x3dh.OneTimePreKey, len(oldOTKs))
+	for user, pool := range oldOTKs {
+		f.otks[user] = pool
+	}
+	for _, user := range users {
+		delete(f.bundles, user)
+		delete(f.otks, user)
+	}
+	// The pools go first: a crash in between leaves bundles without OTKs,
+	// which clients already handle, rather than OTKs without a bundle.
+	if err := f.save(otksFile, f.otks); err != nil {
+		f.bundles, f.otks = oldBundles, oldOTKs
+		return nil, err
+	}
+	if err := f.save(bundlesFile, f.bundles); err != nil {
+		f.bundles = oldBundles
+		return nil, err
+	}
+	return users, nil
+}
+
+// restoreBundle undoes an in-memory bundle change after a failed save.
+func (f *FileStore) restoreBundle(user string, old *bundleRecord) {
+	if old == nil {
+		delete(f.bundles, user)
+	} else {
+		f.bundles[user] = old
+	}
+}
+
+func (f *FileStore) GetBundle(ctx context.Context, user string) (*x3dh.Bundle, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	rec, ok := f.bundles[user]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	bundle := rec.Bundle
+	return &bundle, nil
+}
+
+func (f *FileStore) ListDevices(ctx context.Context, user string) ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	addrs := make([]string, 0, len(f.bundles))
+	for addr := range f.bundles {
+		addrs = append(addrs, addr)
+	}
+	return devicesOf(user, addrs), nil
+}
+
+func (f *FileStore) PinIdentity(ctx context.Context, user, edKey string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if pinned, ok := f.idents[user]; ok {
+		return pinned, nil
+	}
+	f.idents[user] = edKey
+	if err := f.save(identsFile, f.idents); err != nil {
+		delete(f.idents, user)
+		return "", err
+	}
+	return edKey, nil
+}
+
+func (f *FileStore) ClaimIdentity(ctx context.Context, user, edKey string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if pinned, ok := f.idents[user]; ok {
+		return pinned, nil
+	}
+	addrs := make([]string, 0, len(f.idents)+len(f.bundles))
+	for addr := range f.idents {
+		addrs = append(addrs, addr)
+	}
+	for addr := range f.bundles {
+		addrs = append(addrs, addr)
+	}
+	if owner, _ := splitAddress(user); len(devicesOf(owner, addrs)) > 0 {
+		return "", nil
+	}
+	f.idents[user] = edKey
+	if err := f.save(identsFile, f.idents); err != nil {
+		delete(f.idents, user)
+		return "", err
+	}
+	return edKey, nil
+}
+
+// setOTKs replaces a user's OTK pool and persists it, rolling back on failure.
+func (f *FileStore) setOTKs(user string, pool []x3dh.OneTimePreKey) error {
+	old, had := f.otks[user]
+	if len(pool) == 0 {
+		delete(f.otks, user)
+	} else {
+		f.otks[user] = pool
+	}
+	if err := f.save(otksFile, f.otks); err != nil {
+		if had {
+			f.otks[user] = old
+		} else {
+			delete(f.otks, user)
+		}
+		return err
+	}
+	return nil
+}
+
+func (f *FileStore) AddOneTimePreKeys(ctx context.Context, user string, otks []x3dh.OneTimePreKey) error {
+	if len(otks) == 0 {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	pool := append(append([]x3dh.OneTimePreKey(nil), f.otks[user]...), otks...)
+	return f.setOTKs(user, pool)
+}
+
+func (f *FileStore) PopOneTimePreKey(ctx context.Context, user string) (*x3dh.OneTimePreKey, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	pool := f.otks[user]
+	if len(pool) == 0 {
+		return nil, ErrNotFound
+	}
+	otk := pool[0]
+	if err := f.setOTKs(user, pool[1:]); err != nil {
+		return nil, err
+	}
+	return &otk, nil
+}
+
+func (f *FileStore) CountOneTimePreKeys(ctx context.Context, user string) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return int64(len(f.otks[user])), nil
+}
+
+func (f *FileStore) ClearOneTimePreKeys(ctx context.Context, user string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.otks[user]; !ok {
+		return nil
+	}
+	return f.setOTKs(user, nil)
+}
+
+// setQueue replaces a user's message queue and persists it, rolling back on failure.
+func (f *FileStore) setQueue(user string, queue []x3dh.InitialMessage) error {
+	old, had := f.messages[user]
+	if len(queue) == 0 {
+		delete(f.messages, user)
+	} else {
+		f.messages[user] = queue
+	}
+	if err := f.save(messagesFile, f.messages); err != nil {
+		if had {
+			f.messages[user] = old
+		} else {
+			delete(f.messages, user)
+		}
+		return err
+	}
+	return nil
+}
+
+func (f *FileStore) PushMessage(ctx context.Context, user string, msg x3dh.InitialMessage, limit int) error {
+	f.mu.Lock()
+	if limit > 0 && len(f.messages[user])+len(f.inflight[user]) >= limit {
+		f.mu.Unlock()
+		return ErrMailboxFull
+	}
+	queue := append(append([]x3dh.InitialMessage(nil), f.messages[user]...), msg)
+	err := f.setQueue(user, queue)
+	f.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	f.notify.Notify(user)
+	return nil
+}
+
+// setInflight replaces a user's in-flight list and persists it, rolling back on failure.
+func (f *FileStore) setInflight(user string, inflight []LeasedMessage) error {
+	old, had := f.inflight[user]
+	if len(inflight) == 0 {
+		delete(f.inflight, user)
+	} else {
+		f.inflight[user] = inflight
+	}
+	if err := f.save(inflightFile, f.inflight); err != nil {
+		if had {
+			f.inflight[user] = old
+		} else {
+			delete(f.inflight, user)
+		}
+		return err
+	}
+	return nil
+}
+
+func (f *FileStore) LeaseMessage(ctx context.Context, user string, lease time.Duration) (*x3dh.InitialMessage, int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	oldInflight := f.inflight[user]
+	msg, queue, inflight, dropped := leaseNext(f.messages[user], oldInflight, time.Now(), lease)
+	if msg == nil && dropped == 0 {
+		return nil, 0, ErrNotFound
+	}
+	// The in-flight list is written first: a crash in between leaves the
+	// message in both files and it is delivered twice rather than lost.
+	if err := f.setInflight(user, inflight); err != nil {
+		return nil, 0, err
+	}
+	if err := f.setQueue(user, queue); err != nil {
+		f.setInflight(user, oldInflight)
+		return nil, 0, err
+	}
+	if dropped > 0 {
+		// The messages are gone either way; a failure only skews /stats.
+		f.incrCounter(counterMessagesExpired, dropped)
+	}
+	if msg == nil {
+		return nil, 0, ErrNotFound
+	}
+	return msg, int64(len(queue)), nil
+}
+
+func (f *FileStore) AckMessage(ctx context.Context, user, id string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	inflight, ok := ackFrom(f.inflight[user], id)
+	if !ok {
+		return ErrNotFound
+	}
+	return f.setInflight(user, inflight)
+}
+
+func (f *FileStore) ExpireMessages(ctx context.Context, now time.Time) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var total int64
+	messages := make(map[string][]x3dh.InitialMessage, len(f.messages))
+	for user, queue := range f.messages {
+		kept, _, n := dropExpired(queue, nil, now)
+		total += n
+		if len(kept) > 0 {
+			messages[user] = kept
+		}
+	}
+	inflight := make(map[string][]LeasedMessage, len(f.inflight))
+	for user, list := range f.inflight {
+		_, kept, n := dropExpired(nil, list, now)
+		total += n
+		if len(kept) > 0 {
+			inflight[user] = kept
+		}
+	}
+	if total == 0 {
+		return 0, nil
+	}
+	oldMessages, oldInflight := f.messages, f.inflight
+	f.messages, f.inflight = messages, inflight
+	if err := f.save(inflightFile, f.inflight); err != nil {
+		f.messages, f.inflight = oldMessages, oldInflight
+		return 0, err
+	}
+	if err := f.save(messagesFile, f.messages); err != nil {
+		// The expired in-flight messages are gone from disk already; only
+		// the queue is rolled back.
+		f.messages = oldMessages
+		return 0, err
+	}
+	return total, nil
+}
+
+func (f *FileStore) ListMessages(ctx context.Context, user string) ([]x3dh.InitialMessage, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var list []x3dh.InitialMessage
+	for _, l := range f.inflight[user] {
+		list = append(list, l.Message)
+	}
+	return append(list, f.messages[user]...), nil
+}
+
+func (f *FileStore) Subscribe(ctx context.Context, user string) (<-chan struct{}, error) {
+	return f.notify.Subscribe(ctx, user)
+}
+
+func (f *FileStore) CountBundles(ctx context.Context) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return int64(len(f.bundles)), nil
+}
+
+func (f *FileStore) MailboxSizes(ctx context.Context) (map[string]int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	sizes := make(map[string]int64)
+	for user, queue := range f.messages {
+		sizes[user] += int64(len(queue))
+	}
+	for user, inflight := range f.inflight {
+		sizes[user] += int64(len(inflight))
+	}
+	return sizes, nil
+}
+
+func (f *FileStore) OTKPoolSizes(ctx context.Context) (map[string]int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	sizes := make(map[string]int64)
+	for user := range f.bundles {
+		sizes[user] = 0
+	}
+	for user, pool := range f.otks {
+		sizes[user] = int64(len(pool))
+	}
+	return sizes, nil
+}
+
+func (f *FileStore) IncrCounter(ctx context.Context, name string, delta int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.incrCounter(name, delta)
+}
+
+// incrCounter implements IncrCounter with f.mu held.
+func (f *FileStore) incrCounter(name string, delta int64) error {
+	f.counters[name] += delta
+	if err := f.save(countersFile, f.counters); err != nil {
+		f.counters[name] -= delta
+		return err
+	}
+	return nil
+}
+
+func (f *FileStore) Counters(ctx context.Context) (map[string]int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	counters := make(map[string]int64, len(f.counters))
+	for name, n := range f.counters {
+		counters[name] = n
+	}
+	return counters, nil
+}
+
+func (f *FileStore) Close() error { return nil }
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"x3dh-demo/internal/x3dh"
+)
+
+// MemoryStore keeps everything in process memory. It is meant for tests and
+// for devices that run without Redis; all data is lost on restart.
+type MemoryStore struct {
+	mu       sync.Mutex
+	bundles  map[string]x3dh.Bundle
+	updated  map[string]time.Time // when each bundle was last stored or touched
+	idents   map[string]string
+	otks     map[string][]x3dh.OneTimePreKey
+	messages map[string][]x3dh.InitialMessage
+	inflight map[string][]LeasedMessage
+	counters map[string]int64
+	notify   *broker
+}
+
+// NewMemoryStore creates an empty in-memory store.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		bundles:  make(map[string]x3dh.Bundle),
+		updated:  make(map[string]time.Time),
+		idents:   make(map[string]string),
+		otks:     make(map[string][]x3dh.OneTimePreKey),
+		messages: make(map[string][]x3dh.InitialMessage),
+		inflight: make(map[string][]LeasedMessage),
+		counters: make(map[string]int64),
+		notify:   newBroker(),
+	}
+}
+
+func (m *MemoryStore) PutBundle(ctx context.Context, user string, bundle x3dh.Bundle) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bundles[user] = bundle
+	m.updated[user] = time.Now()
+	return nil
+}
+
+func (m *MemoryStore) TouchBundle(ctx context.Context, user string, t time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if last, ok := m.updated[user]; ok && t.After(last) {
+		m.updated[user] = t
+	}
+	return nil
+}
+
+func (m *MemoryStore) ExpireBundles(ctx context.Context, cutoff time.Time) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var users []string
+	for user, t := range m.updated {
+		if t.Before(cutoff) {
+			delete(m.bundles, user)
+			delete(m.updated, user)
+			delete(m.otks, user)
+			users = append(users, user)
+		}
+	}
+	return users, nil
+}
+
+func (m *MemoryStore) GetBundle(ctx context.Context, user string) (*x3dh.Bundle, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	bundle, ok := m.bundles[user]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &bundle, nil
+}
+
+func (m *MemoryStore) ListDevices(ctx context.Context, user string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	addrs := make([]string, 0, len(m.bundles))
+	for addr := range m.bundles {
+		addrs = append(addrs, addr)
+	}
+	return devicesOf(user, addrs), nil
+}
+
+func (m *MemoryStore) PinIdentity(ctx context.Context, user, edKey string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if pinned, ok := m.idents[user]; ok {
+		return pinned, nil
+	}
+	m.idents[user] = edKey
+	return edKey, nil
+}
+
+func (m *MemoryStore) ClaimIdentity(ctx context.Context, user, edKey string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if pinned, ok := m.idents[user]; ok {
+		return pinned, nil
+	}
+	addrs := make([]string, 0, len(m.idents)+len(m.bundles))
+	for addr := range m.idents {
+		addrs = append(addrs, addr)
+	}
+	for addr := range m.bundles {
+		addrs = append(addrs, addr)
+	}
+	if owner, _ := splitAddress(user); len(devicesOf(owner, addrs)) > 0 {
+		return "", nil
+	}
+	m.idents[user] = edKey
+	return edKey, nil
+}
+
+func (m *MemoryStore) AddOneTimePreKeys(ctx context.Context, user string, otks []x3dh.OneTimePreKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.otks[user] = append(m.otks[user], otks...)
+	return nil
+}
+
+func (m *MemoryStore) PopOneTimePreKey(ctx context.Context, user string) (*x3dh.OneTimePreKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	pool := m.otks[user]
+	if len(pool) == 0 {
+		return nil, ErrNotFound
+	}
+	otk := pool[0]
+	m.otks[user] = pool[1:]
+	return &otk, nil
+}
+
+func (m *MemoryStore) CountOneTimePreKeys(ctx context.Context, user string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return int64(len(m.otks[user])), nil
+}
+
+func (m *MemoryStore) ClearOneTimePreKeys(ctx context.Context, user string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.otks, user)
+	return nil
+}
+
+func (m *MemoryStore) PushMessage(ctx context.Context, user string, msg x3dh.InitialMessage, limit int) error {
+	m.mu.Lock()
+	if limit > 0 && len(m.messages[user])+len(m.inflight[user]) >= limit {
+		m.mu.Unlock()
+		return ErrMailboxFull
+	}
+	m.messages[user] = append(m.messages[user], msg)
+	m.mu.Unlock()
+	m.notify.Notify(user)
+	return nil
+}
+
+func (m *MemoryStore) LeaseMessage(ctx context.Context, user string, lease time.Duration) (*x3dh.InitialMessage, int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	msg, queue, inflight, dropped := leaseNext(m.messages[user], m.inflight[user], time.Now(), lease)
+	m.setLists(user, queue, inflight)
+	if dropped > 0 {
+		m.counters[counterMessagesExpired] += dropped
+	}
+	if msg == nil {
+		return nil, 0, ErrNotFound
+	}
+	return msg, int64(len(queue)), nil
+}
+
+func (m *MemoryStore) AckMessage(ctx context.Context, user, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	inflight, ok := ackFrom(m.inflight[user], id)
+	if !ok {
+		return ErrNotFound
+	}
+	m.setLists(user, m.messages[user], inflight)
+	return nil
+}
+
+func (m *MemoryStore) ExpireMessages(ctx context.Context, now time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var total int64
+	users := make(map[string]bool)
+	for user := range m.messages {
+		users[user] = true
+	}
+	for user := range m.inflight {
+		users[user] = true
+	}
+	for user := range users {
+		queue, inflight, n := dropExpired(m.messages[user], m.inflight[user], now)
+		if n > 0 {
+			m.setLists(user, queue, inflight)
+			total += n
+		}
+	}
+	return total, nil
+}
+
+// setLists replaces a user's queue and in-flight list, dropping empty ones.
+// The caller holds m.mu.
+func (m *MemoryStore) setLists(user string, queue []x3dh.InitialMessage, inflight []LeasedMessage) {
+	if len(queue) == 0 {
+		delete(m.messages, user)
+	} else {
+		m.messages[user] = queue
+	}
+	if len(inflight) == 0 {
+		delete(m.inflight, user)
+	} else {
+		m.inflight[user] = inflight
+	}
+}
+
+func (m *MemoryStore) ListMessages(ctx context.Context, user string) ([]x3dh.InitialMessage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var list []x3dh.InitialMessage
+	for _, l := range m.inflight[user] {
+		list = append(list, l.Message)
+	}
+	return append(list, m.messages[user]...), nil
+}
+
+func (m *MemoryStore) Subscribe(ctx context.Context, user string) (<-chan struct{}, error) {
+	return m.notify.Subscribe(ctx, user)
+}
+
+func (m *MemoryStore) CountBundles(ctx context.Context) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return int64(len(m.bundles)), nil
+}
+
+func (m *MemoryStore) MailboxSizes(ctx context.Context) (map[string]int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sizes := make(map[string]int64)
+	for user, queue := range m.messages {
+		sizes[user] += int64(len(queue))
+	}
+	for user, inflight := range m.inflight {
+		sizes[user] += int64(len(inflight))
+	}
+	return sizes, nil
+}
+
+func (m *MemoryStore) OTKPoolSizes(ctx context.Context) (map[string]int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sizes := make(map[string]int64)
+	for user := range m.bundles {
+		sizes[user] = 0
+	}
+	for user, pool := range m.otks {
+		sizes[user] = int64(len(pool))
+	}
+	return sizes, nil
+}
+
+func (m *MemoryStore) IncrCounter(ctx context.Context, name string, delta int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counters[name] += delta
+	return nil
+}
+
+func (m *MemoryStore) Counters(ctx context.Context) (map[string]int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	counters := make(map[string]int64, len(m.counters))
+	for name, n := range m.counters {
+		counters[name] = n
+	}
+	return counters, nil
+}
+
+func (m *MemoryStore) Close() error { return nil }
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"x3dh-demo/internal/x3dh"
+)
+
+// meteredStore wraps a Store and counts its failures in x3dh_store_errors_total.
+// ErrNotFound and ErrMailboxFull are ordinary outcomes, not failures.
+type meteredStore struct {
+	store   Store
+	metrics *Metrics
+}
+
+func (s meteredStore) check(op string, err error) error {
+	if err != nil && !errors.Is(err, ErrNotFound) && !errors.Is(err, ErrMailboxFull) {
+		s.metrics.StoreError(op)
+	}
+	return err
+}
+
+func (s meteredStore) PutBundle(ctx context.Context, user string, bundle x3dh.Bundle) error {
+	return s.check("PutBundle", s.store.PutBundle(ctx, user, bundle))
+}
+
+func (s meteredStore) GetBundle(ctx context.Context, user string) (*x3dh.Bundle, error) {
+	bundle, err := s.store.GetBundle(ctx, user)
+	return bundle, s.check("GetBundle", err)
+}
+
+func (s meteredStore) ListDevices(ctx context.Context, user string) ([]string, error) {
+	devices, err := s.store.ListDevices(ctx, user)
+	return devices, s.check("ListDevices", err)
+}
+
+func (s meteredStore) PinIdentity(ctx context.Context, user, edKey string) (string, error) {
+	pinned, err := s.store.PinIdentity(ctx, user, edKey)
+	return pinned, s.check("PinIdentity", err)
+}
+
+func (s meteredStore) ClaimIdentity(ctx context.Context, user, edKey string) (string, error) {
+	pinned, err := s.store.ClaimIdentity(ctx, user, edKey)
+	return pinned, s.check("ClaimIdentity", err)
+}
+
+func (s meteredStore) AddOneTimePreKeys(ctx context.Context, user string, otks []x3dh.OneTimePreKey) error {
+	return s.check("AddOneTimePreKeys", s.store.AddOneTimePreKeys(ctx, user, otks))
+}
+
+func (s meteredStore) PopOneTimePreKey(ctx context.Context, user string) (*x3dh.OneTimePreKey, error) {
+	otk, err := s.store.PopOneTimePreKey(ctx, user)
+	return otk, s.check("PopOneTimePreKey", err)
+}
+
+func (s meteredStore) CountOneTimePreKeys(ctx context.Context, user string) (int64, error) {
+	n, err := s.store.CountOneTimePreKeys(ctx, user)
+	return n, s.check("CountOneTimePreKeys", err)
+}
+
+func (s meteredStore) ClearOneTimePreKeys(ctx context.Context, user string) error {
+	return s.check("ClearOneTimePreKeys", s.store.ClearOneTimePreKeys(ctx, user))
+}
+
+func (s meteredStore) TouchBundle(ctx context.Context, user string, t time.Time) error {
+	return s.check("TouchBundle", s.store.TouchBundle(ctx, user, t))
+}
+
+func (s meteredStore) ExpireBundles(ctx context.Context, cutoff time.Time) ([]string, error) {
+	users, err := s.store.ExpireBundles(ctx, cutoff)
+	return users, s.check("ExpireBundles", err)
+}
+
+func (s meteredStore) PushMessage(ctx context.Context, user string, msg x3dh.InitialMessage, limit int) error {
+	return s.check("PushMessage", s.store.PushMessage(ctx, user, msg, limit))
+}
+
+func (s meteredStore) LeaseMessage(ctx context.Context, user string, lease time.Duration) (*x3dh.InitialMessage, int64, error) {
+	msg, left, err := s.store.LeaseMessage(ctx, user, lease)
+	return msg, left, s.check("LeaseMessage", err)
+}
+
+func (s meteredStore) AckMessage(ctx context.Context, user, id string) error {
+	return s.check("AckMessage", s.store.AckMessage(ctx, user, id))
+}
+
+func (s meteredStore) ExpireMessages(ctx context.Context, now time.Time) (int64, error) {
+	n, err := s.store.ExpireMessages(ctx, now)
+	return n, s.check("ExpireMessages", err)
+}
+
+func (s meteredStore) ListMessages(ctx context.Context, user string) ([]x3dh.InitialMessage, error) {
+	list, err := s.store.ListMessages(ctx, user)
+	return list, s.check("ListMessages", err)
+}
+
+func (s meteredStore) Subscribe(ctx context.Context, user string) (<-chan struct{}, error) {
+	ch, err := s.store.Subscribe(ctx, user)
+	return ch, s.check("Subscribe", err)
+}
+
+func (s meteredStore) CountBundles(ctx context.Context) (int64, error) {
+	n, err := s.store.CountBundles(ctx)
+	return n, s.check("CountBundles", err)
+}
+
+func (s meteredStore) MailboxSizes(ctx context.Context) (map[string]int64, error) {
+	sizes, err := s.store.MailboxSizes(ctx)
+	return sizes, s.check("MailboxSizes", err)
+}
+
+func (s meteredStore) OTKPoolSizes(ctx context.Context) (map[string]int64, error) {
+	sizes, err := s.store.OTKPoolSizes(ctx)
+	return sizes, s.check("OTKPoolSizes", err)
+}
+
+func (s meteredStore) IncrCounter(ctx context.Context, name string, delta int64) error {
+	return s.check("IncrCounter", s.store.IncrCounter(ctx, name, delta))
+}
+
+func (s meteredStore) Counters(ctx context.Context) (map[string]int64, error) {
+	counters, err := s.store.Counters(ctx)
+	return counters, s.check("Counters", err)
+}
+
+func (s meteredStore) Close() error {
+	return s.store.Close()
+}
@@ -0,0 +1,509 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"x3dh-demo/internal/x3dh"
+)
+
+// RedisStore keeps bundles in "bundle:{user}" strings, with the time each
+// was last stored or touched in the "bundles:updated" sorted set and the
+// device names of each user in a "devices:{user}" set, pinned Ed25519 keys
+// in "identity:{user}" strings with the devices that have one in an
+// "identities:{user}" set, one-time prekeys in "otks:{user}" sets and
+// message queues in "messages:{user}" lists. Leased messages live in the
+// "inflight:{user}" hash (id to message) with their deadlines in the
+// "leases:{user}" sorted set. Statistics counters are fields of the "stats"
+// hash. New messages are announced on
+// the "notify:{user}" pub/sub channel so every server instance can wake its
+// subscribers.
+type RedisStore struct {
+	rdb *redis.Client
+}
+
+// NewRedisStore wraps a Redis client as a Store.
+func NewRedisStore(rdb *redis.Client) *RedisStore {
+	return &RedisStore{rdb: rdb}
+}
+
+func (r *RedisStore) PutBundle(ctx context.Context, user string, bundle x3dh.Bundle) error {
+	data, _ := json.Marshal(bundle)
+	owner, device := splitAddress(user)
+	_, err := r.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, "bundle:"+user, data, 0)
+		pipe.SAdd(ctx, "devices:"+owner, device)
+		pipe.ZAdd(ctx, "bundles:updated", redis.Z{Score: float64(time.Now().UnixMilli()), Member: user})
+		return nil
+	})
+	return err
+}
+
+func (r *RedisStore) TouchBundle(ctx context.Context, user string, t time.Time) error {
+	// XX skips users without a bundle, GT never moves the time back.
+	return r.rdb.ZAddArgs(ctx, "bundles:updated", redis.ZAddArgs{
+		XX:      true,
+		GT:      true,
+		Members: []redis.Z{{Score: float64(t.UnixMilli()), Member: user}},
+	}).Err()
+}
+
+// expireBundleScript deletes a user's bundle and OTK pool if the bundle was
+// still last stored or touched before the cutoff, so a concurrent
+// re-registration or touch wins.
+// KEYS: bundles:updated, bundle, otks, devices. ARGV: user, cutoff (ms),
+// device.
+var expireBundleScript = redis.NewScript(`
+local updated = redis.call('ZSCORE', KEYS[1], ARGV[1])
+if not updated or tonumber(updated) >= tonumber(ARGV[2]) then
+	return 0
+end
+redis.call('DEL', KEYS[2], KEYS[3])
+redis.call('ZREM', KEYS[1], ARGV[1])
+redis.call('SREM', KEYS[4], ARGV[3])
+return 1
+`)
+
+// ExpireBundles only sees bundles stored since "bundles:updated" was
+// introduced; older ones are picked up the next time they are registered.
+func (r *RedisStore) ExpireBundles(ctx context.Context, cutoff time.Time) ([]string, error) {
+	users, err := r.rdb.ZRangeByScore(ctx, "bundles:updated", &redis.ZRangeBy{
+		Min: "-inf",
+		Max: fmt.Sprintf("(%d", cutoff.UnixMilli()),
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	var expired []string
+	for _, user := range users {
+		owner, device := splitAddress(user)
+		keys := []string{"bundles:updated", "bundle:" + user, "otks:" + user, "devices:" + owner}
+		n, err := expireBundleScript.Run(ctx, r.rdb, keys, user, cutoff.UnixMilli(), device).Int()
+		if err != nil {
+			return expired, err
+		}
+		if n == 1 {
+			expired = append(expired, user)
+		}
+	}
+	return expired, nil
+}
+
+func (r *RedisStore) GetBundle(ctx context.Context, user string) (*x3dh.Bundle, error) {
+	data, err := r.rdb.Get(ctx, "bundle:"+user).Result()
+	if err == redis.Nil {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	var bundle x3dh.Bundle
+	if err := json.Unmarshal([]byte(data), &bundle); err != nil {
+		return nil, fmt.Errorf("failed to decode bundle: %v", err)
+	}
+	return &bundle, nil
+}
+
+// ListDevices also reports the default device of a user registered before
+// "devices:{user}" existed.
+func (r *RedisStore) ListDevices(ctx context.Context, user string) ([]string, error) {
+	devices, err := r.rdb.SMembers(ctx, "devices:"+user).Result()
+	if err != nil {
+		return nil, err
+	}
+	n, err := r.rdb.Exists(ctx, "bundle:"+user).Result()
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, 0, len(devices)+1)
+	for _, device := range devices {
+		addrs = append(addrs, deviceAddress(user, device))
+	}
+	if n == 1 && !slices.Contains(devices, defaultDevice) {
+		addrs = append(addrs, user)
+	}
+	return devicesOf(user, addrs), nil
+}
+
+// pinScript pins an identity key unless one is pinned, and records the
+// device in the user's "identities:{user}" set. With claim set it refuses
+// when another device of the user has a pinned key or a bundle; keys pinned
+// before the set existed are caught by the default device's keys.
+// KEYS: identity, identities, devices, default device's identity, default
+// device's bundle. ARGV: key, device, claim ("1" or "0").
+var pinScript = redis.NewScript(`
+local pinned = redis.call('GET', KEYS[1])
+if pinned then
+	return pinned
+end
+if ARGV[3] == '1' and (redis.call('SCARD', KEYS[2]) > 0 or redis.call('SCARD', KEYS[3]) > 0
+		or redis.call('EXISTS', KEYS[4]) == 1 or redis.call('EXISTS', KEYS[5]) == 1) then
+	return ''
+end
+redis.call('SET', KEYS[1], ARGV[1])
+redis.call('SADD', KEYS[2], ARGV[2])
+return ARGV[1]
+`)
+
+func (r *RedisStore) pin(ctx context.Context, user, edKey string, claim bool) (string, error) {
+	owner, device := splitAddress(user)
+	keys := []string{"identity:" + user, "identities:" + owner, "devices:" + owner, "identity:" + owner, "bundle:" + owner}
+	flag := "0"
+	if claim {
+		flag = "1"
+	}
+	return pinScript.Run(ctx, r.rdb, keys, edKey, device, flag).Text()
+}
+
+func (r *RedisStore) PinIdentity(ctx context.Context, user, edKey string) (string, error) {
+	return r.pin(ctx, user, edKey, false)
+}
+
+func (r *RedisStore) ClaimIdentity(ctx context.Context, user, edKey string) (string, error) {
+	return r.pin(ctx, user, edKey, true)
+}
+
+func (r *RedisStore) AddOneTimePreKeys(ctx context.Context, user string, otks []x3dh.OneTimePreKey) error {
+	if len(otks) == 0 {
+		return nil
+	}
+	members := make([]interface{}, 0, len(otks))
+	for _, otk := range otks {
+		data, _ := json.Marshal(otk)
+		members = append(members, data)
+	}
+	return r.rdb.SAdd(ctx, "otks:"+user, members...).Err()
+}
+
+func (r *RedisStore) PopOneTimePreKey(ctx context.Context, user string) (*x3dh.OneTimePreKey, error) {
+	data, err := r.rdb.SPop(ctx, "otks:"+user).Result()
+	if err == redis.Nil {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	var otk x3dh.OneTimePreKey
+	if err := json.Unmarshal([]byte(data), &otk); err != nil {
+		return nil, fmt.Errorf("failed to decode OTK: %v", err)
+	}
+	return &otk, nil
+}
+
+func (r *RedisStore) CountOneTimePreKeys(ctx context.Context, user string) (int64, error) {
+	return r.rdb.SCard(ctx, "otks:"+user).Result()
+}
+
+func (r *RedisStore) ClearOneTimePreKeys(ctx context.Context, user string) error {
+	return r.rdb.Del(ctx, "otks:"+user).Err()
+}
+
+// pushScript appends a message unless the mailbox is full, and announces it.
+// KEYS: messages, inflight. ARGV: message, limit (0 for none), channel.
+var pushScript = redis.NewScript(`
+local limit = tonumber(ARGV[2])
+if limit > 0 and redis.call('LLEN', KEYS[1]) + redis.call('HLEN', KEYS[2]) >= limit then
+	return 0
+end
+redis.call('RPUSH', KEYS[1], ARGV[1])
+redis.call('PUBLISH', ARGV[3], '')
+return 1
+`)
+
+func (r *RedisStore) PushMessage(ctx context.Context, user string, msg x3dh.InitialMessage, limit int) error {
+	data, _ := json.Marshal(msg)
+	keys := []string{"messages:" + user, "inflight:" + user}
+	n, err := pushScript.Run(ctx, r.rdb, keys, data, limit, "notify:"+user).Int()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrMailboxFull
+	}
+	return nil
+}
+
+// leaseScript requeues expired leases at the head of the queue (oldest
+// first), drops expired messages from the head of the queue, then moves the
+// head of the queue in flight. Dropped messages are added to a counter in
+// the stats hash.
+// KEYS: messages, inflight, leases, stats. ARGV: now (ms), deadline (ms), id
+// for a message queued without one, counter name.
+var leaseScript = redis.NewScript(`
+local expired = redis.call('ZRANGEBYSCORE', KEYS[3], '-inf', '(' .. ARGV[1])
+for i = #expired, 1, -1 do
+	local data = redis.call('HGET', KEYS[2], expired[i])
+	if data then
+		redis.call('LPUSH', KEYS[1], data)
+	end
+	redis.call('HDEL', KEYS[2], expired[i])
+	redis.call('ZREM', KEYS[3], expired[i])
+end
+local data, msg
+local dropped = 0
+while true do
+	data = redis.call('LPOP', KEYS[1])
+	if not data then
+		break
+	end
+	msg = cjson.decode(data)
+	if not (type(msg.expires_at) == 'number' and msg.expires_at > 0 and msg.expires_at * 1000 <= tonumber(ARGV[1])) then
+		break
+	end
+	dropped = dropped + 1
+end
+if dropped > 0 then
+	redis.call('HINCRBY', KEYS[4], ARGV[4], dropped)
+end
+if not data then
+	return false
+end
+if type(msg.id) ~= 'string' or msg.id == '' then
+	msg.id = ARGV[3]
+	data = cjson.encode(msg)
+end
+redis.call('HSET', KEYS[2], msg.id, data)
+redis.call('ZADD', KEYS[3], ARGV[2], msg.id)
+return {data, redis.call('LLEN', KEYS[1])}
+`)
+
+// ackScript deletes an in-flight message. KEYS: inflight, leases. ARGV: id.
+var ackScript = redis.NewScript(`
+if redis.call('HDEL', KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+redis.call('ZREM', KEYS[2], ARGV[1])
+return 1
+`)
+
+func (r *RedisStore) LeaseMessage(ctx context.Context, user string, lease time.Duration) (*x3dh.InitialMessage, int64, error) {
+	now := time.Now()
+	keys := []string{"messages:" + user, "inflight:" + user, "leases:" + user, "stats"}
+	res, err := leaseScript.Run(ctx, r.rdb, keys, now.UnixMilli(), now.Add(lease).UnixMilli(), newMessageID(), counterMessagesExpired).Slice()
+	if err == redis.Nil {
+		return nil, 0, ErrNotFound
+	} else if err != nil {
+		return nil, 0, err
+	}
+	data, _ := res[0].(string)
+	left, _ := res[1].(int64)
+	var msg x3dh.InitialMessage
+	if err := json.Unmarshal([]byte(data), &msg); err != nil {
+		return nil, 0, fmt.Errorf("failed to decode message: %v", err)
+	}
+	return &msg, left, nil
+}
+
+func (r *RedisStore) AckMessage(ctx context.Context, user, id string) error {
+	n, err := ackScript.Run(ctx, r.rdb, []string{"inflight:" + user, "leases:" + user}, id).Int()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// expireScript deletes a user's expired queued and in-flight messages.
+// KEYS: messages, inflight, leases. ARGV: now (s).
+var expireScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local function expired(data)
+	local msg = cjson.decode(data)
+	return type(msg.expires_at) == 'number' and msg.expires_at > 0 and msg.expires_at <= now
+end
+local n = 0
+for _, data in ipairs(redis.call('LRANGE', KEYS[1], 0, -1)) do
+	if expired(data) then
+		n = n + redis.call('LREM', KEYS[1], 1, data)
+	end
+end
+local inflight = redis.call('HGETALL', KEYS[2])
+for i = 1, #inflight, 2 do
+	if expired(inflight[i + 1]) then
+		redis.call('HDEL', KEYS[2], inflight[i])
+		redis.call('ZREM', KEYS[3], inflight[i])
+		n = n + 1
+	end
+end
+return n
+`)
+
+func (r *RedisStore) ExpireMessages(ctx context.Context, now time.Time) (int64, error) {
+	users := make(map[string]bool)
+	for _, pattern := range []string{"messages:*", "inflight:*"} {
+		keys, err := r.scanKeys(ctx, pattern)
+		if err != nil {
+			return 0, err
+		}
+		for _, key := range keys {
+			users[key[strings.Index(key, ":")+1:]] = true
+		}
+	}
+	var total int64
+	for user := range users {
+		keys := []string{"messages:" + user, "inflight:" + user, "leases:" + user}
+		n, err := expireScript.Run(ctx, r.rdb, keys, now.Unix()).Int64()
+		if err != nil {
+			return total, err
+		}
+		total += n
+	}
+	return total, nil
+}
+
+func (r *RedisStore) ListMessages(ctx context.Context, user string) ([]x3dh.InitialMessage, error) {
+	var data []string
+	ids, err := r.rdb.ZRange(ctx, "leases:"+user, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) > 0 {
+		leased, err := r.rdb.HMGet(ctx, "inflight:"+user, ids...).Result()
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range leased {
+			if s, ok := item.(string); ok {
+				data = append(data, s)
+			}
+		}
+	}
+	queued, err := r.rdb.LRange(ctx, "messages:"+user, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	data = append(data, queued...)
+	var messages []x3dh.InitialMessage
+	for _, item := range data {
+		var msg x3dh.InitialMessage
+		if err := json.Unmarshal([]byte(item), &msg); err == nil {
+			messages = append(messages, msg)
+		}
+	}
+	return messages, nil
+}
+
+func (r *RedisStore) Subscribe(ctx context.Context, user string) (<-chan struct{}, error) {
+	ps := r.rdb.Subscribe(ctx, "notify:"+user)
+	// Wait for the confirmation so no publish after we return is missed.
+	if _, err := ps.Receive(ctx); err != nil {
+		ps.Close()
+		return nil, err
+	}
+	ch := make(chan struct{}, 1)
+	go func() {
+		defer close(ch)
+		defer ps.Close()
+		msgs := ps.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case _, ok := <-msgs:
+				if !ok {
+					return
+				}
+				select {
+				case ch <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// scanKeys collects all keys matching pattern without blocking Redis like KEYS would.
+func (r *RedisStore) scanKeys(ctx context.Context, pattern string) ([]string, error) {
+	var keys []string
+	iter := r.rdb.Scan(ctx, 0, pattern, 100).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	return keys, iter.Err()
+}
+
+func (r *RedisStore) CountBundles(ctx context.Context) (int64, error) {
+	keys, err := r.scanKeys(ctx, "bundle:*")
+	return int64(len(keys)), err
+}
+
+func (r *RedisStore) MailboxSizes(ctx context.Context) (map[string]int64, error) {
+	sizes := make(map[string]int64)
+	keys, err := r.scanKeys(ctx, "messages:*")
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		n, err := r.rdb.LLen(ctx, key).Result()
+		if err != nil {
+			return nil, err
+		}
+		sizes[strings.TrimPrefix(key, "messages:")] += n
+	}
+	keys, err = r.scanKeys(ctx, "inflight:*")
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		n, err := r.rdb.HLen(ctx, key).Result()
+		if err != nil {
+			return nil, err
+		}
+		sizes[strings.TrimPrefix(key, "inflight:")] += n
+	}
+	return sizes, nil
+}
+
+func (r *RedisStore) OTKPoolSizes(ctx context.Context) (map[string]int64, error) {
+	sizes := make(map[string]int64)
+	keys, err := r.scanKeys(ctx, "bundle:*")
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		sizes[strings.TrimPrefix(key, "bundle:")] = 0
+	}
+	keys, err = r.scanKeys(ctx, "otks:*")
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		n, err := r.rdb.SCard(ctx, key).Result()
+		if err != nil {
+			return nil, err
+		}
+		sizes[strings.TrimPrefix(key, "otks:")] = n
+	}
+	return sizes, nil
+}
+
+func (r *RedisStore) IncrCounter(ctx context.Context, name string, delta int64) error {
+	return r.rdb.HIncrBy(ctx, "stats", name, delta).Err()
+}
+
+func (r *RedisStore) Counters(ctx context.Context) (map[string]int64, error) {
+	fields, err := r.rdb.HGetAll(ctx, "stats").Result()
+	if err != nil {
+		return nil, err
+	}
+	counters := make(map[string]int64, len(fields))
+	for name, v := range fields {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode counter %s: %v", name, err)
+		}
+		counters[name] = n
+	}
+	return counters, nil
+}
+
+func (r *RedisStore) Close() error {
+	return r.rdb.Close()
+}
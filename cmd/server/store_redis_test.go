@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// TestRedisStore runs the shared store suites, and with them the Lua
+// scripts, against an in-process miniredis.
+func TestRedisStore(t *testing.T) {
+	for _, suite := range []func(*testing.T, Store){testStore, testRetention} {
+		mr := miniredis.RunT(t)
+		store := NewRedisStore(redis.NewClient(&redis.Options{Addr: mr.Addr()}))
+		suite(t, store)
+		store.Close()
+	}
+}
+
+// TestRedisStore_Server runs the same suites against a real Redis. It is
+// skipped unless X3DH_TEST_REDIS_ADDR is set, and flushes the database
+// X3DH_TEST_REDIS_DB (15 by default) before and after each suite, so never
+// point it at one holding data.
+func TestRedisStore_Server(t *testing.T) {
+	addr := os.Getenv("X3DH_TEST_REDIS_ADDR")
+	if addr == "" {
+		t.Skip("set X3DH_TEST_REDIS_ADDR to run the store tests against Redis")
+	}
+	db := 15
+	if s := os.Getenv("X3DH_TEST_REDIS_DB"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			t.Fatalf("invalid X3DH_TEST_REDIS_DB %q: %v", s, err)
+		}
+		db = n
+	}
+	rdb := redis.NewClient(&redis.Options{Addr: addr, DB: db})
+	store := NewRedisStore(rdb)
+	t.Cleanup(func() { store.Close() })
+
+	ctx := context.Background()
+	flush := func() {
+		if err := rdb.FlushDB(ctx).Err(); err != nil {
+			t.Fatalf("failed to flush Redis database %d at %s: %v", db, addr, err)
+		}
+	}
+	flush()
+	t.Cleanup(flush)
+	testStore(t, store)
+	flush()
+	testRetention(t, store)
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"x3dh-demo/internal/x3dh"
+)
+
+// testStore runs the behaviour every Store implementation must share.
+func testStore(t *testing.T, store Store) {
+	ctx := context.Background()
+
+	if _, err := store.GetBundle(ctx, "bob"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound for missing bundle, got %v", err)
+	}
+	bundle := x3dh.Bundle{IK: testKey(1), SPK: testKey(2), SPKID: 1}
+	if err := store.PutBundle(ctx, "bob", bundle); err != nil {
+		t.Fatalf("PutBundle failed: %v", err)
+	}
+	got, err := store.GetBundle(ctx, "bob")
+	if err != nil || *got != bundle {
+		t.Fatalf("GetBundle returned %+v, %v", got, err)
+	}
+
+	if pinned, err := store.PinIdentity(ctx, "bob", "ed-1"); err != nil || pinned != "ed-1" {
+		t.Fatalf("first PinIdentity returned %q, %v", pinned, err)
+	}
+	if pinned, err := store.PinIdentity(ctx, "bob", "ed-2"); err != nil || pinned != "ed-1" {
+		t.Fatalf("PinIdentity must keep the first key, got %q, %v", pinned, err)
+	}
+	// Only the first device of a user may claim a key.
+	if pinned, err := store.ClaimIdentity(ctx, "bob", "ed-2"); err != nil || pinned != "ed-1" {
+		t.Fatalf("ClaimIdentity must keep the pinned key, got %q, %v", pinned, err)
+	}
+	if pinned, err := store.ClaimIdentity(ctx, "bob/evil", "ed-2"); err != nil || pinned != "" {
+		t.Fatalf("ClaimIdentity for a second device returned %q, %v", pinned, err)
+	}
+	if pinned, err := store.ClaimIdentity(ctx, "carol/laptop", "ed-3"); err != nil || pinned != "ed-3" {
+		t.Fatalf("ClaimIdentity for a first device returned %q, %v", pinned, err)
+	}
+	if pinned, err := store.ClaimIdentity(ctx, "carol", "ed-4"); err != nil || pinned != "" {
+		t.Fatalf("ClaimIdentity for a second default device returned %q, %v", pinned, err)
+	}
+
+	otks := []x3dh.OneTimePreKey{{ID: 1, Key: testKey(10)}, {ID: 2, Key: testKey(11)}}
+	if err := store.AddOneTimePreKeys(ctx, "bob", otks); err != nil {
+		t.Fatalf("AddOneTimePreKeys failed: %v", err)
+	}
+	if n, _ := store.CountOneTimePreKeys(ctx, "bob"); n != 2 {
+		t.Fatalf("expected 2 OTKs, got %d", n)
+	}
+	if _, err := store.PopOneTimePreKey(ctx, "bob"); err != nil {
+		t.Fatalf("PopOneTimePreKey failed: %v", err)
+	}
+	if err := store.ClearOneTimePreKeys(ctx, "bob"); err != nil {
+		t.Fatalf("ClearOneTimePreKeys failed: %v", err)
+	}
+	if _, err := store.PopOneTimePreKey(ctx, "bob"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound for empty pool, got %v", err)
+	}
+
+	subCtx, unsubscribe := context.WithCancel(ctx)
+	wake, err := store.Subscribe(subCtx, "bob")
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	for _, text := range []string{"one", "two"} {
+		if err := store.PushMessage(ctx, "bob", x3dh.InitialMessage{Ciphertext: text}, 0); err != nil {
+			t.Fatalf("PushMessage failed: %v", err)
+		}
+	}
+	select {
+	case <-wake:
+	case <-time.After(time.Second):
+		t.Fatal("subscriber was not woken by PushMessage")
+	}
+	unsubscribe()
+	for range wake {
+		// Drain until the channel is closed.
+	}
+	if list, _ := store.ListMessages(ctx, "bob"); len(list) != 2 {
+		t.Fatalf("expected 2 queued messages, got %d", len(list))
+	}
+	msg, left, err := store.LeaseMessage(ctx, "bob", time.Minute)
+	if err != nil || msg.Ciphertext != "one" || msg.ID == "" || left != 1 {
+		t.Fatalf("LeaseMessage returned %+v, %d, %v", msg, left, err)
+	}
+	if list, _ := store.ListMessages(ctx, "bob"); len(list) != 2 || list[0].ID != msg.ID {
+		t.Fatalf("in-flight message should be listed first, got %+v", list)
+	}
+	if err := store.AckMessage(ctx, "bob", "unknown"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound for unknown id, got %v", err)
+	}
+	if err := store.AckMessage(ctx, "bob", msg.ID); err != nil {
+		t.Fatalf("AckMessage failed: %v", err)
+	}
+	if err := store.AckMessage(ctx, "bob", msg.ID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("second ack should fail, got %v", err)
+	}
+
+	// An unacknowledged message is delivered again once its lease expires.
+	msg, _, err = store.LeaseMessage(ctx, "bob", 50*time.Millisecond)
+	if err != nil || msg.Ciphertext != "two" {
+		t.Fatalf("LeaseMessage returned %+v, %v", msg, err)
+	}
+	if _, _, err := store.LeaseMessage(ctx, "bob", time.Minute); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("leased message must not be handed out twice, got %v", err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	again, left, err := store.LeaseMessage(ctx, "bob", time.Minute)
+	if err != nil || again.ID != msg.ID || left != 0 {
+		t.Fatalf("expired lease should be redelivered, got %+v, %d, %v", again, left, err)
+	}
+
+	if n, _ := store.CountBundles(ctx); n != 1 {
+		t.Fatalf("expected 1 bundle, got %d", n)
+	}
+	if sizes, err := store.MailboxSizes(ctx); err != nil || len(sizes) != 1 || sizes["bob"] != 1 {
+		t.Fatalf("MailboxSizes returned %v, %v", sizes, err)
+	}
+	store.AddOneTimePreKeys(ctx, "carol", otks)
+	if sizes, err := store.OTKPoolSizes(ctx); err != nil || len(sizes) != 2 || sizes["bob"] != 0 || sizes["carol"] != 2 {
+		t.Fatalf("OTKPoolSizes returned %v, %v", sizes, err)
+	}
+	store.ClearOneTimePreKeys(ctx, "carol")
+
+	for _, delta := range []int64{2, 3} {
+		if err := store.IncrCounter(ctx, counterMessagesReceived, delta); err != nil {
+			t.Fatalf("IncrCounter failed: %v", err)
+		}
+	}
+	if counters, err := store.Counters(ctx); err != nil || len(counters) != 1 || counters[counterMessagesReceived] != 5 {
+		t.Fatalf("Counters returned %v, %v", counters, err)
+	}
+	if err := store.PutBundle(ctx, deviceAddress("bob", "phone"), bundle); err != nil {
+		t.Fatalf("PutBundle for a device failed: %v", err)
+	}
+	if devices, err := store.ListDevices(ctx, "bob"); err != nil || len(devices) != 2 || devices[0] != defaultDevice || devices[1] != "phone" {
+		t.Fatalf("ListDevices returned %v, %v", devices, err)
+	}
+	if devices, err := store.ListDevices(ctx, "bo"); err != nil || len(devices) != 0 {
+		t.Fatalf("ListDevices for an unknown user returned %v, %v", devices, err)
+	}
+}
+
+// testRetention checks mailbox limits and expiry on an empty store.
+func testRetention(t *testing.T, store Store) {
+	ctx := context.Background()
+	now := time.Now()
+
+	// In-flight messages count towards the limit.
+	for _, text := range []string{"one", "two"} {
+		if err := store.PushMessage(ctx, "carol", x3dh.InitialMessage{Ciphertext: text}, 2); err != nil {
+			t.Fatalf("PushMessage failed: %v", err)
+		}
+	}
+	if _, _, err := store.LeaseMessage(ctx, "carol", time.Minute); err != nil {
+		t.Fatalf("LeaseMessage failed: %v", err)
+	}
+	if err := store.PushMessage(ctx, "carol", x3dh.InitialMessage{Ciphertext: "three"}, 2); !errors.Is(err, ErrMailboxFull) {
+		t.Fatalf("expected ErrMailboxFull, got %v", err)
+	}
+
+	soon := now.Add(10 * time.Second).Unix()
+	for _, msg := range []x3dh.InitialMessage{
+		{Ciphertext: "a", ExpiresAt: soon},
+		{Ciphertext: "b"},
+		{Ciphertext: "c", ExpiresAt: soon},
+	} {
+		if err := store.PushMessage(ctx, "dave", msg, 0); err != nil {
+			t.Fatalf("PushMessage failed: %v", err)
+		}
+	}
+	if msg, _, err := store.LeaseMessage(ctx, "dave", time.Minute); err != nil || msg.Ciphertext != "a" {
+		t.Fatalf("LeaseMessage returned %+v, %v", msg, err)
+	}
+	if n, err := store.ExpireMessages(ctx, now); err != nil || n != 0 {
+		t.Fatalf("nothing should have expired yet, got %d, %v", n, err)
+	}
+	if n, err := store.ExpireMessages(ctx, now.Add(time.Minute)); err != nil || n != 2 {
+		t.Fatalf("expected 2 expired messages, got %d, %v", n, err)
+	}
+	if list, _ := store.ListMessages(ctx, "dave"); len(list) != 1 || list[0].Ciphertext != "b" {
+		t.Fatalf("only the message without expiry should be left, got %+v", list)
+	}
+
+	// Leasing skips messages that expired before the sweeper ran.
+	if err := store.PushMessage(ctx, "erin", x3dh.InitialMessage{Ciphertext: "old", ExpiresAt: now.Add(-time.Second).Unix()}, 0); err != nil {
+		t.Fatalf("PushMessage failed: %v", err)
+	}
+	if _, _, err := store.LeaseMessage(ctx, "erin", time.Minute); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expired message must not be delivered, got %v", err)
+	}
+	if counters, err := store.Counters(ctx); err != nil || counters[counterMessagesExpired] != 1 {
+		t.Fatalf("the dropped message should be counted, got %v, %v", counters, err)
+	}
+
+	for _, user := range []string{"frank", "grace"} {
+		if err := store.PutBundle(ctx, user, x3dh.Bundle{IK: testKey(1), SPK: testKey(2), SPKID: 1}); err != nil {
+			t.Fatalf("PutBundle failed: %v", err)
+		}
+	}
+	store.AddOneTimePreKeys(ctx, "frank", []x3dh.OneTimePreKey{{ID: 1, Key: testKey(10)}})
+	if users, err := store.ExpireBundles(ctx, now.Add(-time.Hour)); err != nil || len(users) != 0 {
+		t.Fatalf("fresh bundle should be kept, got %v, %v", users, err)
+	}
+	// Activity keeps a bundle that was registered long ago; touching a user
+	// without a bundle does not create one.
+	for _, user := range []string{"grace", "heidi"} {
+		if err := store.TouchBundle(ctx, user, time.Now().Add(time.Hour)); err != nil {
+			t.Fatalf("TouchBundle failed: %v", err)
+		}
+	}
+	users, err := store.ExpireBundles(ctx, time.Now().Add(time.Second))
+	if err != nil || len(users) != 1 || users[0] != "frank" {
+		t.Fatalf("ExpireBundles returned %v, %v", users, err)
+	}
+	if _, err := store.GetBundle(ctx, "frank"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expired bundle should be gone, got %v", err)
+	}
+	if n, _ := store.CountOneTimePreKeys(ctx, "frank"); n != 0 {
+		t.Fatalf("expired bundle's OTKs should be gone, got %d", n)
+	}
+	if _, err := store.GetBundle(ctx, "grace"); err != nil {
+		t.Fatalf("touched bundle should be kept, got %v", err)
+	}
+	if _, err := store.GetBundle(ctx, "heidi"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("touching must not create a bundle, got %v", err)
+	}
+	users, err = store.ExpireBundles(ctx, time.Now().Add(2*time.Hour))
+	if err != nil || len(users) != 1 || users[0] != "grace" {
+		t.Fatalf("ExpireBundles after the touch returned %v, %v", users, err)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore())
+	testRetention(t, NewMemoryStore())
+}
+
+func TestFileStore(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatalf("NewFileStore failed: %v", err)
+	}
+	testStore(t, store)
+
+	// Everything must survive a restart.
+	reopened, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatalf("reopening file store failed: %v", err)
+	}
+	ctx := context.Background()
+	if _, err := reopened.GetBundle(ctx, "bob"); err != nil {
+		t.Fatalf("bundle lost across restart: %v", err)
+	}
+	if pinned, _ := reopened.PinIdentity(ctx, "bob", "ed-3"); pinned != "ed-1" {
+		t.Fatalf("pinned identity lost across restart, got %q", pinned)
+	}
+	list, err := reopened.ListMessages(ctx, "bob")
+	if err != nil || len(list) != 1 || list[0].Ciphertext != "two" {
+		t.Fatalf("in-flight message lost across restart: %+v, %v", list, err)
+	}
+	if err := reopened.AckMessage(ctx, "bob", list[0].ID); err != nil {
+		t.Fatalf("lease lost across restart: %v", err)
+	}
+	if counters, _ := reopened.Counters(ctx); counters[counterMessagesReceived] != 5 {
+		t.Fatalf("counters lost across restart: %v", counters)
+	}
+
+	retained, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewFileStore failed: %v", err)
+	}
+	testRetention(t, retained)
+}
+
+func TestFileStore_ServerDataLayout(t *testing.T) {
+	// A copy of the shipped server_data, whose bundle holds an OTK inline
+	// and without an id, as bundles were stored before OTK pools.
+	dir := t.TempDir()
+	for _, name := range []string{bundlesFile, messagesFile} {
+		data, err := os.ReadFile(filepath.Join("../../server_data", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx := context.Background()
+	store, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatalf("failed to read the shipped server_data: %v", err)
+	}
+	bundle, err := store.GetBundle(ctx, "bob")
+	if err != nil {
+		t.Fatalf("expected bob's bundle from server_data: %v", err)
+	}
+	if bundle.IK == "" || bundle.OTK != "" {
+		t.Fatalf("unexpected bundle %+v", bundle)
+	}
+
+	// The inline OTK is pooled once, under the id bob's keys migrate it to,
+	// and stays pooled when the store is opened again.
+	reopened, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatalf("reopening file store failed: %v", err)
+	}
+	if count, _ := reopened.CountOneTimePreKeys(ctx, "bob"); count != 1 {
+		t.Fatalf("expected the inline OTK in the pool, got %d", count)
+	}
+	otk, err := reopened.PopOneTimePreKey(ctx, "bob")
+	if err != nil || otk.ID != legacyOTKID || otk.Key != "8fbe77130006a79056aa61e7798fa1aa4cdf9e4f90e7106f4df0c6a341b1ee59" {
+		t.Fatalf("unexpected pooled OTK %+v, %v", otk, err)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// wsWriteWait is how long a client may take to accept one frame. A
+	// client that falls behind is disconnected; its messages stay queued.
+	wsWriteWait = 10 * time.Second
+	// wsPingPeriod is how often idle connections are pinged.
+	wsPingPeriod = 30 * time.Second
+	// wsPongWait is how long to wait for any frame before giving up on the client.
+	wsPongWait = 2 * wsPingPeriod
+	// wsReadLimit caps the size of a frame from the client.
+	wsReadLimit = 1 << 20
+)
+
+// wsUpgrader completes the opening handshake. Its default origin check
+// rejects browser pages from other hosts; the programs send no Origin.
+var wsUpgrader = websocket.Upgrader{HandshakeTimeout: wsWriteWait}
+
+// wsControl writes a control frame with a deadline of its own. Unlike data
+// frames, control frames may be written while another goroutine writes.
+func wsControl(conn *websocket.Conn, messageType int, data []byte) error {
+	return conn.WriteControl(messageType, data, time.Now().Add(wsWriteWait))
+}
+
+// wsHandler streams a user's queued and newly arriving messages over a
+// WebSocket at /ws/{user}. Each frame has the same shape as a GET
+// /messages/{user} response, and the client acknowledges it by sending
+// {"ack": "<id>"} (or with DELETE /messages/{user}/{id}). Messages are
+// leased one at a time and only after the previous frame was written, so a
+// slow reader is throttled by TCP flow control instead of piling up
+// messages in server memory.
+func wsHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := parseAddress(r.URL.Path, "/ws/")
+	if !ok {
+		http.Error(w, "Invalid user or device", http.StatusBadRequest)
+		return
+	}
+	if _, ok := requireAuth(w, r, user); !ok {
+		return
+	}
+	release, err := serverState.waiters.acquire(user)
+	if err != nil {
+		writeError(w, http.StatusTooManyRequests, codeTooManyWaiters, "", "Too many concurrent waits for user: "+user)
+		return
+	}
+	defer release()
+	// On failure Upgrade has already replied with an HTTP error.
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	// Subscribe before the first drain so no push in between is missed.
+	wake, err := serverState.store.Subscribe(ctx, user)
+	if err != nil {
+		warnLog.Printf("Failed to subscribe to %s: %v", user, err)
+		wsControl(conn, websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "subscribe failed"))
+		return
+	}
+
+	// The client sends acknowledgements; reading also answers pings and the
+	// closing handshake, and notices a dead peer.
+	conn.SetReadLimit(wsReadLimit)
+	conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error { return conn.SetReadDeadline(time.Now().Add(wsPongWait)) })
+	go func() {
+		defer cancel()
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			conn.SetReadDeadline(time.Now().Add(wsPongWait))
+			var ack struct {
+				Ack string `json:"ack"`
+			}
+			if json.Unmarshal(data, &ack) != nil || ack.Ack == "" {
+				continue
+			}
+			if err := serverState.AckMessage(ctx, user, ack.Ack); err != nil && !errors.Is(err, ErrNotFound) {
+				warnLog.Printf("Failed to acknowledge message for %s: %v", user, err)
+			}
+		}
+	}()
+
+	ping := time.NewTicker(wsPingPeriod)
+	defer ping.Stop()
+	for {
+		if err := drainMailbox(ctx, conn, user); err != nil {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			wsControl(conn, websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+			return
+		case <-wake:
+		case <-ping.C:
+			if err := wsControl(conn, websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// drainMailbox writes every queued message to conn. A message whose frame
+// cannot be written stays in flight and is delivered again once its lease
+// expires.
+func drainMailbox(ctx context.Context, conn *websocket.Conn, user string) error {
+	for ctx.Err() == nil {
+		msg, left, err := serverState.LeaseMessage(ctx, user)
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		} else if err != nil {
+			warnLog.Printf("Failed to fetch message for %s: %v", user, err)
+			return err
+		}
+		data, _ := json.Marshal(deliveryFrame(msg, left))
+		conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+		if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"x3dh-demo/internal/x3dh"
+)
+
+func TestWebSocketDelivery(t *testing.T) {
+	ts := newTestServer(t)
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws/bob"
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, resp, err := websocket.DefaultDialer.DialContext(ctx, wsURL, nil); err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("dial without token should fail with 401, got %v", err)
+	}
+
+	// One message is queued before connecting, one arrives while connected.
+	postJSON(t, ts.URL+"/send/bob", x3dh.InitialMessage{Sender: "alice", Ciphertext: "queued"}).Body.Close()
+	token := login(t, ts.URL, "bob", testEdKey(1))
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, wsURL, http.Header{"Authorization": {"Bearer " + token}})
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	// read returns the next message's text and acknowledges it.
+	read := func() string {
+		t.Helper()
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("read failed: %v", err)
+		}
+		var got struct {
+			Message x3dh.InitialMessage `json:"message"`
+		}
+		if err := json.Unmarshal(data, &got); err != nil {
+			t.Fatalf("bad frame %s: %v", data, err)
+		}
+		ack, _ := json.Marshal(map[string]string{"ack": got.Message.ID})
+		if err := conn.WriteMessage(websocket.TextMessage, ack); err != nil {
+			t.Fatalf("ack failed: %v", err)
+		}
+		return got.Message.Ciphertext
+	}
+	if got := read(); got != "queued" {
+		t.Fatalf("expected the queued message first, got %q", got)
+	}
+	postJSON(t, ts.URL+"/send/bob", x3dh.InitialMessage{Sender: "alice", Ciphertext: "live"}).Body.Close()
+	if got := read(); got != "live" {
+		t.Fatalf("expected the live message, got %q", got)
+	}
+
+	// Acknowledged messages are gone from the mailbox.
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		sizes, _ := serverState.store.MailboxSizes(ctx)
+		if sizes["bob"] == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d messages left after acknowledging everything", sizes["bob"])
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,362 @@
+// Command x3dh is a relay client for any user. Each user (and each of their
+// devices) keeps its keys and contacts in its own directory under -key-dir.
+//
+//	x3dh -user carol init
+//	x3dh -user carol register
+//	x3dh -user dave send carol "hello"
+//	x3dh -user carol recv
+//	x3dh -user dave contacts
+//	x3dh -user carol passphrase
+//	x3dh status
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"x3dh-demo/internal/client"
+	"x3dh-demo/internal/config"
+	"x3dh-demo/internal/keystore"
+	"x3dh-demo/internal/user"
+	"x3dh-demo/internal/x3dh"
+)
+
+const usage = `Usage: x3dh [flags] <command> [arguments]
+
+Commands:
+  init                     generate keys for the user's device
+  register [-otks n]       upload the bundle and one-time prekeys
+  approve <device> <key>   let a new device of the user log in with its
+                           Ed25519 key (printed by init on that device)
+  send <user> [message]    send a message (read from stdin if not given)
+  recv                     receive and decrypt all waiting messages
+  contacts [forget <user>] list contacts and their pinned identity keys
+  history                  list the messages waiting in the mailbox
+  status                   show the relay's health and statistics
+  replenish [-otks n] [-min-otks n]
+                           top up the one-time prekey pool when it runs low
+  rotate-spk [-spk-grace d]
+                           replace the signed prekey
+  passphrase               encrypt the keys with a new passphrase, or
+                           decrypt them with an empty one
+
+Flags:
+`
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	cfg, err := config.Load(flag.CommandLine, os.Args[1:], "", (*config.Config).RegisterUserFlags)
+	if err != nil {
+		log.Fatal(err)
+	}
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	cmd, args := args[0], args[1:]
+	if cfg.User == "" && cmd != "status" {
+		log.Fatal("No user given: set -user or X3DH_USER")
+	}
+
+	u := user.New(cfg.ServerURL, cfg.KeyDir, cfg.User, cfg.Device)
+	if cfg.KeyFile != "" {
+		u.KeyFile = cfg.KeyFile
+	}
+	u.Client.Timeout, u.Client.Retries = cfg.Timeout, cfg.Retries
+	u.Passphrase = keystore.Source(cfg.Passphrase, u.KeyFile)
+
+	switch cmd {
+	case "init":
+		err = initKeys(u)
+	case "register":
+		err = register(u, args)
+	case "approve":
+		err = approve(u, args)
+	case "send":
+		err = send(u, args)
+	case "recv":
+		err = recv(u)
+	case "contacts":
+		err = contacts(u, args)
+	case "history":
+		err = history(u)
+	case "status":
+		err = status(u.Relay())
+	case "replenish":
+		err = replenish(u, args)
+	case "rotate-spk":
+		err = rotateSPK(u, args)
+	case "passphrase":
+		err = changePassphrase(u)
+	default:
+		log.Printf("Unknown command %q", cmd)
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatalf("%s: %v", cmd, err)
+	}
+}
+
+func initKeys(u *user.User) error {
+	if err := u.Init(); err != nil {
+		return err
+	}
+	id, err := u.Identity()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Keys for %s saved to %s\n", u.Address(), u.KeyFile)
+	fmt.Printf("Identity fingerprint: %s\n", x3dh.GetKeyFingerprint(x3dh.PublicKey(id.Key)))
+	key, err := u.SigningKey()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Ed25519 key: %s\n", key)
+	if u.Device != "" {
+		fmt.Printf("Unless it is the first device of %s, approve it from one that is registered with:\n", u.Name)
+		fmt.Printf("  x3dh -user %s approve %s %s\n", u.Name, u.Device, key)
+	}
+	return nil
+}
+
+// ensureKeys creates keys for a user that has none yet, so register and
+// send work without a separate init.
+func ensureKeys(u *user.User) error {
+	if _, err := u.Identity(); errors.Is(err, user.ErrNoKeys) {
+		return initKeys(u)
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+func register(u *user.User, args []string) error {
+	fs := flag.NewFlagSet("register", flag.ExitOnError)
+	numOTKs := fs.Int("otks", 20, "Number of one-time prekeys to upload (0 forces the 3-DH handshake)")
+	fs.Parse(args)
+
+	if err := ensureKeys(u); err != nil {
+		return err
+	}
+	count, err := u.Register(*numOTKs)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Registered %s with %d one-time prekeys available.\n", u.Address(), count)
+	return nil
+}
+
+func approve(u *user.User, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: approve <device> <ed25519-key>")
+	}
+	if err := u.ApproveDevice(args[0], args[1]); err != nil {
+		return err
+	}
+	fmt.Printf("Approved device %s of %s.\n", args[0], u.Name)
+	return nil
+}
+
+func send(u *user.User, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("no recipient given")
+	}
+	to := args[0]
+	text := strings.Join(args[1:], " ")
+	if text == "" {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return fmt.Errorf("failed to read message: %v", err)
+		}
+		text = strings.TrimSpace(line)
+	}
+	if err := ensureKeys(u); err != nil {
+		return err
+	}
+	// Devices that were reached are listed even if others failed.
+	sent, err := u.Send(to, []byte(text))
+	for _, s := range sent {
+		kind := "session"
+		if s.Session != nil {
+			kind = "new session"
+		}
+		fmt.Printf("Sent to %s device %s (identity %s, %s)\n", to, s.Device, x3dh.GetKeyFingerprint(s.PeerIdentity), kind)
+	}
+	if errors.Is(err, user.ErrIdentityChanged) {
+		return fmt.Errorf("%v; if %s really has new keys, run: x3dh -user %s contacts forget %s", err, to, u.Name, to)
+	}
+	return err
+}
+
+func recv(u *user.User) error {
+	for {
+		received, err := u.Receive()
+		if err != nil {
+			return err
+		}
+		if received == nil {
+			fmt.Println("No new messages.")
+			return nil
+		}
+		msg := received.Message
+		fmt.Printf("%s: %s\n", msg.Sender, received.Plaintext)
+		fmt.Printf("  (identity %s", x3dh.GetKeyFingerprint(received.PeerIdentity))
+		if received.Session != nil {
+			fmt.Print(", new session")
+			if msg.OTKID == 0 {
+				fmt.Print(", no one-time prekey")
+			}
+		}
+		fmt.Println(")")
+		if received.Left == 0 {
+			return nil
+		}
+	}
+}
+
+func contacts(u *user.User, args []string) error {
+	if len(args) == 2 && args[0] == "forget" {
+		found, err := u.ForgetContact(args[1])
+		if err != nil {
+			return err
+		}
+		if !found {
+			return fmt.Errorf("no contact named %s", args[1])
+		}
+		fmt.Printf("Forgot %s.\n", args[1])
+		return nil
+	}
+	if len(args) > 0 {
+		return fmt.Errorf("usage: contacts [forget <user>]")
+	}
+
+	list, err := u.Contacts()
+	if err != nil {
+		return err
+	}
+	if len(list) == 0 {
+		fmt.Println("No contacts yet.")
+		return nil
+	}
+	for _, name := range list.Names() {
+		contact := list[name]
+		fmt.Printf("%s (last seen %s)\n", name, contact.LastSeen.Local().Format(time.DateTime))
+		devices := make([]string, 0, len(contact.Devices))
+		for device := range contact.Devices {
+			devices = append(devices, device)
+		}
+		sort.Strings(devices)
+		for _, device := range devices {
+			ik := contact.Devices[device]
+			fingerprint := ik
+			if pub, err := x3dh.DecodePublicKey(ik); err == nil {
+				fingerprint = x3dh.GetKeyFingerprint(pub)
+			}
+			fmt.Printf("  %-12s %s\n", device, fingerprint)
+		}
+	}
+	return nil
+}
+
+func history(u *user.User) error {
+	messages, err := u.Relay().History(context.Background())
+	if err != nil {
+		return err
+	}
+	if len(messages) == 0 {
+		fmt.Println("No messages waiting.")
+		return nil
+	}
+	for _, msg := range messages {
+		kind := "session message"
+		if msg.AliceIK != "" {
+			kind = "handshake"
+		}
+		from := msg.Sender
+		if msg.SenderDevice != "" {
+			from += "/" + msg.SenderDevice
+		}
+		fmt.Printf("%s  %-20s %s, expires %s\n", msg.ID, from, kind, time.Unix(msg.ExpiresAt, 0).Local().Format(time.DateTime))
+	}
+	return nil
+}
+
+func status(relay *client.Client) error {
+	ctx := context.Background()
+	health, err := relay.Health(ctx)
+	if err != nil {
+		return err
+	}
+	stats, err := relay.Stats(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Relay %s is %s (up %s)\n", relay.BaseURL, health.Status, health.Uptime)
+	fmt.Printf("  %d bundles, %d pending messages\n", stats.ActiveBundles, stats.PendingMessages)
+	fmt.Printf("  %d messages received, %d delivered, %d expired\n", stats.TotalMessagesReceived, stats.TotalMessagesDelivered, stats.TotalMessagesExpired)
+	return nil
+}
+
+func replenish(u *user.User, args []string) error {
+	fs := flag.NewFlagSet("replenish", flag.ExitOnError)
+	batch := fs.Int("otks", 20, "Number of one-time prekeys to upload")
+	threshold := fs.Int("min-otks", 10, "Replenish when fewer than this many one-time prekeys are left on the server")
+	fs.Parse(args)
+
+	uploaded, count, err := u.Replenish(*batch, *threshold)
+	if err != nil {
+		return err
+	}
+	if uploaded == 0 {
+		fmt.Printf("%d one-time prekeys left on server, no need to replenish.\n", count)
+		return nil
+	}
+	fmt.Printf("Uploaded %d one-time prekeys (%d available on server).\n", uploaded, count)
+	return nil
+}
+
+func rotateSPK(u *user.User, args []string) error {
+	fs := flag.NewFlagSet("rotate-spk", flag.ExitOnError)
+	grace := fs.Duration("spk-grace", 7*24*time.Hour, "How long a rotated-out signed prekey is kept to decrypt in-flight messages")
+	fs.Parse(args)
+
+	oldID, newID, err := u.RotateSPK(*grace)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Rotated signed prekey %d -> %d; old key kept until %s.\n", oldID, newID, time.Now().Add(*grace).Format(time.RFC3339))
+	return nil
+}
+
+func changePassphrase(u *user.User) error {
+	// Unlock with the old passphrase before asking for the new one.
+	if _, err := u.Identity(); err != nil {
+		return err
+	}
+	pass, err := keystore.NewPassphrase(u.KeyFile)
+	if err != nil {
+		return err
+	}
+	if err := u.ChangePassphrase(pass); err != nil {
+		return err
+	}
+	if len(pass) == 0 {
+		fmt.Printf("Keys in %s are stored unencrypted.\n", u.KeyFile)
+		return nil
+	}
+	fmt.Printf("Keys in %s are encrypted with the new passphrase.\n", u.KeyFile)
+	return nil
+}
@@ -2,19 +2,24 @@ module x3dh-demo
 
 go 1.24
 
+require (
+	github.com/alicebob/miniredis/v2 v2.37.0
+	github.com/gdamore/tcell/v2 v2.8.1
+	github.com/gorilla/websocket v1.5.3
+	github.com/redis/go-redis/v9 v9.10.0
+	github.com/rivo/tview v0.0.0-20250501113434-0c592cd31026
+	golang.org/x/crypto v0.39.0
+	golang.org/x/term v0.32.0
+)
+
 require (
 	github.com/cespare/xxhash/v2 v2.3.0 // indirect
 	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
 	github.com/gdamore/encoding v1.0.1 // indirect
-	github.com/gdamore/tcell/v2 v2.8.1 // indirect
 	github.com/lucasb-eyer/go-colorful v1.2.0 // indirect
 	github.com/mattn/go-runewidth v0.0.16 // indirect
-	github.com/noah1510/signalprotocol v0.0.0-20190719205434-1dd84dbc7180 // indirect
-	github.com/redis/go-redis/v9 v9.10.0 // indirect
-	github.com/rivo/tview v0.0.0-20250501113434-0c592cd31026 // indirect
 	github.com/rivo/uniseg v0.4.7 // indirect
-	golang.org/x/crypto v0.39.0 // indirect
+	github.com/yuin/gopher-lua v1.1.1 // indirect
 	golang.org/x/sys v0.33.0 // indirect
-	golang.org/x/term v0.32.0 // indirect
 	golang.org/x/text v0.26.0 // indirect
 )
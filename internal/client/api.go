@@ -0,0 +1,200 @@
+// internal/client/api.go
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"x3dh-demo/internal/x3dh"
+)
+
+// Delivery is a message leased from a mailbox, as returned by Fetch and
+// pushed over the WebSocket. It must be acknowledged within LeaseSeconds.
+type Delivery struct {
+	Message      x3dh.InitialMessage `json:"message"`
+	MessagesLeft int64               `json:"messages_left"`
+	LeaseSeconds int                 `json:"lease_seconds"`
+}
+
+// Stats is the relay's statistics snapshot from GET /stats.
+type Stats struct {
+	TotalBundlesRegistered int64                `json:"total_bundles_registered"`
+	TotalMessagesReceived  int64                `json:"total_messages_received"`
+	TotalMessagesDelivered int64                `json:"total_messages_delivered"`
+	TotalMessagesExpired   int64                `json:"total_messages_expired"`
+	TotalBundlesExpired    int64                `json:"total_bundles_expired"`
+	ActiveBundles          int                  `json:"active_bundles"`
+	PendingMessages        int                  `json:"pending_messages"`
+	Users                  map[string]UserStats `json:"users,omitempty"`
+	Uptime                 time.Duration        `json:"uptime"`
+	StartTime              time.Time            `json:"start_time"`
+}
+
+// UserStats is the per-user part of Stats.
+type UserStats struct {
+	PendingMessages int64 `json:"pending_messages"`
+	OneTimePreKeys  int64 `json:"one_time_prekeys"`
+}
+
+// Health is the relay's answer to GET /health.
+type Health struct {
+	Status    string    `json:"status"`
+	Timestamp time.Time `json:"timestamp"`
+	Uptime    string    `json:"uptime"`
+}
+
+type count struct {
+	Count int64 `json:"count"`
+}
+
+// Register uploads the bundle of the client's device, replacing its old one.
+func (c *Client) Register(ctx context.Context, bundle x3dh.Bundle) error {
+	return c.do(ctx, &request{method: http.MethodPost, path: []string{"register", c.Address()}, body: bundle, auth: true, idempotent: true}, nil)
+}
+
+// UploadOTKs publishes one-time prekeys for the client's device and returns
+// the size of its pool.
+func (c *Client) UploadOTKs(ctx context.Context, otks []x3dh.OneTimePreKey) (int64, error) {
+	var n count
+	err := c.do(ctx, &request{method: http.MethodPost, path: []string{"otks", c.Address()}, body: otks, auth: true}, &n)
+	return n.Count, err
+}
+
+// CountOTKs returns how many one-time prekeys the device at addr has left.
+func (c *Client) CountOTKs(ctx context.Context, addr string) (int64, error) {
+	var n count
+	err := c.do(ctx, &request{method: http.MethodGet, path: []string{"otks", addr}, idempotent: true}, &n)
+	return n.Count, err
+}
+
+// Devices lists the names of user's devices. It returns ErrNotFound if the
+// user has none.
+func (c *Client) Devices(ctx context.Context, user string) ([]string, error) {
+	var list struct {
+		Devices []string `json:"devices"`
+	}
+	err := c.do(ctx, &request{method: http.MethodGet, path: []string{"devices", user}, idempotent: true}, &list)
+	return list.Devices, err
+}
+
+// ApproveDevice lets the device named device of the client's user log in
+// with the hex Ed25519 key edKey. The relay only pins the key of a user's
+// first device on its first login; later devices must be approved by one
+// that is already pinned.
+func (c *Client) ApproveDevice(ctx context.Context, device, edKey string) error {
+	owner, _, _ := strings.Cut(c.Address(), "/")
+	req := &request{method: http.MethodPost, path: []string{"devices", owner, device}, body: x3dh.DeviceApproval{Ed25519: edKey}, auth: true, idempotent: true}
+	return c.do(ctx, req, nil)
+}
+
+// FetchBundle returns the bundle of one of user's devices, carrying a
+// one-time prekey if any were left. A retried fetch may use up an extra one.
+func (c *Client) FetchBundle(ctx context.Context, user, device string) (*x3dh.Bundle, error) {
+	var bundle x3dh.Bundle
+	err := c.do(ctx, &request{method: http.MethodGet, path: []string{"bundle", user, device}, idempotent: true}, &bundle)
+	if err != nil {
+		return nil, err
+	}
+	return &bundle, nil
+}
+
+// FetchBundles returns one bundle for each of user's devices.
+func (c *Client) FetchBundles(ctx context.Context, user string) ([]x3dh.Bundle, error) {
+	var bundles []x3dh.Bundle
+	err := c.do(ctx, &request{method: http.MethodGet, path: []string{"bundle", user}, idempotent: true}, &bundles)
+	return bundles, err
+}
+
+// Send queues msg in the mailbox at addr. A positive ttl, of at least a
+// second, shortens how long it waits for delivery. A message whose sender
+// owns the mailbox is sent logged in. Send is only retried when the relay
+// turned it away, so a message is never queued twice.
+func (c *Client) Send(ctx context.Context, addr string, msg *x3dh.InitialMessage, ttl time.Duration) error {
+	req := &request{method: http.MethodPost, path: []string{"send", addr}, body: msg}
+	if owner, _, _ := strings.Cut(addr, "/"); msg.Sender == owner {
+		req.auth = true
+	}
+	if ttl > 0 {
+		req.query = url.Values{"ttl": {strconv.Itoa(int(ttl / time.Second))}}
+	}
+	return c.do(ctx, req, nil)
+}
+
+// Fetch leases the oldest message in the client's mailbox. With a positive
+// wait it long-polls for that long. It returns nil if there is no message.
+func (c *Client) Fetch(ctx context.Context, wait time.Duration) (*Delivery, error) {
+	req := &request{method: http.MethodGet, path: []string{"messages", c.Address()}, auth: true, idempotent: true, wait: wait}
+	if wait > 0 {
+		req.query = url.Values{"wait": {strconv.Itoa(int(wait / time.Second))}}
+	}
+	var delivery Delivery
+	err := c.do(ctx, req, &delivery)
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &delivery, nil
+}
+
+// Ack confirms that the fetched message id was processed so the relay
+// deletes it. It returns ErrNotFound if the lease had already expired.
+func (c *Client) Ack(ctx context.Context, id string) error {
+	return c.do(ctx, &request{method: http.MethodDelete, path: []string{"messages", c.Address(), id}, status: http.StatusNoContent, auth: true, idempotent: true}, nil)
+}
+
+// History lists the messages queued in the client's mailbox without
+// leasing them.
+func (c *Client) History(ctx context.Context) ([]x3dh.InitialMessage, error) {
+	var messages []x3dh.InitialMessage
+	err := c.do(ctx, &request{method: http.MethodGet, path: []string{"history", c.Address()}, auth: true, idempotent: true}, &messages)
+	return messages, err
+}
+
+// Stats returns the relay's statistics.
+func (c *Client) Stats(ctx context.Context) (*Stats, error) {
+	var stats Stats
+	if err := c.do(ctx, &request{method: http.MethodGet, path: []string{"stats"}, idempotent: true}, &stats); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// Health reports whether the relay is up.
+func (c *Client) Health(ctx context.Context) (*Health, error) {
+	var health Health
+	if err := c.do(ctx, &request{method: http.MethodGet, path: []string{"health"}, idempotent: true}, &health); err != nil {
+		return nil, err
+	}
+	return &health, nil
+}
+
+// Dial opens the client's mailbox WebSocket, which pushes each message as
+// a Delivery frame and expects {"ack": id} in return. ctx and the timeout
+// only bound the opening handshake, which is not retried.
+func (c *Client) Dial(ctx context.Context) (*websocket.Conn, error) {
+	token, err := c.login(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+	wsURL := "ws" + strings.TrimPrefix(c.BaseURL, "http") + "/ws/" + escapePath(c.Address())
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, wsURL, http.Header{"Authorization": {"Bearer " + token}})
+	if err != nil {
+		// The token may be stale; log in again next time.
+		c.dropToken()
+		return nil, err
+	}
+	return conn, nil
+}
@@ -0,0 +1,292 @@
+// internal/client/client.go
+//
+// Package client is a typed client for the relay's HTTP API, shared by the
+// alice, bob and x3dh programs (through package user) and the chat. Every
+// call takes a context, runs each attempt under a timeout and is retried
+// with exponential backoff when the relay is unreachable or overloaded.
+// Error responses come back as *Error, which matches this package's
+// sentinel errors with errors.Is. Owner-only endpoints log in on demand
+// through the challenge-response exchange once SetIdentity has been called.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"x3dh-demo/internal/x3dh"
+)
+
+// Defaults for the fields of a Client made by New.
+const (
+	DefaultTimeout = 10 * time.Second
+	DefaultRetries = 3
+	DefaultBackoff = 200 * time.Millisecond
+)
+
+// maxBackoff caps the delay between two attempts.
+const maxBackoff = 5 * time.Second
+
+// ErrNoIdentity is returned by owner-only calls on a client without an identity.
+var ErrNoIdentity = errors.New("no identity to log in with")
+
+// Client talks to one relay. Its fields may be changed until the first
+// call; after that it is safe for concurrent use.
+type Client struct {
+	BaseURL string // relay URL without a trailing slash
+	// Transport carries the requests; nil means http.DefaultTransport.
+	Transport http.RoundTripper
+	// Timeout bounds each attempt. Long-polls get their wait on top of it.
+	Timeout time.Duration
+	// Retries is how many times a failed attempt may be repeated.
+	Retries int
+	// Backoff is the delay before the first retry; it doubles each time.
+	Backoff time.Duration
+
+	mu      sync.Mutex // guards the identity, the token and pending
+	address string
+	key     ed25519.PrivateKey
+	token   string
+	expires time.Time
+	pending *loginCall // the login in progress, shared by concurrent calls
+}
+
+// loginCall is a login in progress. token and err are set before done is
+// closed.
+type loginCall struct {
+	done  chan struct{}
+	token string
+	err   error
+}
+
+// New returns a client for the relay at baseURL with the default timeout,
+// retries and backoff.
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL: strings.TrimSuffix(baseURL, "/"),
+		Timeout: DefaultTimeout,
+		Retries: DefaultRetries,
+		Backoff: DefaultBackoff,
+	}
+}
+
+// SetIdentity makes the client act as the device at address, which owns
+// the Ed25519 key, on the owner-only endpoints. Changing it drops the
+// current token.
+func (c *Client) SetIdentity(address string, key ed25519.PrivateKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if address != c.address || !key.Equal(c.key) {
+		c.token, c.pending = "", nil
+	}
+	c.address, c.key = address, key
+}
+
+// Address returns the mailbox address set with SetIdentity.
+func (c *Client) Address() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.address
+}
+
+// request describes one API call.
+type request struct {
+	method string
+	path   []string // joined after the base URL; may hold {user}/{device}
+	query  url.Values
+	body   interface{}
+	status int // expected status; 0 means 200
+	auth   bool
+	// idempotent calls may be repeated even when the relay might have
+	// processed the failed attempt.
+	idempotent bool
+	// wait extends the timeout of a long-poll.
+	wait time.Duration
+}
+
+func (r *request) url(base string) string {
+	u := base + "/" + escapePath(strings.Join(r.path, "/"))
+	if len(r.query) > 0 {
+		u += "?" + r.query.Encode()
+	}
+	return u
+}
+
+// escapePath escapes each segment of a slash-separated path.
+func escapePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return strings.Join(segments, "/")
+}
+
+// do performs req, retrying as allowed, and decodes a successful response
+// into out unless out is nil.
+func (c *Client) do(ctx context.Context, req *request, out interface{}) error {
+	var body []byte
+	if req.body != nil {
+		var err error
+		if body, err = json.Marshal(req.body); err != nil {
+			return err
+		}
+	}
+	relogged := false
+	for attempt := 0; ; attempt++ {
+		retry, err := c.attempt(ctx, req, body, out)
+		if err == nil {
+			return nil
+		}
+		var apiErr *Error
+		if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusUnauthorized && req.auth && !relogged {
+			// The token expired early, e.g. because the relay restarted.
+			c.dropToken()
+			relogged = true
+			attempt--
+			continue
+		}
+		if !retry || attempt >= c.Retries || ctx.Err() != nil {
+			return err
+		}
+		delay := c.Backoff << attempt
+		if delay > maxBackoff || delay < 0 {
+			delay = maxBackoff
+		}
+		if apiErr != nil && apiErr.RetryAfter > delay {
+			delay = apiErr.RetryAfter
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// attempt sends req once. It reports whether a failure may be retried.
+func (c *Client) attempt(ctx context.Context, req *request, body []byte, out interface{}) (bool, error) {
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout+req.wait)
+		defer cancel()
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, req.method, req.url(c.BaseURL), bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	if req.body != nil {
+		httpReq.Header.Set("Content-Type", "application/json")
+	}
+	if req.auth {
+		token, err := c.login(ctx)
+		if err != nil {
+			return false, fmt.Errorf("failed to authenticate with server: %w", err)
+		}
+		httpReq.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := (&http.Client{Transport: c.Transport}).Do(httpReq)
+	if err != nil {
+		// The request may or may not have reached the relay.
+		return req.idempotent, err
+	}
+	defer resp.Body.Close()
+	want := req.status
+	if want == 0 {
+		want = http.StatusOK
+	}
+	if resp.StatusCode != want {
+		apiErr := newError(resp)
+		return apiErr.retryable(req.idempotent), apiErr
+	}
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return false, fmt.Errorf("invalid response from server: %v", err)
+		}
+	}
+	return false, nil
+}
+
+// login proves ownership of the identity key through the challenge-response
+// exchange when the current token is missing or about to expire. The lock is
+// only held to read and store the token: concurrent calls share one
+// exchange, and calls that already have a token are not held up by it.
+func (c *Client) login(ctx context.Context) (string, error) {
+	for {
+		c.mu.Lock()
+		if c.key == nil {
+			c.mu.Unlock()
+			return "", ErrNoIdentity
+		}
+		if c.token != "" && time.Now().Before(c.expires) {
+			token := c.token
+			c.mu.Unlock()
+			return token, nil
+		}
+		if call := c.pending; call != nil {
+			c.mu.Unlock()
+			select {
+			case <-call.done:
+			case <-ctx.Done():
+				return "", ctx.Err()
+			}
+			// A login given up by the call that started it is tried again.
+			if call.err != nil && ctx.Err() == nil && (errors.Is(call.err, context.Canceled) || errors.Is(call.err, context.DeadlineExceeded)) {
+				continue
+			}
+			return call.token, call.err
+		}
+		call := &loginCall{done: make(chan struct{})}
+		c.pending = call
+		address, key := c.address, c.key
+		c.mu.Unlock()
+
+		var expires time.Time
+		call.token, expires, call.err = c.authenticate(ctx, address, key)
+		c.mu.Lock()
+		// The identity may have changed meanwhile; its token is not kept then.
+		if c.pending == call {
+			c.pending = nil
+			if call.err == nil {
+				c.token, c.expires = call.token, expires
+			}
+		}
+		c.mu.Unlock()
+		close(call.done)
+		return call.token, call.err
+	}
+}
+
+// authenticate runs the challenge-response exchange for the device at
+// address and returns the token and when to renew it.
+func (c *Client) authenticate(ctx context.Context, address string, key ed25519.PrivateKey) (string, time.Time, error) {
+	var challenge x3dh.AuthChallenge
+	err := c.do(ctx, &request{method: http.MethodPost, path: []string{"auth", "challenge", address}, idempotent: true}, &challenge)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	answer := x3dh.SignChallenge(key, address, challenge.Nonce)
+	var token x3dh.AuthToken
+	// A nonce is single-use, so the answer is never repeated.
+	err = c.do(ctx, &request{method: http.MethodPost, path: []string{"auth", "token", address}, body: answer}, &token)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return token.Token, time.Now().Add(time.Duration(token.ExpiresIn)*time.Second - 30*time.Second), nil
+}
+
+func (c *Client) dropToken() {
+	c.mu.Lock()
+	c.token = ""
+	c.mu.Unlock()
+}
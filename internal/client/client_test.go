@@ -0,0 +1,283 @@
+package client
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"x3dh-demo/internal/x3dh"
+)
+
+// stubRelay is a RoundTripper that answers each request with the next
+// response from its handler and records what was asked.
+type stubRelay struct {
+	mu       sync.Mutex
+	requests []*http.Request
+	handle   func(r *http.Request, n int) (int, string)
+	header   http.Header // sent with every response
+}
+
+func (s *stubRelay) RoundTrip(r *http.Request) (*http.Response, error) {
+	s.mu.Lock()
+	s.requests = append(s.requests, r)
+	n := len(s.requests)
+	s.mu.Unlock()
+	status, body := s.handle(r, n)
+	header := s.header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	if strings.HasPrefix(body, "{") || strings.HasPrefix(body, "[") {
+		header.Set("Content-Type", "application/json")
+	}
+	return &http.Response{
+		StatusCode: status,
+		Status:     http.StatusText(status),
+		Header:     header,
+		Body:       io.NopCloser(strings.NewReader(body)),
+		Request:    r,
+	}, nil
+}
+
+func (s *stubRelay) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.requests)
+}
+
+func newStubClient(handle func(r *http.Request, n int) (int, string)) (*Client, *stubRelay) {
+	stub := &stubRelay{handle: handle}
+	c := New("http://relay.test/")
+	c.Transport = stub
+	c.Backoff = time.Millisecond
+	return c, stub
+}
+
+func TestErrors(t *testing.T) {
+	cases := []struct {
+		status int
+		body   string
+		want   error
+	}{
+		{http.StatusNotFound, "Bundle not found for user: carol\n", ErrNotFound},
+		{http.StatusUnprocessableEntity, `{"code":"low_order_key","field":"spk","error":"Invalid SPK"}`, ErrRejected},
+		{http.StatusTooManyRequests, `{"code":"mailbox_full","error":"Mailbox is full"}`, ErrMailboxFull},
+		{http.StatusTooManyRequests, `{"code":"too_many_waiters","error":"Too many concurrent waits"}`, ErrTooManyRequests},
+		{http.StatusInternalServerError, "Failed to store message", ErrServer},
+	}
+	for _, tc := range cases {
+		c, _ := newStubClient(func(*http.Request, int) (int, string) { return tc.status, tc.body })
+		err := c.Send(context.Background(), "carol", &x3dh.InitialMessage{Sender: "dave"}, 0)
+		if !errors.Is(err, tc.want) {
+			t.Errorf("status %d: expected %v, got %v", tc.status, tc.want, err)
+		}
+		if tc.want != ErrServer && errors.Is(err, ErrServer) {
+			t.Errorf("status %d should not match ErrServer", tc.status)
+		}
+	}
+
+	c, _ := newStubClient(func(*http.Request, int) (int, string) {
+		return http.StatusUnprocessableEntity, `{"code":"low_order_key","field":"spk","error":"Invalid SPK"}`
+	})
+	var apiErr *Error
+	if err := c.Send(context.Background(), "carol", &x3dh.InitialMessage{}, 0); !errors.As(err, &apiErr) {
+		t.Fatalf("expected an *Error, got %v", err)
+	}
+	if apiErr.Code != "low_order_key" || apiErr.Field != "spk" || apiErr.Message != "Invalid SPK" {
+		t.Fatalf("structured error body was not decoded: %+v", apiErr)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	// Idempotent calls are retried until the relay answers.
+	c, stub := newStubClient(func(r *http.Request, n int) (int, string) {
+		if n < 3 {
+			return http.StatusServiceUnavailable, "busy"
+		}
+		return http.StatusOK, `{"status":"healthy","uptime":"1m0s"}`
+	})
+	health, err := c.Health(context.Background())
+	if err != nil || health.Status != "healthy" || stub.count() != 3 {
+		t.Fatalf("Health returned %+v, %v after %d attempts", health, err, stub.count())
+	}
+
+	// They give up after Retries.
+	c, stub = newStubClient(func(*http.Request, int) (int, string) { return http.StatusBadGateway, "down" })
+	c.Retries = 2
+	if _, err := c.Stats(context.Background()); !errors.Is(err, ErrServer) || stub.count() != 3 {
+		t.Fatalf("expected ErrServer after 3 attempts, got %v after %d", err, stub.count())
+	}
+
+	// A message is only sent again when the relay turned it away.
+	c, stub = newStubClient(func(*http.Request, int) (int, string) { return http.StatusBadGateway, "down" })
+	if err := c.Send(context.Background(), "carol", &x3dh.InitialMessage{}, 0); err == nil || stub.count() != 1 {
+		t.Fatalf("Send after 502 should not be retried, got %v after %d attempts", err, stub.count())
+	}
+	c, stub = newStubClient(func(r *http.Request, n int) (int, string) {
+		if n == 1 {
+			return http.StatusTooManyRequests, "slow down"
+		}
+		return http.StatusOK, ""
+	})
+	if err := c.Send(context.Background(), "carol", &x3dh.InitialMessage{}, time.Hour); err != nil || stub.count() != 2 {
+		t.Fatalf("Send after 429 should be retried, got %v after %d attempts", err, stub.count())
+	}
+	if q := stub.requests[1].URL.Query().Get("ttl"); q != "3600" {
+		t.Fatalf("unexpected ttl %q", q)
+	}
+
+	// A full mailbox is left to the caller, with the delay the relay asked for.
+	c, stub = newStubClient(func(*http.Request, int) (int, string) {
+		return http.StatusTooManyRequests, `{"code":"mailbox_full","error":"Mailbox is full"}`
+	})
+	stub.header = http.Header{"Retry-After": {"60"}}
+	var apiErr *Error
+	err = c.Send(context.Background(), "carol", &x3dh.InitialMessage{}, 0)
+	if !errors.As(err, &apiErr) || !errors.Is(err, ErrMailboxFull) || stub.count() != 1 {
+		t.Fatalf("Send to a full mailbox should not be retried, got %v after %d attempts", err, stub.count())
+	}
+	if apiErr.RetryAfter != time.Minute {
+		t.Fatalf("unexpected RetryAfter %s", apiErr.RetryAfter)
+	}
+}
+
+func TestContextCancelsBackoff(t *testing.T) {
+	c, stub := newStubClient(func(*http.Request, int) (int, string) { return http.StatusServiceUnavailable, "busy" })
+	c.Backoff = time.Hour
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := c.Health(ctx); !errors.Is(err, ErrServer) {
+		t.Fatalf("expected the last error, got %v", err)
+	}
+	if time.Since(start) > time.Second || stub.count() != 1 {
+		t.Fatalf("cancelled context did not stop the retries (%d attempts)", stub.count())
+	}
+}
+
+func TestLogin(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(nil)
+	var logins int
+	c, stub := newStubClient(func(r *http.Request, n int) (int, string) {
+		switch {
+		case r.URL.Path == "/auth/challenge/carol/phone":
+			return http.StatusOK, `{"nonce":"n1","expires_in":120}`
+		case r.URL.Path == "/auth/token/carol/phone":
+			var answer x3dh.AuthResponse
+			json.NewDecoder(r.Body).Decode(&answer)
+			sig, _ := hex.DecodeString(answer.Signature)
+			if !ed25519.Verify(key.Public().(ed25519.PublicKey), x3dh.AuthPayload("carol/phone", answer.Nonce), sig) {
+				return http.StatusForbidden, "bad signature"
+			}
+			logins++
+			token, _ := json.Marshal(x3dh.AuthToken{Token: "t" + string(rune('0'+logins)), ExpiresIn: 600})
+			return http.StatusOK, string(token)
+		case r.Header.Get("Authorization") != "Bearer t2":
+			// The first token is refused, as after a relay restart.
+			return http.StatusUnauthorized, "Invalid or expired token"
+		case r.URL.Path == "/messages/carol/phone":
+			return http.StatusNotFound, "No new messages"
+		}
+		return http.StatusOK, "[]"
+	})
+
+	if _, err := c.History(context.Background()); !errors.Is(err, ErrNoIdentity) {
+		t.Fatalf("expected ErrNoIdentity, got %v", err)
+	}
+	c.SetIdentity("carol/phone", key)
+	if _, err := c.History(context.Background()); err != nil {
+		t.Fatalf("History failed: %v", err)
+	}
+	if logins != 2 {
+		t.Fatalf("expected a second login after 401, got %d logins", logins)
+	}
+	// The token is reused, and an empty mailbox is not an error.
+	before := stub.count()
+	if d, err := c.Fetch(context.Background(), 30*time.Second); d != nil || err != nil {
+		t.Fatalf("Fetch on an empty mailbox returned %v, %v", d, err)
+	}
+	last := stub.requests[len(stub.requests)-1]
+	if stub.count() != before+1 || last.URL.Query().Get("wait") != "30" {
+		t.Fatalf("unexpected requests after login: %d, %s", stub.count()-before, last.URL)
+	}
+}
+
+func TestLogin_Concurrent(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(nil)
+	release := make(chan struct{})
+	var mu sync.Mutex
+	challenges := 0
+	c, _ := newStubClient(func(r *http.Request, n int) (int, string) {
+		switch r.URL.Path {
+		case "/auth/challenge/carol":
+			mu.Lock()
+			challenges++
+			mu.Unlock()
+			<-release
+			return http.StatusOK, `{"nonce":"n1","expires_in":120}`
+		case "/auth/token/carol":
+			return http.StatusOK, `{"token":"t1","expires_in":600}`
+		case "/health":
+			return http.StatusOK, `{"status":"healthy"}`
+		}
+		if r.Header.Get("Authorization") != "Bearer t1" {
+			return http.StatusUnauthorized, "Invalid or expired token"
+		}
+		return http.StatusOK, "[]"
+	})
+	c.SetIdentity("carol", key)
+
+	errs := make(chan error, 3)
+	for range 3 {
+		go func() {
+			_, err := c.History(context.Background())
+			errs <- err
+		}()
+	}
+	// While the login waits for the relay, the client stays usable.
+	time.Sleep(20 * time.Millisecond)
+	c.SetIdentity("carol", key)
+	if _, err := c.Health(context.Background()); err != nil {
+		t.Fatalf("Health failed during a login: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := c.History(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("a call waiting for the login should stop with its context, got %v", err)
+	}
+
+	close(release)
+	for range 3 {
+		if err := <-errs; err != nil {
+			t.Fatalf("History failed: %v", err)
+		}
+	}
+	if challenges != 1 {
+		t.Fatalf("concurrent calls should share one login, got %d", challenges)
+	}
+}
+
+func TestPaths(t *testing.T) {
+	c, stub := newStubClient(func(r *http.Request, n int) (int, string) {
+		return http.StatusOK, `{"ik":"aa","spk":"bb","spk_id":1,"device":"phone"}`
+	})
+	bundle, err := c.FetchBundle(context.Background(), "carol", "phone")
+	if err != nil || bundle.Device != "phone" {
+		t.Fatalf("FetchBundle returned %+v, %v", bundle, err)
+	}
+	if got := stub.requests[0].URL.String(); got != "http://relay.test/bundle/carol/phone" {
+		t.Fatalf("unexpected URL %s", got)
+	}
+	c.FetchBundle(context.Background(), "a b", "default")
+	if got := stub.requests[1].URL.EscapedPath(); got != "/bundle/a%20b/default" {
+		t.Fatalf("path segments were not escaped: %s", got)
+	}
+}
@@ -0,0 +1,107 @@
+// internal/client/errors.go
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Sentinel errors matched by *Error according to its status code.
+var (
+	ErrBadRequest      = errors.New("bad request")            // 400
+	ErrUnauthorized    = errors.New("not logged in")          // 401
+	ErrForbidden       = errors.New("forbidden")              // 403
+	ErrNotFound        = errors.New("not found")              // 404
+	ErrRejected        = errors.New("rejected by validation") // 422
+	ErrTooManyRequests = errors.New("too many requests")      // 429
+	ErrMailboxFull     = errors.New("mailbox is full")        // 429 with code mailbox_full
+	ErrServer          = errors.New("server error")           // any other 5xx
+)
+
+var statusErrors = map[int]error{
+	http.StatusBadRequest:          ErrBadRequest,
+	http.StatusUnauthorized:        ErrUnauthorized,
+	http.StatusForbidden:           ErrForbidden,
+	http.StatusNotFound:            ErrNotFound,
+	http.StatusUnprocessableEntity: ErrRejected,
+	http.StatusTooManyRequests:     ErrTooManyRequests,
+}
+
+// codeMailboxFull is the error code of a message turned away because the
+// recipient's mailbox is full.
+const codeMailboxFull = "mailbox_full"
+
+// Error is an error response from the relay. Code and Field are set when
+// the relay sent a structured error body such as
+// {"code": "low_order_key", "field": "spk", "error": "..."}.
+type Error struct {
+	StatusCode int
+	Status     string // e.g. "404 Not Found"
+	Code       string
+	Field      string
+	Message    string
+	// RetryAfter is the delay the relay asked for, if any.
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("server returned %s - %s (%s)", e.Status, e.Message, e.Code)
+	}
+	return fmt.Sprintf("server returned %s - %s", e.Status, e.Message)
+}
+
+// Is matches the sentinel error for the status code, and ErrMailboxFull
+// for its error code.
+func (e *Error) Is(target error) bool {
+	if target == ErrMailboxFull {
+		return e.Code == codeMailboxFull
+	}
+	if sentinel, ok := statusErrors[e.StatusCode]; ok {
+		return target == sentinel
+	}
+	return target == ErrServer && e.StatusCode >= 500
+}
+
+// retryable reports whether the request may be sent again. 429 and 503
+// mean the relay turned it away unprocessed; gateway errors leave that open.
+// A full mailbox only drains as its owner reads it, so it is left to the
+// caller to try again after RetryAfter.
+func (e *Error) retryable(idempotent bool) bool {
+	if e.Code == codeMailboxFull {
+		return false
+	}
+	switch e.StatusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return true
+	case http.StatusBadGateway, http.StatusGatewayTimeout:
+		return idempotent
+	}
+	return false
+}
+
+// newError reads an unexpected response into an *Error.
+func newError(resp *http.Response) *Error {
+	e := &Error{StatusCode: resp.StatusCode, Status: resp.Status}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	var structured struct {
+		Code    string `json:"code"`
+		Field   string `json:"field"`
+		Message string `json:"error"`
+	}
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") && json.Unmarshal(body, &structured) == nil {
+		e.Code, e.Field, e.Message = structured.Code, structured.Field, structured.Message
+	} else {
+		e.Message = strings.TrimSpace(string(body))
+	}
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		e.RetryAfter = time.Duration(seconds) * time.Second
+	}
+	return e
+}
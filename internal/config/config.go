@@ -0,0 +1,271 @@
+// internal/config/config.go
+//
+// Package config loads the settings shared by the server and the clients.
+// Every value comes from, in increasing order of precedence: the built-in
+// default, an X3DH_* environment variable, and a command-line flag.
+package config
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the server and client settings.
+type Config struct {
+	// Server
+	ListenAddr    string        // X3DH_LISTEN_ADDR, or ":" + X3DH_SERVER_PORT
+	Store         string        // X3DH_STORE: redis, memory or file
+	DataDir       string        // X3DH_DATA_DIR
+	RedisAddr     string        // X3DH_REDIS_ADDR
+	RedisPassword string        // X3DH_REDIS_PASSWORD
+	RedisDB       int           // X3DH_REDIS_DB
+	MaxWaiters    int           // X3DH_MAX_WAITERS: concurrent long-polls and WebSockets per user
+	LeaseTimeout  time.Duration // X3DH_LEASE_TIMEOUT: how long a fetched message waits for its ack
+	MessageTTL    time.Duration // X3DH_MESSAGE_TTL: longest a message may wait in a mailbox
+	MailboxSize   int           // X3DH_MAILBOX_SIZE: messages a mailbox may hold, 0 for no limit
+	BundleTTL     time.Duration // X3DH_BUNDLE_TTL: drop bundles of users inactive for this long, 0 to keep forever
+	SweepInterval time.Duration // X3DH_SWEEP_INTERVAL: how often expired messages and bundles are removed
+	LogLevel      string        // X3DH_LOG_LEVEL: debug, info, warn or error
+	EnableLogging bool          // X3DH_ENABLE_LOGGING
+
+	// Clients
+	ServerURL string        // X3DH_SERVER_URL, or built from X3DH_SERVER_HOST and X3DH_SERVER_PORT
+	KeyFile   string        // X3DH_KEY_FILE
+	Device    string        // X3DH_DEVICE: this client's device, empty for the user's default device
+	User      string        // X3DH_USER: the user the x3dh client and chat act as
+	KeyDir    string        // X3DH_KEY_DIR: holds one key directory per user
+	Timeout   time.Duration // X3DH_REQUEST_TIMEOUT: bounds each attempt of a relay request
+	Retries   int           // X3DH_RETRIES: how often a failed relay request is repeated
+	// Passphrase unlocks encrypted key files. It has no flag so that it
+	// does not show up in the process list.
+	Passphrase string // X3DH_PASSPHRASE
+
+	// Both
+	LowMemory bool // X3DH_LOW_MEMORY
+}
+
+// Default returns the built-in defaults, matching a local setup with Redis
+// on localhost. keyFile is the client's default private key file.
+func Default(keyFile string) *Config {
+	return &Config{
+		ListenAddr:    ":8080",
+		Store:         "redis",
+		DataDir:       "server_data",
+		RedisAddr:     "localhost:6379",
+		MaxWaiters:    4,
+		LeaseTimeout:  60 * time.Second,
+		MessageTTL:    7 * 24 * time.Hour,
+		MailboxSize:   1000,
+		BundleTTL:     90 * 24 * time.Hour,
+		SweepInterval: time.Minute,
+		ServerURL:     "http://localhost:8080",
+		KeyFile:       keyFile,
+		KeyDir:        "keys",
+		Timeout:       10 * time.Second,
+		Retries:       3,
+		LogLevel:      "info",
+		EnableLogging: true,
+	}
+}
+
+// LoadEnv overrides c with any X3DH_* variables found in the environment.
+func (c *Config) LoadEnv() error {
+	return c.loadEnv(os.LookupEnv)
+}
+
+func (c *Config) loadEnv(lookup func(string) (string, bool)) error {
+	str := func(name string, dst *string) {
+		if v, ok := lookup(name); ok && v != "" {
+			*dst = v
+		}
+	}
+	var err error
+	boolean := func(name string, dst *bool) {
+		if v, ok := lookup(name); ok && v != "" && err == nil {
+			b, perr := strconv.ParseBool(v)
+			if perr != nil {
+				err = fmt.Errorf("invalid %s: %q", name, v)
+				return
+			}
+			*dst = b
+		}
+	}
+	integer := func(name string, dst *int) {
+		if v, ok := lookup(name); ok && v != "" && err == nil {
+			n, perr := strconv.Atoi(v)
+			if perr != nil {
+				err = fmt.Errorf("invalid %s: %q", name, v)
+				return
+			}
+			*dst = n
+		}
+	}
+
+	duration := func(name string, dst *time.Duration) {
+		if v, ok := lookup(name); ok && v != "" && err == nil {
+			d, perr := time.ParseDuration(v)
+			if perr != nil {
+				err = fmt.Errorf("invalid %s: %q", name, v)
+				return
+			}
+			*dst = d
+		}
+	}
+
+	// The compose file describes the server by host and port.
+	host, hostSet := lookup("X3DH_SERVER_HOST")
+	port, portSet := lookup("X3DH_SERVER_PORT")
+	if portSet && port != "" {
+		c.ListenAddr = ":" + port
+	}
+	if hostSet || portSet {
+		if host == "" {
+			host = "localhost"
+		}
+		if port == "" {
+			port = "8080"
+		}
+		c.ServerURL = "http://" + net.JoinHostPort(host, port)
+	}
+
+	str("X3DH_LISTEN_ADDR", &c.ListenAddr)
+	str("X3DH_SERVER_URL", &c.ServerURL)
+	str("X3DH_STORE", &c.Store)
+	str("X3DH_DATA_DIR", &c.DataDir)
+	str("X3DH_REDIS_ADDR", &c.RedisAddr)
+	str("X3DH_REDIS_PASSWORD", &c.RedisPassword)
+	str("X3DH_KEY_FILE", &c.KeyFile)
+	str("X3DH_DEVICE", &c.Device)
+	str("X3DH_USER", &c.User)
+	str("X3DH_KEY_DIR", &c.KeyDir)
+	str("X3DH_PASSPHRASE", &c.Passphrase)
+	str("X3DH_LOG_LEVEL", &c.LogLevel)
+	boolean("X3DH_ENABLE_LOGGING", &c.EnableLogging)
+	boolean("X3DH_LOW_MEMORY", &c.LowMemory)
+	integer("X3DH_REDIS_DB", &c.RedisDB)
+	integer("X3DH_MAX_WAITERS", &c.MaxWaiters)
+	duration("X3DH_LEASE_TIMEOUT", &c.LeaseTimeout)
+	duration("X3DH_MESSAGE_TTL", &c.MessageTTL)
+	integer("X3DH_MAILBOX_SIZE", &c.MailboxSize)
+	duration("X3DH_BUNDLE_TTL", &c.BundleTTL)
+	duration("X3DH_SWEEP_INTERVAL", &c.SweepInterval)
+	duration("X3DH_REQUEST_TIMEOUT", &c.Timeout)
+	integer("X3DH_RETRIES", &c.Retries)
+	return err
+}
+
+// RegisterServerFlags adds the server flags to fs, defaulting to the current values of c.
+func (c *Config) RegisterServerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.ListenAddr, "listen", c.ListenAddr, "Address to listen on (X3DH_LISTEN_ADDR)")
+	fs.StringVar(&c.Store, "store", c.Store, "Storage backend: redis, memory or file (X3DH_STORE)")
+	fs.StringVar(&c.DataDir, "data-dir", c.DataDir, "Directory for the file store (X3DH_DATA_DIR)")
+	fs.StringVar(&c.RedisAddr, "redis-addr", c.RedisAddr, "Redis server address (X3DH_REDIS_ADDR)")
+	fs.StringVar(&c.RedisPassword, "redis-password", c.RedisPassword, "Redis password (X3DH_REDIS_PASSWORD)")
+	fs.IntVar(&c.RedisDB, "redis-db", c.RedisDB, "Redis database number (X3DH_REDIS_DB)")
+	fs.IntVar(&c.MaxWaiters, "max-waiters", c.MaxWaiters, "Concurrent long-polls and WebSockets allowed per user (X3DH_MAX_WAITERS)")
+	fs.DurationVar(&c.LeaseTimeout, "lease-timeout", c.LeaseTimeout, "How long a fetched message waits for its acknowledgement before redelivery (X3DH_LEASE_TIMEOUT)")
+	fs.DurationVar(&c.MessageTTL, "message-ttl", c.MessageTTL, "Longest a message may wait for delivery; senders may ask for less (X3DH_MESSAGE_TTL)")
+	fs.IntVar(&c.MailboxSize, "mailbox-size", c.MailboxSize, "Messages a mailbox may hold before new ones are rejected, 0 for no limit (X3DH_MAILBOX_SIZE)")
+	fs.DurationVar(&c.BundleTTL, "bundle-ttl", c.BundleTTL, "Remove bundles of users inactive for this long, 0 to keep them forever (X3DH_BUNDLE_TTL)")
+	fs.DurationVar(&c.SweepInterval, "sweep-interval", c.SweepInterval, "How often expired messages and bundles are removed (X3DH_SWEEP_INTERVAL)")
+	c.registerCommonFlags(fs)
+}
+
+// RegisterClientFlags adds the client flags to fs, defaulting to the current values of c.
+func (c *Config) RegisterClientFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.ServerURL, "server", c.ServerURL, "Relay server URL (X3DH_SERVER_URL)")
+	fs.StringVar(&c.KeyFile, "keys", c.KeyFile, "Private key file (X3DH_KEY_FILE)")
+	fs.StringVar(&c.Device, "device", c.Device, "Device name under the user, empty for the default device (X3DH_DEVICE)")
+	fs.DurationVar(&c.Timeout, "request-timeout", c.Timeout, "Timeout for each attempt of a relay request (X3DH_REQUEST_TIMEOUT)")
+	fs.IntVar(&c.Retries, "retries", c.Retries, "How often a failed relay request is retried (X3DH_RETRIES)")
+	c.registerCommonFlags(fs)
+}
+
+// RegisterUserFlags adds the flags of clients that can act as any user, on
+// top of the client flags.
+func (c *Config) RegisterUserFlags(fs *flag.FlagSet) {
+	c.RegisterClientFlags(fs)
+	fs.StringVar(&c.User, "user", c.User, "User to act as (X3DH_USER)")
+	fs.StringVar(&c.KeyDir, "key-dir", c.KeyDir, "Directory holding each user's keys (X3DH_KEY_DIR)")
+}
+
+func (c *Config) registerCommonFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.LogLevel, "log-level", c.LogLevel, "Log level: debug, info, warn or error (X3DH_LOG_LEVEL)")
+}
+
+// Validate checks the values that have a fixed set of choices.
+func (c *Config) Validate() error {
+	switch c.Store {
+	case "redis", "memory", "file":
+	default:
+		return fmt.Errorf("unknown store %q (use redis, memory or file)", c.Store)
+	}
+	switch c.LogLevel {
+	case "debug", "info", "warn", "error":
+	default:
+		return fmt.Errorf("unknown log level %q (use debug, info, warn or error)", c.LogLevel)
+	}
+	if c.MaxWaiters < 1 {
+		return fmt.Errorf("max waiters must be at least 1, got %d", c.MaxWaiters)
+	}
+	if c.LeaseTimeout <= 0 {
+		return fmt.Errorf("lease timeout must be positive, got %s", c.LeaseTimeout)
+	}
+	if c.MessageTTL <= 0 {
+		return fmt.Errorf("message TTL must be positive, got %s", c.MessageTTL)
+	}
+	if c.MailboxSize < 0 {
+		return fmt.Errorf("mailbox size must not be negative, got %d", c.MailboxSize)
+	}
+	if c.BundleTTL < 0 {
+		return fmt.Errorf("bundle TTL must not be negative, got %s", c.BundleTTL)
+	}
+	if c.SweepInterval <= 0 {
+		return fmt.Errorf("sweep interval must be positive, got %s", c.SweepInterval)
+	}
+	if c.Timeout <= 0 {
+		return fmt.Errorf("request timeout must be positive, got %s", c.Timeout)
+	}
+	if c.Retries < 0 {
+		return fmt.Errorf("retries must not be negative, got %d", c.Retries)
+	}
+	if strings.Contains(c.Device, "/") {
+		return fmt.Errorf("device name %q must not contain '/'", c.Device)
+	}
+	if strings.Contains(c.User, "/") {
+		return fmt.Errorf("user name %q must not contain '/'", c.User)
+	}
+	c.ServerURL = strings.TrimRight(c.ServerURL, "/")
+	return nil
+}
+
+// logLevels orders the log levels by severity.
+var logLevels = map[string]int{"debug": 0, "info": 1, "warn": 2, "error": 3}
+
+// Logs reports whether messages of the given level are logged: logging is
+// enabled and the level is at least as severe as LogLevel.
+func (c *Config) Logs(level string) bool {
+	return c.EnableLogging && logLevels[level] >= logLevels[c.LogLevel]
+}
+
+// Load is the usual entry point for a binary: defaults, then environment,
+// then the flags in fs parsed from args. register adds the binary's flags.
+func Load(fs *flag.FlagSet, args []string, keyFile string, register func(*Config, *flag.FlagSet)) (*Config, error) {
+	c := Default(keyFile)
+	if err := c.LoadEnv(); err != nil {
+		return nil, err
+	}
+	register(c, fs)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
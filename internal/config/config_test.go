@@ -0,0 +1,138 @@
+package config
+
+import (
+	"flag"
+	"testing"
+	"time"
+)
+
+func lookupFrom(env map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+}
+
+func TestLoadEnv_ComposeVariables(t *testing.T) {
+	c := Default("bob_private_keys.json")
+	err := c.loadEnv(lookupFrom(map[string]string{
+		"X3DH_SERVER_HOST":    "x3dh-server",
+		"X3DH_SERVER_PORT":    "9090",
+		"X3DH_LOW_MEMORY":     "true",
+		"X3DH_ENABLE_LOGGING": "false",
+		"X3DH_REDIS_DB":       "2",
+		"X3DH_MAX_WAITERS":    "8",
+		"X3DH_LEASE_TIMEOUT":  "90s",
+		"X3DH_MESSAGE_TTL":    "24h",
+		"X3DH_MAILBOX_SIZE":   "50",
+		"X3DH_BUNDLE_TTL":     "0",
+	}))
+	if err != nil {
+		t.Fatalf("loadEnv failed: %v", err)
+	}
+	if c.ServerURL != "http://x3dh-server:9090" {
+		t.Fatalf("unexpected server URL %q", c.ServerURL)
+	}
+	if c.ListenAddr != ":9090" {
+		t.Fatalf("unexpected listen address %q", c.ListenAddr)
+	}
+	if !c.LowMemory || c.EnableLogging || c.RedisDB != 2 || c.MaxWaiters != 8 || c.LeaseTimeout != 90*time.Second {
+		t.Fatalf("unexpected config %+v", c)
+	}
+	if c.MessageTTL != 24*time.Hour || c.MailboxSize != 50 || c.BundleTTL != 0 {
+		t.Fatalf("unexpected retention config %+v", c)
+	}
+}
+
+func TestLoadEnv_Invalid(t *testing.T) {
+	c := Default("")
+	if err := c.loadEnv(lookupFrom(map[string]string{"X3DH_LOW_MEMORY": "maybe"})); err == nil {
+		t.Fatal("expected error for invalid boolean")
+	}
+	if err := c.loadEnv(lookupFrom(map[string]string{"X3DH_REDIS_DB": "one"})); err == nil {
+		t.Fatal("expected error for invalid Redis DB")
+	}
+}
+
+func TestFlagsOverrideEnvironment(t *testing.T) {
+	c := Default("alice_private_keys.json")
+	if err := c.loadEnv(lookupFrom(map[string]string{
+		"X3DH_SERVER_URL": "http://env:8080",
+		"X3DH_KEY_FILE":   "/app/keys/alice.json",
+		"X3DH_DEVICE":     "phone",
+	})); err != nil {
+		t.Fatalf("loadEnv failed: %v", err)
+	}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	c.RegisterClientFlags(fs)
+	if err := fs.Parse([]string{"-server", "http://flag:8080/"}); err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	if c.ServerURL != "http://flag:8080" {
+		t.Fatalf("flag should override environment, got %q", c.ServerURL)
+	}
+	if c.KeyFile != "/app/keys/alice.json" || c.Device != "phone" {
+		t.Fatalf("environment should override default, got %q, %q", c.KeyFile, c.Device)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	c := Default("")
+	c.Store = "etcd"
+	if err := c.Validate(); err == nil {
+		t.Fatal("expected error for unknown store")
+	}
+	c = Default("")
+	c.LogLevel = "verbose"
+	if err := c.Validate(); err == nil {
+		t.Fatal("expected error for unknown log level")
+	}
+	c = Default("")
+	c.MessageTTL = 0
+	if err := c.Validate(); err == nil {
+		t.Fatal("expected error for zero message TTL")
+	}
+	c = Default("")
+	c.Retries = -1
+	if err := c.Validate(); err == nil {
+		t.Fatal("expected error for negative retries")
+	}
+}
+
+func TestUserFlags(t *testing.T) {
+	c := Default("")
+	if err := c.loadEnv(lookupFrom(map[string]string{"X3DH_USER": "carol"})); err != nil {
+		t.Fatalf("loadEnv failed: %v", err)
+	}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	c.RegisterUserFlags(fs)
+	if err := fs.Parse([]string{"-key-dir", "/var/lib/x3dh"}); err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if c.User != "carol" || c.KeyDir != "/var/lib/x3dh" {
+		t.Fatalf("unexpected user %q and key directory %q", c.User, c.KeyDir)
+	}
+	c.User = "carol/phone"
+	if err := c.Validate(); err == nil {
+		t.Fatal("expected error for user name with a slash")
+	}
+}
+
+func TestLogs(t *testing.T) {
+	c := Default("")
+	c.LogLevel = "warn"
+	if c.Logs("info") || !c.Logs("warn") || !c.Logs("error") {
+		t.Fatal("warn should log warnings and errors only")
+	}
+	c.LogLevel = "debug"
+	if !c.Logs("debug") {
+		t.Fatal("debug should log everything")
+	}
+	c.EnableLogging = false
+	if c.Logs("error") {
+		t.Fatal("nothing should be logged with logging disabled")
+	}
+}
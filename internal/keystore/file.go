@@ -0,0 +1,453 @@
+// internal/keystore/file.go
+package keystore
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ErrPassphraseRequired is returned when an encrypted file is read without
+// a passphrase.
+var ErrPassphraseRequired = errors.New("key file is encrypted: a passphrase is required")
+
+// File is a KeyStore in two JSON files, one for the keys and one for the
+// sessions, each rewritten whenever it changes. Both are sealed when the
+// store has a passphrase. Files are loaded on first use; files written by
+// the old alice and bob programs and by older versions are migrated then.
+type File struct {
+	KeyFile string
+	// SessionsFile holds the sessions. When it is empty they only last as
+	// long as the File.
+	SessionsFile string
+
+	// Passphrase is asked for the passphrase the first time a file is read
+	// or written; create is set when the files are not encrypted yet. When
+	// it is nil or returns an empty passphrase the files are kept
+	// unencrypted, and unencrypted files read with a passphrase are
+	// encrypted on the spot.
+	Passphrase func(create bool) ([]byte, error)
+	// Params are the Argon2id parameters for newly encrypted files; zero
+	// means DefaultParams.
+	Params Params
+
+	mu        sync.Mutex
+	keys      *keyring
+	sessions  map[string][]*Session
+	pass      []byte
+	passAsked bool
+	vault     *Key // derived from pass once a file was sealed or opened
+}
+
+func (f *File) Identity() (*Identity, error) {
+	var id *Identity
+	err := f.read(func(k *keyring) (err error) {
+		id, err = k.identity()
+		return err
+	})
+	return id, err
+}
+
+func (f *File) SetIdentity(id *Identity) error {
+	return f.update(func(k *keyring) error {
+		k.setIdentity(id)
+		return nil
+	})
+}
+
+func (f *File) SignedPreKey(id uint32) (*SignedPreKey, error) {
+	var spk *SignedPreKey
+	err := f.read(func(k *keyring) (err error) {
+		spk, err = k.signedPreKey(id, time.Now())
+		return err
+	})
+	return spk, err
+}
+
+func (f *File) CurrentSignedPreKey() (uint32, *SignedPreKey, error) {
+	var id uint32
+	var spk *SignedPreKey
+	err := f.read(func(k *keyring) (err error) {
+		id, spk, err = k.currentSignedPreKey(time.Now())
+		return err
+	})
+	return id, spk, err
+}
+
+func (f *File) AddSignedPreKey(spk *SignedPreKey) (uint32, error) {
+	var id uint32
+	err := f.update(func(k *keyring) error {
+		k.pruneSignedPreKeys(time.Now())
+		id = k.addSignedPreKey(spk)
+		return nil
+	})
+	return id, err
+}
+
+func (f *File) RetireSignedPreKey(id uint32, expires time.Time) error {
+	return f.update(func(k *keyring) error {
+		return k.retireSignedPreKey(id, expires)
+	})
+}
+
+func (f *File) OneTimePreKey(id uint32) (*ecdh.PrivateKey, error) {
+	var otk *ecdh.PrivateKey
+	err := f.read(func(k *keyring) (err error) {
+		otk, err = k.oneTimePreKey(id)
+		return err
+	})
+	return otk, err
+}
+
+func (f *File) AddOneTimePreKeys(keys []*ecdh.PrivateKey) ([]uint32, error) {
+	var ids []uint32
+	err := f.update(func(k *keyring) error {
+		ids = k.addOneTimePreKeys(keys)
+		return nil
+	})
+	return ids, err
+}
+
+func (f *File) DeleteOneTimePreKey(id uint32) error {
+	return f.update(func(k *keyring) error {
+		delete(k.OTKs, id)
+		return nil
+	})
+}
+
+func (f *File) Sessions(addr string) ([]*Session, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.loadSessions(); err != nil {
+		return nil, err
+	}
+	return f.sessions[addr], nil
+}
+
+func (f *File) SetSessions(addr string, sessions []*Session) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.loadSessions(); err != nil {
+		return err
+	}
+	setSessions(f.sessions, addr, sessions)
+	return f.saveSessions()
+}
+
+func (f *File) SessionAddresses() ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.loadSessions(); err != nil {
+		return nil, err
+	}
+	return sessionAddresses(f.sessions), nil
+}
+
+// ChangePassphrase re-encrypts the keys and sessions under a new
+// passphrase. An empty one stores them unencrypted. Unencrypted files are
+// migrated the same way.
+func (f *File) ChangePassphrase(pass []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.loadKeys(); err != nil {
+		return err
+	}
+	if err := f.loadSessions(); err != nil {
+		return err
+	}
+	f.vault, f.pass, f.passAsked = nil, pass, true
+	if err := f.saveKeys(); err != nil {
+		return err
+	}
+	return f.saveSessions()
+}
+
+// read loads the keys and passes them to fn.
+func (f *File) read(fn func(k *keyring) error) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.loadKeys(); err != nil {
+		return err
+	}
+	return fn(f.keys)
+}
+
+// update loads the keys, passes them to fn to change and saves them.
+func (f *File) update(fn func(k *keyring) error) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.loadKeys(); err != nil {
+		return err
+	}
+	if err := fn(f.keys); err != nil {
+		return err
+	}
+	return f.saveKeys()
+}
+
+// loadKeys reads the key file on first use. A missing file means no keys yet.
+func (f *File) loadKeys() error {
+	if f.keys != nil {
+		return nil
+	}
+	blob, sealed, err := f.readSecret(f.KeyFile)
+	if os.IsNotExist(err) {
+		f.keys = newKeyring()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	keys, err := parseKeyring(blob, f.KeyFile)
+	if err != nil {
+		return err
+	}
+	f.keys = keys
+	if !sealed {
+		return f.migrate(f.saveKeys)
+	}
+	return nil
+}
+
+func (f *File) saveKeys() error {
+	if len(f.keys.IKPriv) == 0 {
+		return fmt.Errorf("%w: no identity to save in %s", ErrNotFound, f.KeyFile)
+	}
+	blob, err := json.MarshalIndent(f.keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := f.writeSecret(f.KeyFile, blob); err != nil {
+		return fmt.Errorf("failed to save keys: %v", err)
+	}
+	return nil
+}
+
+// loadSessions reads the sessions file on first use. A missing file means
+// no sessions yet.
+func (f *File) loadSessions() error {
+	if f.sessions != nil {
+		return nil
+	}
+	f.sessions = make(map[string][]*Session)
+	if f.SessionsFile == "" {
+		return nil
+	}
+	blob, sealed, err := f.readSecret(f.SessionsFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err == nil {
+		err = json.Unmarshal(blob, &f.sessions)
+		if err != nil {
+			err = fmt.Errorf("invalid sessions file %s: %v", f.SessionsFile, err)
+		}
+	}
+	if err != nil {
+		f.sessions = nil
+		return err
+	}
+	if !sealed {
+		return f.migrate(f.saveSessions)
+	}
+	return nil
+}
+
+func (f *File) saveSessions() error {
+	if f.SessionsFile == "" {
+		return nil
+	}
+	blob, err := json.MarshalIndent(f.sessions, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := f.writeSecret(f.SessionsFile, blob); err != nil {
+		return fmt.Errorf("failed to save sessions: %v", err)
+	}
+	return nil
+}
+
+// parseKeyring reads a key file, migrating older layouts and dropping
+// retired SPKs whose grace period is over.
+func parseKeyring(blob []byte, path string) (*keyring, error) {
+	var keys keyring
+	if err := json.Unmarshal(blob, &keys); err != nil {
+		return nil, fmt.Errorf("invalid key file %s: %v", path, err)
+	}
+	if len(keys.IKPriv) == 0 {
+		if len(keys.IKbPriv) > 0 {
+			keys.IKPriv = keys.IKbPriv
+		} else {
+			keys.IKPriv = keys.IKaPriv
+		}
+	}
+	keys.IKaPriv, keys.IKbPriv = nil, nil
+	if len(keys.IKPriv) == 0 {
+		return nil, fmt.Errorf("no identity key in %s", path)
+	}
+	// Alice's key files from before authentication have no Ed25519 key yet.
+	if len(keys.EdPriv) == 0 {
+		_, edPriv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate Ed25519 key: %v", err)
+		}
+		keys.EdPriv = edPriv
+	}
+	if len(keys.EdPriv) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("invalid Ed25519 key in %s", path)
+	}
+	if keys.OTKs == nil {
+		keys.OTKs = make(map[uint32][]byte)
+	}
+	if keys.NextOTKID == 0 {
+		keys.NextOTKID = 1
+	}
+	if len(keys.OTKbPriv) > 0 {
+		keys.OTKs[keys.NextOTKID] = keys.OTKbPriv
+		keys.NextOTKID++
+		keys.OTKbPriv = nil
+	}
+	if keys.SPKs == nil {
+		keys.SPKs = make(map[uint32]*storedSPK)
+	}
+	if len(keys.SPKbPriv) > 0 {
+		// Bundles registered by older versions carry no SPK id, i.e. id 0.
+		keys.SPKs[0] = &storedSPK{Priv: keys.SPKbPriv}
+		keys.CurrentSPKID = 0
+		keys.SPKbPriv = nil
+	}
+	keys.pruneSignedPreKeys(time.Now())
+	return &keys, nil
+}
+
+// passphrase returns the store's passphrase, asking for it at most once.
+// create tells the callback that a passphrase is being chosen for files
+// that are not encrypted yet.
+func (f *File) passphrase(create bool) ([]byte, error) {
+	if f.passAsked || f.Passphrase == nil {
+		return f.pass, nil
+	}
+	pass, err := f.Passphrase(create)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read passphrase: %v", err)
+	}
+	f.pass, f.passAsked = pass, true
+	return pass, nil
+}
+
+// readSecret reads a file and decrypts it if it is sealed, which sealed
+// reports. Errors from reading the file are returned unwrapped.
+func (f *File) readSecret(path string) (data []byte, sealed bool, err error) {
+	data, err = os.ReadFile(path)
+	if err != nil || !IsSealed(data) {
+		return data, false, err
+	}
+	if f.vault != nil {
+		plaintext, err := f.vault.Open(data)
+		if !errors.Is(err, ErrOtherKey) {
+			if err != nil {
+				return nil, true, fmt.Errorf("%s: %w", path, err)
+			}
+			return plaintext, true, nil
+		}
+	}
+	pass, err := f.passphrase(false)
+	if err != nil {
+		return nil, true, err
+	}
+	if len(pass) == 0 {
+		return nil, true, fmt.Errorf("%w: %s", ErrPassphraseRequired, path)
+	}
+	key, plaintext, err := Unlock(data, pass)
+	if err != nil {
+		return nil, true, fmt.Errorf("%s: %w", path, err)
+	}
+	if f.vault == nil {
+		f.vault = key
+	}
+	return plaintext, true, nil
+}
+
+// writeSecret writes data to path, sealed if the store has a passphrase,
+// creating its directory if needed.
+func (f *File) writeSecret(path string, data []byte) error {
+	if f.vault == nil {
+		pass, err := f.passphrase(true)
+		if err != nil {
+			return err
+		}
+		if len(pass) > 0 {
+			params := f.Params
+			if params == (Params{}) {
+				params = DefaultParams
+			}
+			if f.vault, err = NewKey(pass, params); err != nil {
+				return err
+			}
+		}
+	}
+	if f.vault != nil {
+		var err error
+		if data, err = f.vault.Seal(data); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return writeFile(path, data)
+}
+
+// writeFile replaces path with data through a temporary file in the same
+// directory, so a crash or a full disk leaves either the old file or the new
+// one, never a truncated key. The temporary file is created with mode 0600.
+func writeFile(path string, data []byte) error {
+	dir, name := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	tmp, err := os.CreateTemp(dir, name+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync %s: %v", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace %s: %v", path, err)
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// migrate seals a file that was read unencrypted by saving it again, if
+// the store has a passphrase.
+func (f *File) migrate(save func() error) error {
+	if f.vault == nil {
+		pass, err := f.passphrase(true)
+		if err != nil || len(pass) == 0 {
+			return err
+		}
+	}
+	return save()
+}
@@ -0,0 +1,253 @@
+package keystore
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeJSON(t *testing.T, path string, v interface{}) {
+	t.Helper()
+	blob, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, blob, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newX25519(t *testing.T) *ecdh.PrivateKey {
+	t.Helper()
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return priv
+}
+
+func newIdentity(t *testing.T) *Identity {
+	t.Helper()
+	_, ed, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Identity{Key: newX25519(t), Signing: ed}
+}
+
+func sealed(t *testing.T, path string) bool {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read %s: %v", path, err)
+	}
+	return IsSealed(data)
+}
+
+func TestFile_SaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "carol", "keys.json")
+	f := &File{KeyFile: path}
+	if _, err := f.AddOneTimePreKeys([]*ecdh.PrivateKey{newX25519(t)}); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("keys without an identity should not be saved, got %v", err)
+	}
+	f = &File{KeyFile: path}
+	id := newIdentity(t)
+	if err := f.SetIdentity(id); err != nil {
+		t.Fatalf("SetIdentity failed: %v", err)
+	}
+	if _, err := f.AddOneTimePreKeys([]*ecdh.PrivateKey{newX25519(t), newX25519(t), newX25519(t)}); err != nil {
+		t.Fatalf("AddOneTimePreKeys failed: %v", err)
+	}
+
+	loaded := &File{KeyFile: path}
+	got, err := loaded.Identity()
+	if err != nil || !got.Key.Equal(id.Key) || !got.Signing.Equal(id.Signing) {
+		t.Fatalf("identity did not round-trip: %v", err)
+	}
+	if _, err := loaded.OneTimePreKey(3); err != nil {
+		t.Fatalf("OneTimePreKey failed: %v", err)
+	}
+	if ids, _ := loaded.AddOneTimePreKeys([]*ecdh.PrivateKey{newX25519(t)}); ids[0] != 4 {
+		t.Fatalf("one-time prekey ids should continue after a reload, got %v", ids)
+	}
+
+	// Files are replaced whole, leaving no temporary files behind.
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil || len(entries) != 1 || entries[0].Name() != "keys.json" {
+		t.Fatalf("expected only keys.json, got %v, %v", entries, err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("key file mode is %v, want 0600", info.Mode().Perm())
+	}
+}
+
+func TestFile_Missing(t *testing.T) {
+	f := &File{KeyFile: filepath.Join(t.TempDir(), "keys.json")}
+	if _, err := f.Identity(); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestFile_MigratesAliceFile(t *testing.T) {
+	ik := newX25519(t)
+	path := filepath.Join(t.TempDir(), "alice_private_keys.json")
+	writeJSON(t, path, map[string][]byte{"ika_priv": ik.Bytes()})
+
+	f := &File{KeyFile: path}
+	id, err := f.Identity()
+	if err != nil {
+		t.Fatalf("Identity failed: %v", err)
+	}
+	if !id.Key.Equal(ik) || f.keys.IKaPriv != nil {
+		t.Fatal("identity key was not migrated")
+	}
+	if len(id.Signing) == 0 {
+		t.Fatal("missing Ed25519 key was not generated")
+	}
+	if _, _, err := f.CurrentSignedPreKey(); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("a send-only key file should have no SPK, got %v", err)
+	}
+}
+
+func TestFile_MigratesBobFile(t *testing.T) {
+	ik, spk, otk, old := newX25519(t), newX25519(t), newX25519(t), newX25519(t)
+	path := filepath.Join(t.TempDir(), "bob_private_keys.json")
+	writeJSON(t, path, map[string]interface{}{
+		"ikb_priv":       ik.Bytes(),
+		"ed_priv":        newIdentity(t).Signing,
+		"current_spk_id": 2,
+		"spks": map[string]*storedSPK{
+			"1": {Priv: old.Bytes(), ExpiresAt: time.Now().Add(-time.Hour)},
+			"2": {Priv: spk.Bytes()},
+		},
+		"otkb_priv": otk.Bytes(),
+	})
+
+	f := &File{KeyFile: path}
+	id, err := f.Identity()
+	if err != nil {
+		t.Fatalf("Identity failed: %v", err)
+	}
+	if !id.Key.Equal(ik) || f.keys.IKbPriv != nil {
+		t.Fatal("identity key was not migrated")
+	}
+	if _, err := f.SignedPreKey(1); !errors.Is(err, ErrNotFound) || f.keys.SPKs[1] != nil {
+		t.Fatalf("expired SPK should be dropped, got %v", err)
+	}
+	if current, got, err := f.CurrentSignedPreKey(); err != nil || current != 2 || !got.Key.Equal(spk) {
+		t.Fatalf("current SPK was not kept: %d, %v", current, err)
+	}
+	if got, err := f.OneTimePreKey(1); err != nil || !got.Equal(otk) || f.keys.NextOTKID != 2 {
+		t.Fatalf("legacy OTK was not migrated: %v", err)
+	}
+}
+
+// withPassphrase returns a store over dir with a fixed passphrase and a
+// count of how often it was asked for.
+func withPassphrase(dir, pass string) (*File, *int) {
+	asked := new(int)
+	return &File{
+		KeyFile:      filepath.Join(dir, "keys.json"),
+		SessionsFile: filepath.Join(dir, "sessions.json"),
+		Params:       testParams,
+		Passphrase: func(bool) ([]byte, error) {
+			*asked++
+			return []byte(pass), nil
+		},
+	}, asked
+}
+
+func TestFile_Passphrase(t *testing.T) {
+	dir := t.TempDir()
+	f, asked := withPassphrase(dir, "one")
+	id := newIdentity(t)
+	if err := f.SetIdentity(id); err != nil {
+		t.Fatalf("SetIdentity failed: %v", err)
+	}
+	if err := f.SetSessions("dave", []*Session{{PeerIdentity: "aa"}}); err != nil {
+		t.Fatalf("SetSessions failed: %v", err)
+	}
+	if *asked != 1 || !sealed(t, f.KeyFile) || !sealed(t, f.SessionsFile) {
+		t.Fatalf("both files should be sealed after asking once, asked %d times", *asked)
+	}
+
+	// Reading them back takes the same passphrase, asked for once.
+	again, asked := withPassphrase(dir, "one")
+	if got, err := again.Identity(); err != nil || !got.Key.Equal(id.Key) {
+		t.Fatalf("Identity returned %v", err)
+	}
+	if list, err := again.Sessions("dave"); err != nil || len(list) != 1 || *asked != 1 {
+		t.Fatalf("Sessions returned %d sessions, %v after %d prompts", len(list), err, *asked)
+	}
+	wrong, _ := withPassphrase(dir, "two")
+	if _, err := wrong.Identity(); !errors.Is(err, ErrWrongPassphrase) {
+		t.Fatalf("expected ErrWrongPassphrase, got %v", err)
+	}
+	none := &File{KeyFile: f.KeyFile}
+	if _, err := none.Identity(); !errors.Is(err, ErrPassphraseRequired) {
+		t.Fatalf("expected ErrPassphraseRequired, got %v", err)
+	}
+
+	// Changing the passphrase re-encrypts both files.
+	if err := again.ChangePassphrase([]byte("two")); err != nil {
+		t.Fatalf("ChangePassphrase failed: %v", err)
+	}
+	if _, err := wrong.Identity(); err != nil {
+		t.Fatalf("new passphrase does not unlock the keys: %v", err)
+	}
+	if _, err := wrong.Sessions("dave"); err != nil {
+		t.Fatalf("new passphrase does not unlock the sessions: %v", err)
+	}
+	old, _ := withPassphrase(dir, "one")
+	if _, err := old.Identity(); !errors.Is(err, ErrWrongPassphrase) {
+		t.Fatalf("old passphrase still works: %v", err)
+	}
+
+	// An empty passphrase stores them unencrypted again.
+	if err := wrong.ChangePassphrase(nil); err != nil {
+		t.Fatalf("ChangePassphrase failed: %v", err)
+	}
+	if sealed(t, f.KeyFile) || sealed(t, f.SessionsFile) {
+		t.Fatal("files are still sealed")
+	}
+	if got, err := (&File{KeyFile: f.KeyFile}).Identity(); err != nil || !got.Key.Equal(id.Key) {
+		t.Fatalf("Identity after decrypting returned %v", err)
+	}
+}
+
+func TestFile_MigratesPlaintext(t *testing.T) {
+	ik := newX25519(t)
+	path := filepath.Join(t.TempDir(), "alice_private_keys.json")
+	writeJSON(t, path, map[string][]byte{"ika_priv": ik.Bytes()})
+
+	// Without a passphrase the file is left as it is.
+	if _, err := (&File{KeyFile: path}).Identity(); err != nil || sealed(t, path) {
+		t.Fatalf("Identity returned %v, or sealed the file without a passphrase", err)
+	}
+
+	pass := func(bool) ([]byte, error) { return []byte("pw"), nil }
+	if _, err := (&File{KeyFile: path, Passphrase: pass, Params: testParams}).Identity(); err != nil {
+		t.Fatalf("Identity failed: %v", err)
+	}
+	if !sealed(t, path) {
+		t.Fatal("plaintext key file was not encrypted")
+	}
+	data, _ := os.ReadFile(path)
+	if bytes.Contains(data, []byte("ika_priv")) {
+		t.Fatal("legacy layout leaked into the sealed file")
+	}
+	if id, err := (&File{KeyFile: path, Passphrase: pass}).Identity(); err != nil || !id.Key.Equal(ik) {
+		t.Fatalf("migrated keys do not load: %v", err)
+	}
+}
@@ -0,0 +1,201 @@
+// internal/keystore/keystore.go
+//
+// Package keystore stores the private key material of a device. A
+// KeyStore holds its identity, prekeys and sessions; File keeps them in
+// JSON files and Memory in memory.
+//
+// Files can be sealed under a passphrase. A sealed file is a JSON envelope: a versioned header naming
+// the KDF (Argon2id) with its parameters and salt, and the cipher
+// (XChaCha20-Poly1305) with its nonce, followed by the ciphertext. The
+// header is bound to the ciphertext as associated data, so tampering with
+// the parameters is detected like tampering with the keys themselves.
+//
+// Deriving a key is deliberately slow. A Key is therefore derived once per
+// passphrase and salt and then seals any number of files; each seal uses a
+// fresh nonce.
+package keystore
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	// Format identifies a sealed file.
+	Format = "x3dh-keystore"
+	// Version is the envelope version written by Seal.
+	Version = 1
+
+	kdfArgon2id = "argon2id"
+	cipherName  = "xchacha20-poly1305"
+	saltSize    = 16
+)
+
+var (
+	// ErrWrongPassphrase is returned when a file does not decrypt, either
+	// because the passphrase is wrong or because the file was modified.
+	ErrWrongPassphrase = errors.New("wrong passphrase or corrupted key file")
+	// ErrUnsupported is returned for envelopes of an unknown version, KDF or cipher.
+	ErrUnsupported = errors.New("unsupported key file format")
+	// ErrOtherKey is returned by Key.Open for a file sealed with another
+	// passphrase or salt; it has to be unlocked with Unlock instead.
+	ErrOtherKey = errors.New("file was sealed with another key")
+)
+
+// Params are the Argon2id cost parameters. Memory is in KiB.
+type Params struct {
+	Time    uint32 `json:"time"`
+	Memory  uint32 `json:"memory"`
+	Threads uint8  `json:"threads"`
+}
+
+// DefaultParams follow the second recommended option of RFC 9106 (64 MiB).
+var DefaultParams = Params{Time: 3, Memory: 64 * 1024, Threads: 4}
+
+// MaxParams bound the parameters a sealed file may ask for (1 GiB), so that
+// a corrupt or tampered header cannot make deriving its key exhaust memory
+// before the passphrase is even checked.
+var MaxParams = Params{Time: 10, Memory: 1024 * 1024, Threads: 255}
+
+// header is the unencrypted part of a sealed file.
+type header struct {
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+	KDF     string `json:"kdf"`
+	Params  Params `json:"kdf_params"`
+	Salt    []byte `json:"salt"`
+	Cipher  string `json:"cipher"`
+	Nonce   []byte `json:"nonce"`
+}
+
+type envelope struct {
+	header
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// associatedData is what the AEAD authenticates besides the ciphertext.
+func (h *header) associatedData() []byte {
+	ad, _ := json.Marshal(h)
+	return ad
+}
+
+// IsSealed reports whether data is a sealed file rather than plaintext.
+func IsSealed(data []byte) bool {
+	var h struct {
+		Format string `json:"format"`
+	}
+	return json.Unmarshal(data, &h) == nil && h.Format == Format
+}
+
+// Key is a key derived from a passphrase, together with the salt and
+// parameters it was derived with.
+type Key struct {
+	params Params
+	salt   []byte
+	aead   cipher.AEAD
+}
+
+// NewKey derives a key from passphrase with a fresh random salt.
+func NewKey(passphrase []byte, params Params) (*Key, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return deriveKey(passphrase, params, salt)
+}
+
+func deriveKey(passphrase []byte, params Params, salt []byte) (*Key, error) {
+	if params.Time == 0 || params.Memory == 0 || params.Threads == 0 ||
+		params.Time > MaxParams.Time || params.Memory > MaxParams.Memory || params.Threads > MaxParams.Threads {
+		return nil, fmt.Errorf("%w: invalid Argon2id parameters %+v", ErrUnsupported, params)
+	}
+	raw := argon2.IDKey(passphrase, salt, params.Time, params.Memory, params.Threads, chacha20poly1305.KeySize)
+	aead, err := chacha20poly1305.NewX(raw)
+	if err != nil {
+		return nil, err
+	}
+	return &Key{params: params, salt: salt, aead: aead}, nil
+}
+
+// Seal encrypts plaintext into a sealed file.
+func (k *Key) Seal(plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	env := envelope{header: header{
+		Format:  Format,
+		Version: Version,
+		KDF:     kdfArgon2id,
+		Params:  k.params,
+		Salt:    k.salt,
+		Cipher:  cipherName,
+		Nonce:   nonce,
+	}}
+	env.Ciphertext = k.aead.Seal(nil, nonce, plaintext, env.associatedData())
+	return json.MarshalIndent(env, "", "  ")
+}
+
+// Open decrypts a sealed file. It returns ErrOtherKey if the file was not
+// sealed with this key's salt and parameters.
+func (k *Key) Open(data []byte) ([]byte, error) {
+	env, err := parse(data)
+	if err != nil {
+		return nil, err
+	}
+	if env.Params != k.params || !bytes.Equal(env.Salt, k.salt) {
+		return nil, ErrOtherKey
+	}
+	return k.open(env)
+}
+
+func (k *Key) open(env *envelope) ([]byte, error) {
+	if len(env.Nonce) != k.aead.NonceSize() {
+		return nil, ErrWrongPassphrase
+	}
+	plaintext, err := k.aead.Open(nil, env.Nonce, env.Ciphertext, env.associatedData())
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	return plaintext, nil
+}
+
+// Unlock derives the key of a sealed file from passphrase and decrypts it.
+// The key can then open and seal other files without deriving it again.
+func Unlock(data, passphrase []byte) (*Key, []byte, error) {
+	env, err := parse(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	k, err := deriveKey(passphrase, env.Params, env.Salt)
+	if err != nil {
+		return nil, nil, err
+	}
+	plaintext, err := k.open(env)
+	if err != nil {
+		return nil, nil, err
+	}
+	return k, plaintext, nil
+}
+
+// parse reads and checks the envelope of a sealed file.
+func parse(data []byte) (*envelope, error) {
+	var env envelope
+	if err := json.Unmarshal(data, &env); err != nil || env.Format != Format {
+		return nil, fmt.Errorf("%w: not a sealed key file", ErrUnsupported)
+	}
+	if env.Version != Version {
+		return nil, fmt.Errorf("%w: version %d", ErrUnsupported, env.Version)
+	}
+	if env.KDF != kdfArgon2id || env.Cipher != cipherName {
+		return nil, fmt.Errorf("%w: %s with %s", ErrUnsupported, env.KDF, env.Cipher)
+	}
+	return &env, nil
+}
@@ -0,0 +1,95 @@
+package keystore
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+// testParams keep the tests fast; real files use DefaultParams.
+var testParams = Params{Time: 1, Memory: 64, Threads: 1}
+
+func TestSealOpen(t *testing.T) {
+	key, err := NewKey([]byte("correct horse"), testParams)
+	if err != nil {
+		t.Fatalf("NewKey failed: %v", err)
+	}
+	secret := []byte(`{"ik_priv":"c2VjcmV0"}`)
+	sealed, err := key.Seal(secret)
+	if err != nil {
+		t.Fatalf("Seal failed: %v", err)
+	}
+	if !IsSealed(sealed) || IsSealed(secret) {
+		t.Fatal("IsSealed does not tell sealed files from plaintext")
+	}
+	if bytes.Contains(sealed, []byte("c2VjcmV0")) {
+		t.Fatal("plaintext leaked into the sealed file")
+	}
+
+	// Reopening with the cached key and with the passphrase both work.
+	if plaintext, err := key.Open(sealed); err != nil || !bytes.Equal(plaintext, secret) {
+		t.Fatalf("Open returned %q, %v", plaintext, err)
+	}
+	unlocked, plaintext, err := Unlock(sealed, []byte("correct horse"))
+	if err != nil || !bytes.Equal(plaintext, secret) {
+		t.Fatalf("Unlock returned %q, %v", plaintext, err)
+	}
+	if other, _ := unlocked.Seal(secret); !bytes.Equal(mustOpen(t, key, other), secret) {
+		t.Fatal("unlocked key does not match the original")
+	}
+
+	if _, _, err := Unlock(sealed, []byte("wrong horse")); !errors.Is(err, ErrWrongPassphrase) {
+		t.Fatalf("expected ErrWrongPassphrase, got %v", err)
+	}
+	fresh, _ := NewKey([]byte("correct horse"), testParams)
+	if _, err := fresh.Open(sealed); !errors.Is(err, ErrOtherKey) {
+		t.Fatalf("expected ErrOtherKey for another salt, got %v", err)
+	}
+}
+
+func TestTamperedHeader(t *testing.T) {
+	key, _ := NewKey([]byte("pass"), testParams)
+	sealed, _ := key.Seal([]byte("secret"))
+
+	tamper := func(edit func(env map[string]interface{})) []byte {
+		var env map[string]interface{}
+		json.Unmarshal(sealed, &env)
+		edit(env)
+		data, _ := json.Marshal(env)
+		return data
+	}
+	// Weakening the KDF parameters is detected, not just ignored.
+	weaker := tamper(func(env map[string]interface{}) {
+		env["kdf_params"].(map[string]interface{})["time"] = 2
+	})
+	if _, _, err := Unlock(weaker, []byte("pass")); !errors.Is(err, ErrWrongPassphrase) {
+		t.Fatalf("expected ErrWrongPassphrase for changed parameters, got %v", err)
+	}
+	future := tamper(func(env map[string]interface{}) { env["version"] = Version + 1 })
+	if _, _, err := Unlock(future, []byte("pass")); !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("expected ErrUnsupported for a newer version, got %v", err)
+	}
+	// Costs beyond MaxParams are refused before any key is derived.
+	for name, value := range map[string]interface{}{"memory": 16 << 20, "time": 11} {
+		costly := tamper(func(env map[string]interface{}) {
+			env["kdf_params"].(map[string]interface{})[name] = value
+		})
+		if _, _, err := Unlock(costly, []byte("pass")); !errors.Is(err, ErrUnsupported) {
+			t.Fatalf("expected ErrUnsupported for a huge %s, got %v", name, err)
+		}
+	}
+	scrypt := tamper(func(env map[string]interface{}) { env["kdf"] = "scrypt" })
+	if _, err := key.Open(scrypt); !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("expected ErrUnsupported for another KDF, got %v", err)
+	}
+}
+
+func mustOpen(t *testing.T, key *Key, data []byte) []byte {
+	t.Helper()
+	plaintext, err := key.Open(data)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	return plaintext
+}
@@ -0,0 +1,97 @@
+// internal/keystore/memory.go
+package keystore
+
+import (
+	"crypto/ecdh"
+	"sync"
+	"time"
+)
+
+// Memory is a KeyStore that keeps everything in memory, for tests and for
+// clients that need nothing to outlive the process.
+type Memory struct {
+	mu       sync.Mutex
+	keys     *keyring
+	sessions map[string][]*Session
+}
+
+// NewMemory returns an empty in-memory key store.
+func NewMemory() *Memory {
+	return &Memory{keys: newKeyring(), sessions: make(map[string][]*Session)}
+}
+
+func (m *Memory) Identity() (*Identity, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.keys.identity()
+}
+
+func (m *Memory) SetIdentity(id *Identity) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.keys.setIdentity(id)
+	return nil
+}
+
+func (m *Memory) SignedPreKey(id uint32) (*SignedPreKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.keys.signedPreKey(id, time.Now())
+}
+
+func (m *Memory) CurrentSignedPreKey() (uint32, *SignedPreKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.keys.currentSignedPreKey(time.Now())
+}
+
+func (m *Memory) AddSignedPreKey(spk *SignedPreKey) (uint32, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.keys.pruneSignedPreKeys(time.Now())
+	return m.keys.addSignedPreKey(spk), nil
+}
+
+func (m *Memory) RetireSignedPreKey(id uint32, expires time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.keys.retireSignedPreKey(id, expires)
+}
+
+func (m *Memory) OneTimePreKey(id uint32) (*ecdh.PrivateKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.keys.oneTimePreKey(id)
+}
+
+func (m *Memory) AddOneTimePreKeys(keys []*ecdh.PrivateKey) ([]uint32, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.keys.addOneTimePreKeys(keys), nil
+}
+
+func (m *Memory) DeleteOneTimePreKey(id uint32) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.keys.OTKs, id)
+	return nil
+}
+
+func (m *Memory) Sessions(addr string) ([]*Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.sessions[addr], nil
+}
+
+func (m *Memory) SetSessions(addr string, sessions []*Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	setSessions(m.sessions, addr, sessions)
+	return nil
+}
+
+func (m *Memory) SessionAddresses() ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return sessionAddresses(m.sessions), nil
+}
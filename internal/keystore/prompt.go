@@ -0,0 +1,87 @@
+// internal/keystore/prompt.go
+package keystore
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// ErrNoTerminal is returned by ReadPassphrase when stdin is not a terminal.
+var ErrNoTerminal = errors.New("cannot ask for a passphrase: stdin is not a terminal")
+
+// ReadPassphrase asks for a passphrase on the terminal without echoing it.
+// With confirm it asks twice and fails if the answers differ.
+func ReadPassphrase(prompt string, confirm bool) ([]byte, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil, ErrNoTerminal
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	pass, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	if confirm && len(pass) > 0 {
+		fmt.Fprint(os.Stderr, "Repeat passphrase: ")
+		again, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(pass, again) {
+			return nil, errors.New("passphrases do not match")
+		}
+	}
+	return pass, nil
+}
+
+// Source returns the passphrase callback of a command-line program for
+// the key file at path: the fixed passphrase if one is configured,
+// otherwise one read from the terminal. When a new passphrase is being
+// chosen (create), an empty answer leaves the file unencrypted, and a key
+// file that already exists unencrypted is only encrypted with a fixed
+// passphrase; otherwise that is up to the program's passphrase command.
+// Without a terminal the passphrase is empty.
+func Source(fixed, path string) func(create bool) ([]byte, error) {
+	return func(create bool) ([]byte, error) {
+		if fixed != "" {
+			return []byte(fixed), nil
+		}
+		if create {
+			if _, err := os.Stat(path); err == nil {
+				return nil, nil
+			}
+		}
+		prompt := fmt.Sprintf("Passphrase for %s: ", path)
+		if create {
+			prompt = fmt.Sprintf("New passphrase for %s (empty to leave it unencrypted): ", path)
+		}
+		pass, err := ReadPassphrase(prompt, create)
+		if errors.Is(err, ErrNoTerminal) {
+			return nil, nil
+		}
+		return pass, err
+	}
+}
+
+// NewPassphrase asks for the new passphrase of the key file at path, on the
+// terminal if there is one and as a line of stdin otherwise. An empty one
+// means the file is stored unencrypted.
+func NewPassphrase(path string) ([]byte, error) {
+	pass, err := ReadPassphrase(fmt.Sprintf("New passphrase for %s (empty to store it unencrypted): ", path), true)
+	if !errors.Is(err, ErrNoTerminal) {
+		return pass, err
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return nil, fmt.Errorf("failed to read passphrase: %v", err)
+	}
+	return []byte(strings.TrimRight(line, "\r\n")), nil
+}
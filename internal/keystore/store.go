@@ -0,0 +1,239 @@
+// internal/keystore/store.go
+package keystore
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"x3dh-demo/internal/ratchet"
+)
+
+var (
+	// ErrNotFound is returned for an identity, prekey or session a KeyStore
+	// does not hold.
+	ErrNotFound = errors.New("not in key store")
+	// ErrUsedOneTimePreKey is returned for a one-time prekey that was
+	// deleted after it was used. A handshake that names it again is a
+	// replay or a duplicate.
+	ErrUsedOneTimePreKey = errors.New("one-time prekey was already used")
+)
+
+// Identity is a device's long-term keys: the X25519 identity key of its
+// handshakes and the Ed25519 key that signs its SPKs and relay logins.
+type Identity struct {
+	Key     *ecdh.PrivateKey
+	Signing ed25519.PrivateKey
+}
+
+// SignedPreKey is one of a device's signed prekeys. A retired SPK has an
+// ExpiresAt; it is kept until then so that handshakes already in flight
+// can still be accepted, and dropped afterwards.
+type SignedPreKey struct {
+	Key       *ecdh.PrivateKey
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// Session is a Double Ratchet session with one of a peer's devices,
+// started by an X3DH handshake.
+type Session struct {
+	PeerIdentity string           `json:"peer_identity"`       // hex X25519 identity key of the peer device
+	Handshake    string           `json:"handshake,omitempty"` // hex ephemeral key of the handshake accepted to start it
+	Ratchet      *ratchet.Session `json:"ratchet"`
+	Started      time.Time        `json:"started"`
+}
+
+// KeyStore holds the private key material of one device: its identity, its
+// signed and one-time prekeys by id, and its ratchet sessions by the
+// mailbox address of the peer device. Implementations are safe for
+// concurrent use.
+//
+// A session's ratchet advances with every message it encrypts or
+// decrypts; callers store it again with SetSessions after using it.
+type KeyStore interface {
+	// Identity returns the device's identity, or ErrNotFound if it has none yet.
+	Identity() (*Identity, error)
+	// SetIdentity stores the device's identity.
+	SetIdentity(id *Identity) error
+
+	// SignedPreKey returns the SPK with the given id, or ErrNotFound if
+	// there is none or it has expired.
+	SignedPreKey(id uint32) (*SignedPreKey, error)
+	// CurrentSignedPreKey returns the SPK the device's bundle advertises and
+	// its id, or ErrNotFound if the device has none.
+	CurrentSignedPreKey() (uint32, *SignedPreKey, error)
+	// AddSignedPreKey stores spk under a new id and makes it the current one.
+	AddSignedPreKey(spk *SignedPreKey) (uint32, error)
+	// RetireSignedPreKey sets when the SPK with the given id expires.
+	RetireSignedPreKey(id uint32, expires time.Time) error
+
+	// OneTimePreKey returns the private half of the one-time prekey with
+	// the given id, ErrUsedOneTimePreKey if it was deleted, or ErrNotFound
+	// if it was never stored.
+	OneTimePreKey(id uint32) (*ecdh.PrivateKey, error)
+	// AddOneTimePreKeys stores keys under new ids, in order, and returns the
+	// ids. Ids are never reused, not even after a key is deleted.
+	AddOneTimePreKeys(keys []*ecdh.PrivateKey) ([]uint32, error)
+	// DeleteOneTimePreKey removes a one-time prekey once it has been used.
+	DeleteOneTimePreKey(id uint32) error
+
+	// Sessions returns the sessions with the device at addr, the one last
+	// used first, or none.
+	Sessions(addr string) ([]*Session, error)
+	// SetSessions replaces the sessions with the device at addr. An empty
+	// list removes them.
+	SetSessions(addr string, sessions []*Session) error
+	// SessionAddresses lists the addresses there are sessions with.
+	SessionAddresses() ([]string, error)
+}
+
+// storedSPK is a signed prekey as a keyring holds it.
+type storedSPK struct {
+	Priv      []byte    `json:"priv"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at,omitempty"`
+}
+
+// keyring is the key material of a device, as Memory holds it and as File
+// stores it in its key file. Files written by the old alice and bob
+// programs and by older versions are migrated by File when loaded.
+type keyring struct {
+	IKPriv []byte `json:"ik_priv"`
+	// IKaPriv and IKbPriv are the identity keys of alice and bob key files;
+	// they are migrated into IKPriv on load.
+	IKaPriv []byte `json:"ika_priv,omitempty"`
+	IKbPriv []byte `json:"ikb_priv,omitempty"`
+	EdPriv  []byte `json:"ed_priv"`
+	// SPKbPriv is the single SPK written by older versions; it is migrated into SPKs on load.
+	SPKbPriv []byte `json:"spkb_priv,omitempty"`
+	// SPKs holds the current and still-valid retired signed prekeys by id.
+	SPKs         map[uint32]*storedSPK `json:"spks,omitempty"`
+	CurrentSPKID uint32                `json:"current_spk_id"`
+	// OTKbPriv is the single OTK written by older versions; it is migrated into OTKs on load.
+	OTKbPriv []byte `json:"otkb_priv,omitempty"`
+	// OTKs holds the private halves of the published one-time prekeys by id.
+	OTKs      map[uint32][]byte `json:"otks,omitempty"`
+	NextOTKID uint32            `json:"next_otk_id,omitempty"`
+}
+
+func newKeyring() *keyring {
+	return &keyring{
+		SPKs:      make(map[uint32]*storedSPK),
+		OTKs:      make(map[uint32][]byte),
+		NextOTKID: 1,
+	}
+}
+
+func (k *keyring) identity() (*Identity, error) {
+	if len(k.IKPriv) == 0 {
+		return nil, fmt.Errorf("%w: no identity", ErrNotFound)
+	}
+	ik, err := ecdh.X25519().NewPrivateKey(k.IKPriv)
+	if err != nil {
+		return nil, fmt.Errorf("invalid identity key: %v", err)
+	}
+	if len(k.EdPriv) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("invalid Ed25519 key")
+	}
+	return &Identity{Key: ik, Signing: ed25519.PrivateKey(k.EdPriv)}, nil
+}
+
+func (k *keyring) setIdentity(id *Identity) {
+	k.IKPriv, k.EdPriv = id.Key.Bytes(), id.Signing
+}
+
+func (k *keyring) signedPreKey(id uint32, now time.Time) (*SignedPreKey, error) {
+	stored := k.SPKs[id]
+	if stored == nil || !stored.ExpiresAt.IsZero() && now.After(stored.ExpiresAt) {
+		return nil, fmt.Errorf("%w: signed prekey %d", ErrNotFound, id)
+	}
+	priv, err := ecdh.X25519().NewPrivateKey(stored.Priv)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signed prekey %d: %v", id, err)
+	}
+	return &SignedPreKey{Key: priv, CreatedAt: stored.CreatedAt, ExpiresAt: stored.ExpiresAt}, nil
+}
+
+func (k *keyring) currentSignedPreKey(now time.Time) (uint32, *SignedPreKey, error) {
+	spk, err := k.signedPreKey(k.CurrentSPKID, now)
+	return k.CurrentSPKID, spk, err
+}
+
+func (k *keyring) addSignedPreKey(spk *SignedPreKey) uint32 {
+	var id uint32 = 1
+	for existing := range k.SPKs {
+		if existing >= id {
+			id = existing + 1
+		}
+	}
+	k.SPKs[id] = &storedSPK{Priv: spk.Key.Bytes(), CreatedAt: spk.CreatedAt, ExpiresAt: spk.ExpiresAt}
+	k.CurrentSPKID = id
+	return id
+}
+
+func (k *keyring) retireSignedPreKey(id uint32, expires time.Time) error {
+	stored := k.SPKs[id]
+	if stored == nil {
+		return fmt.Errorf("%w: signed prekey %d", ErrNotFound, id)
+	}
+	stored.ExpiresAt = expires
+	return nil
+}
+
+// pruneSignedPreKeys drops the retired SPKs whose grace period is over.
+func (k *keyring) pruneSignedPreKeys(now time.Time) {
+	for id, spk := range k.SPKs {
+		if id != k.CurrentSPKID && !spk.ExpiresAt.IsZero() && now.After(spk.ExpiresAt) {
+			delete(k.SPKs, id)
+		}
+	}
+}
+
+func (k *keyring) oneTimePreKey(id uint32) (*ecdh.PrivateKey, error) {
+	raw := k.OTKs[id]
+	// Ids are handed out in order, so a missing one below NextOTKID was used.
+	if raw == nil && id != 0 && id < k.NextOTKID {
+		return nil, fmt.Errorf("%w: id %d", ErrUsedOneTimePreKey, id)
+	}
+	if raw == nil {
+		return nil, fmt.Errorf("%w: one-time prekey %d", ErrNotFound, id)
+	}
+	priv, err := ecdh.X25519().NewPrivateKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid one-time prekey %d: %v", id, err)
+	}
+	return priv, nil
+}
+
+func (k *keyring) addOneTimePreKeys(keys []*ecdh.PrivateKey) []uint32 {
+	ids := make([]uint32, len(keys))
+	for i, priv := range keys {
+		ids[i] = k.NextOTKID
+		k.OTKs[k.NextOTKID] = priv.Bytes()
+		k.NextOTKID++
+	}
+	return ids
+}
+
+// sessionAddresses lists the addresses of sessions in order.
+func sessionAddresses(sessions map[string][]*Session) []string {
+	addrs := make([]string, 0, len(sessions))
+	for addr := range sessions {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// setSessions replaces the sessions of addr in sessions.
+func setSessions(sessions map[string][]*Session, addr string, list []*Session) {
+	if len(list) == 0 {
+		delete(sessions, addr)
+		return
+	}
+	sessions[addr] = list
+}
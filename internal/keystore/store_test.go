@@ -0,0 +1,114 @@
+package keystore
+
+import (
+	"crypto/ecdh"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestKeyStores runs the same checks against every implementation.
+func TestKeyStores(t *testing.T) {
+	stores := map[string]func(t *testing.T) KeyStore{
+		"memory": func(*testing.T) KeyStore { return NewMemory() },
+		"file": func(t *testing.T) KeyStore {
+			dir := t.TempDir()
+			return &File{KeyFile: filepath.Join(dir, "keys.json"), SessionsFile: filepath.Join(dir, "sessions.json")}
+		},
+	}
+	for name, open := range stores {
+		t.Run(name, func(t *testing.T) {
+			testKeyStore(t, open(t))
+		})
+	}
+}
+
+func testKeyStore(t *testing.T, s KeyStore) {
+	if _, err := s.Identity(); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound before SetIdentity, got %v", err)
+	}
+	id := newIdentity(t)
+	if err := s.SetIdentity(id); err != nil {
+		t.Fatalf("SetIdentity failed: %v", err)
+	}
+	if got, err := s.Identity(); err != nil || !got.Key.Equal(id.Key) || !got.Signing.Equal(id.Signing) {
+		t.Fatalf("Identity returned %v", err)
+	}
+
+	// Signed prekeys: a new one becomes current, a retired one expires.
+	if _, _, err := s.CurrentSignedPreKey(); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected no current SPK, got %v", err)
+	}
+	first := newX25519(t)
+	firstID, err := s.AddSignedPreKey(&SignedPreKey{Key: first, CreatedAt: time.Now()})
+	if err != nil || firstID != 1 {
+		t.Fatalf("AddSignedPreKey returned %d, %v", firstID, err)
+	}
+	if err := s.RetireSignedPreKey(firstID, time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("RetireSignedPreKey failed: %v", err)
+	}
+	secondID, err := s.AddSignedPreKey(&SignedPreKey{Key: newX25519(t), CreatedAt: time.Now()})
+	if err != nil || secondID != 2 {
+		t.Fatalf("AddSignedPreKey returned %d, %v", secondID, err)
+	}
+	if current, _, err := s.CurrentSignedPreKey(); err != nil || current != secondID {
+		t.Fatalf("CurrentSignedPreKey returned %d, %v", current, err)
+	}
+	if spk, err := s.SignedPreKey(firstID); err != nil || !spk.Key.Equal(first) || spk.ExpiresAt.IsZero() {
+		t.Fatalf("retired SPK should be kept for its grace period: %v", err)
+	}
+	if err := s.RetireSignedPreKey(firstID, time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.SignedPreKey(firstID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expired SPK should be gone, got %v", err)
+	}
+
+	// One-time prekeys are deleted once used.
+	otks := []*ecdh.PrivateKey{newX25519(t), newX25519(t)}
+	ids, err := s.AddOneTimePreKeys(otks)
+	if err != nil || len(ids) != 2 || ids[1] != ids[0]+1 {
+		t.Fatalf("AddOneTimePreKeys returned %v, %v", ids, err)
+	}
+	if otk, err := s.OneTimePreKey(ids[1]); err != nil || !otk.Equal(otks[1]) {
+		t.Fatalf("OneTimePreKey returned %v", err)
+	}
+	if err := s.DeleteOneTimePreKey(ids[1]); err != nil {
+		t.Fatalf("DeleteOneTimePreKey failed: %v", err)
+	}
+	if _, err := s.OneTimePreKey(ids[1]); !errors.Is(err, ErrUsedOneTimePreKey) {
+		t.Fatalf("expected ErrUsedOneTimePreKey for a deleted one-time prekey, got %v", err)
+	}
+	if _, err := s.OneTimePreKey(ids[1] + 1); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound for a one-time prekey never stored, got %v", err)
+	}
+	if next, _ := s.AddOneTimePreKeys([]*ecdh.PrivateKey{newX25519(t)}); next[0] != ids[1]+1 {
+		t.Fatalf("one-time prekey ids should not be reused, got %v", next)
+	}
+	if _, err := s.OneTimePreKey(ids[0]); err != nil {
+		t.Fatalf("other one-time prekey was deleted too: %v", err)
+	}
+
+	// Sessions by peer address.
+	if list, err := s.Sessions("dave"); err != nil || len(list) != 0 {
+		t.Fatalf("expected no sessions, got %d, %v", len(list), err)
+	}
+	for _, addr := range []string{"dave/phone", "dave"} {
+		if err := s.SetSessions(addr, []*Session{{PeerIdentity: addr, Started: time.Now()}}); err != nil {
+			t.Fatalf("SetSessions failed: %v", err)
+		}
+	}
+	if addrs, err := s.SessionAddresses(); err != nil || len(addrs) != 2 || addrs[0] != "dave" {
+		t.Fatalf("SessionAddresses returned %v, %v", addrs, err)
+	}
+	if err := s.SetSessions("dave", nil); err != nil {
+		t.Fatal(err)
+	}
+	if list, _ := s.Sessions("dave/phone"); len(list) != 1 || list[0].PeerIdentity != "dave/phone" {
+		t.Fatalf("unexpected sessions %+v", list)
+	}
+	if addrs, _ := s.SessionAddresses(); len(addrs) != 1 {
+		t.Fatalf("removed sessions are still listed: %v", addrs)
+	}
+}
@@ -0,0 +1,371 @@
+// internal/ratchet/ratchet.go
+//
+// Package ratchet implements the Double Ratchet algorithm on top of the
+// shared secret produced by an X3DH handshake. The initiator seeds its first
+// DH ratchet step with the responder's signed prekey, and the responder
+// starts with that SPK as its ratchet key pair.
+package ratchet
+
+import (
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+	"x3dh-demo/internal/x3dh"
+)
+
+const (
+	// MaxSkip is the largest number of message keys skipped in a single chain.
+	// It bounds the work a malicious header can force on the receiver.
+	MaxSkip = 1000
+	// MaxSkippedKeys is the total number of skipped message keys kept around;
+	// the oldest are evicted first.
+	MaxSkippedKeys = 2000
+
+	rootInfo = "x3dh-demo-ratchet"
+)
+
+var (
+	// ErrTooManySkipped is returned when a message would require skipping more than MaxSkip keys.
+	ErrTooManySkipped = errors.New("too many skipped messages")
+	// ErrReplayedMessage is returned for a message whose key was already used.
+	ErrReplayedMessage = errors.New("message already received or its key was discarded")
+	// ErrNoSendingChain is returned when a responder tries to send before receiving anything.
+	ErrNoSendingChain = errors.New("no sending chain yet: wait for the first message from the peer")
+)
+
+// Header is sent in the clear with every ratchet message.
+type Header struct {
+	DH string `json:"dh"` // sender's current ratchet public key
+	PN uint32 `json:"pn"` // number of messages in the sender's previous sending chain
+	N  uint32 `json:"n"`  // message number in the current sending chain
+}
+
+// Message is an encrypted ratchet message.
+type Message struct {
+	Header     Header `json:"header"`
+	Nonce      string `json:"nonce"`
+	Ciphertext string `json:"ciphertext"`
+}
+
+// skippedKey is a stored message key for a message that has not arrived yet.
+type skippedKey struct {
+	DH [32]byte
+	N  uint32
+	MK [32]byte
+}
+
+// Session holds the Double Ratchet state of one side of a conversation.
+// It is not safe for concurrent use.
+type Session struct {
+	dhs     *ecdh.PrivateKey
+	dhr     [32]byte
+	hasDHr  bool
+	rk      [32]byte
+	cks     [32]byte
+	hasCKs  bool
+	ckr     [32]byte
+	hasCKr  bool
+	ns, nr  uint32
+	pn      uint32
+	ad      []byte
+	skipped []skippedKey
+}
+
+// NewInitiator creates the ratchet for the X3DH initiator from the shared
+// secret sk, the X3DH associated data and the responder's signed prekey.
+func NewInitiator(sk [32]byte, ad []byte, remoteSPK [32]byte) (*Session, error) {
+	dhs, _, err := x3dh.GenKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	s := &Session{dhs: dhs, dhr: remoteSPK, hasDHr: true, ad: append([]byte(nil), ad...)}
+	dh, err := x3dh.DH(s.dhs, &s.dhr)
+	if err != nil {
+		return nil, err
+	}
+	s.rk, s.cks = kdfRK(sk, dh)
+	s.hasCKs = true
+	return s, nil
+}
+
+// NewResponder creates the ratchet for the X3DH responder from the shared
+// secret sk, the X3DH associated data and the private signed prekey the
+// initiator used.
+func NewResponder(sk [32]byte, ad []byte, spk *ecdh.PrivateKey) (*Session, error) {
+	if spk == nil {
+		return nil, fmt.Errorf("signed prekey is nil")
+	}
+	return &Session{dhs: spk, rk: sk, ad: append([]byte(nil), ad...)}, nil
+}
+
+// Encrypt advances the sending chain and encrypts plaintext.
+func (s *Session) Encrypt(plaintext []byte) (*Message, error) {
+	if !s.hasCKs {
+		return nil, ErrNoSendingChain
+	}
+	var mk [32]byte
+	s.cks, mk = kdfCK(s.cks)
+	h := Header{DH: x3dh.EncodePublicKey(x3dh.PublicKey(s.dhs)), PN: s.pn, N: s.ns}
+	s.ns++
+	nonce, ciphertext, err := x3dh.Encrypt(mk, plaintext, s.associatedData(h))
+	if err != nil {
+		return nil, err
+	}
+	return &Message{Header: h, Nonce: hex.EncodeToString(nonce), Ciphertext: hex.EncodeToString(ciphertext)}, nil
+}
+
+// Decrypt decrypts m, performing a DH ratchet step if the sender has a new
+// ratchet key. The session is left untouched if decryption fails.
+func (s *Session) Decrypt(m *Message) ([]byte, error) {
+	dh, err := x3dh.DecodePublicKey(m.Header.DH)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ratchet key: %v", err)
+	}
+	nonce, err := hex.DecodeString(m.Nonce)
+	if err != nil {
+		return nil, fmt.Errorf("invalid nonce encoding: %v", err)
+	}
+	ciphertext, err := hex.DecodeString(m.Ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ciphertext encoding: %v", err)
+	}
+	ad := s.associatedData(m.Header)
+
+	for i, sk := range s.skipped {
+		if sk.DH == dh && sk.N == m.Header.N {
+			plaintext, err := x3dh.Decrypt(sk.MK, nonce, ciphertext, ad)
+			if err != nil {
+				return nil, err
+			}
+			s.skipped = append(s.skipped[:i:i], s.skipped[i+1:]...)
+			return plaintext, nil
+		}
+	}
+
+	// Work on a copy so a forged message cannot corrupt the session.
+	next := s.clone()
+	if !next.hasDHr || dh != next.dhr {
+		if err := next.skipMessageKeys(m.Header.PN); err != nil {
+			return nil, err
+		}
+		if err := next.dhRatchet(dh); err != nil {
+			return nil, err
+		}
+	}
+	if m.Header.N < next.nr {
+		return nil, ErrReplayedMessage
+	}
+	if err := next.skipMessageKeys(m.Header.N); err != nil {
+		return nil, err
+	}
+	var mk [32]byte
+	next.ckr, mk = kdfCK(next.ckr)
+	next.nr++
+	plaintext, err := x3dh.Decrypt(mk, nonce, ciphertext, ad)
+	if err != nil {
+		return nil, err
+	}
+	*s = *next
+	return plaintext, nil
+}
+
+// skipMessageKeys stores the receiving chain's message keys up to (not including) until.
+func (s *Session) skipMessageKeys(until uint32) error {
+	if !s.hasCKr || until <= s.nr {
+		return nil
+	}
+	if until-s.nr > MaxSkip {
+		return ErrTooManySkipped
+	}
+	for s.nr < until {
+		var mk [32]byte
+		s.ckr, mk = kdfCK(s.ckr)
+		s.skipped = append(s.skipped, skippedKey{DH: s.dhr, N: s.nr, MK: mk})
+		s.nr++
+	}
+	if extra := len(s.skipped) - MaxSkippedKeys; extra > 0 {
+		s.skipped = append([]skippedKey(nil), s.skipped[extra:]...)
+	}
+	return nil
+}
+
+// dhRatchet performs a DH ratchet step for the peer's new ratchet key.
+func (s *Session) dhRatchet(dh [32]byte) error {
+	s.pn = s.ns
+	s.ns, s.nr = 0, 0
+	s.dhr, s.hasDHr = dh, true
+
+	out, err := x3dh.DH(s.dhs, &s.dhr)
+	if err != nil {
+		return err
+	}
+	s.rk, s.ckr = kdfRK(s.rk, out)
+	s.hasCKr = true
+
+	if s.dhs, _, err = x3dh.GenKeyPair(); err != nil {
+		return err
+	}
+	if out, err = x3dh.DH(s.dhs, &s.dhr); err != nil {
+		return err
+	}
+	s.rk, s.cks = kdfRK(s.rk, out)
+	s.hasCKs = true
+	return nil
+}
+
+// associatedData binds the X3DH associated data and the message header.
+func (s *Session) associatedData(h Header) []byte {
+	ad := make([]byte, 0, len(s.ad)+len(h.DH)+8)
+	ad = append(ad, s.ad...)
+	ad = append(ad, h.DH...)
+	ad = binary.BigEndian.AppendUint32(ad, h.PN)
+	ad = binary.BigEndian.AppendUint32(ad, h.N)
+	return ad
+}
+
+func (s *Session) clone() *Session {
+	c := *s
+	c.skipped = append([]skippedKey(nil), s.skipped...)
+	return &c
+}
+
+// kdfRK derives a new root key and chain key from the root key and a DH output.
+func kdfRK(rk, dh [32]byte) (newRK, ck [32]byte) {
+	r := hkdf.New(sha256.New, dh[:], rk[:], []byte(rootInfo))
+	var out [64]byte
+	if _, err := io.ReadFull(r, out[:]); err != nil {
+		// HKDF-SHA256 can always produce 64 bytes.
+		panic(err)
+	}
+	copy(newRK[:], out[:32])
+	copy(ck[:], out[32:])
+	return
+}
+
+// kdfCK derives the next chain key and a message key from a chain key.
+func kdfCK(ck [32]byte) (nextCK, mk [32]byte) {
+	m := hmac.New(sha256.New, ck[:])
+	m.Write([]byte{0x01})
+	copy(mk[:], m.Sum(nil))
+	m.Reset()
+	m.Write([]byte{0x02})
+	copy(nextCK[:], m.Sum(nil))
+	return
+}
+
+// --- Serialization ---
+
+type skippedKeyJSON struct {
+	DH string `json:"dh"`
+	N  uint32 `json:"n"`
+	MK string `json:"mk"`
+}
+
+type sessionJSON struct {
+	DHs     string           `json:"dhs"`
+	DHr     string           `json:"dhr,omitempty"`
+	RK      string           `json:"rk"`
+	CKs     string           `json:"cks,omitempty"`
+	CKr     string           `json:"ckr,omitempty"`
+	Ns      uint32           `json:"ns"`
+	Nr      uint32           `json:"nr"`
+	PN      uint32           `json:"pn"`
+	AD      string           `json:"ad"`
+	Skipped []skippedKeyJSON `json:"skipped,omitempty"`
+}
+
+// MarshalJSON serializes the full session state, including private keys.
+// Store the result with the same care as any other private key material.
+func (s *Session) MarshalJSON() ([]byte, error) {
+	v := sessionJSON{
+		DHs: hex.EncodeToString(s.dhs.Bytes()),
+		RK:  hex.EncodeToString(s.rk[:]),
+		Ns:  s.ns,
+		Nr:  s.nr,
+		PN:  s.pn,
+		AD:  hex.EncodeToString(s.ad),
+	}
+	if s.hasDHr {
+		v.DHr = hex.EncodeToString(s.dhr[:])
+	}
+	if s.hasCKs {
+		v.CKs = hex.EncodeToString(s.cks[:])
+	}
+	if s.hasCKr {
+		v.CKr = hex.EncodeToString(s.ckr[:])
+	}
+	for _, sk := range s.skipped {
+		v.Skipped = append(v.Skipped, skippedKeyJSON{
+			DH: hex.EncodeToString(sk.DH[:]),
+			N:  sk.N,
+			MK: hex.EncodeToString(sk.MK[:]),
+		})
+	}
+	return json.Marshal(v)
+}
+
+// UnmarshalJSON restores a session serialized with MarshalJSON.
+func (s *Session) UnmarshalJSON(data []byte) error {
+	var v sessionJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	raw, err := hex.DecodeString(v.DHs)
+	if err != nil {
+		return fmt.Errorf("invalid ratchet private key: %v", err)
+	}
+	dhs, err := ecdh.X25519().NewPrivateKey(raw)
+	if err != nil {
+		return fmt.Errorf("invalid ratchet private key: %v", err)
+	}
+	ad, err := hex.DecodeString(v.AD)
+	if err != nil {
+		return fmt.Errorf("invalid associated data: %v", err)
+	}
+	out := Session{dhs: dhs, ns: v.Ns, nr: v.Nr, pn: v.PN, ad: ad}
+	if out.rk, err = decodeKey(v.RK); err != nil {
+		return fmt.Errorf("invalid root key: %v", err)
+	}
+	if v.DHr != "" {
+		if out.dhr, err = decodeKey(v.DHr); err != nil {
+			return fmt.Errorf("invalid remote ratchet key: %v", err)
+		}
+		out.hasDHr = true
+	}
+	if v.CKs != "" {
+		if out.cks, err = decodeKey(v.CKs); err != nil {
+			return fmt.Errorf("invalid sending chain key: %v", err)
+		}
+		out.hasCKs = true
+	}
+	if v.CKr != "" {
+		if out.ckr, err = decodeKey(v.CKr); err != nil {
+			return fmt.Errorf("invalid receiving chain key: %v", err)
+		}
+		out.hasCKr = true
+	}
+	for _, sk := range v.Skipped {
+		entry := skippedKey{N: sk.N}
+		if entry.DH, err = decodeKey(sk.DH); err != nil {
+			return fmt.Errorf("invalid skipped key: %v", err)
+		}
+		if entry.MK, err = decodeKey(sk.MK); err != nil {
+			return fmt.Errorf("invalid skipped key: %v", err)
+		}
+		out.skipped = append(out.skipped, entry)
+	}
+	*s = out
+	return nil
+}
+
+func decodeKey(s string) ([32]byte, error) {
+	return x3dh.DecodePublicKey(s)
+}
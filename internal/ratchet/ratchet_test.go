@@ -0,0 +1,138 @@
+package ratchet
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"x3dh-demo/internal/x3dh"
+)
+
+// newPair runs an X3DH handshake and seeds both ratchets from it.
+func newPair(t *testing.T) (alice, bob *Session) {
+	t.Helper()
+	ik, ikPub, _ := x3dh.GenKeyPair()
+	spk, spkPub, _ := x3dh.GenKeyPair()
+	edPub, edPriv, _ := ed25519.GenerateKey(rand.Reader)
+	bundle := &x3dh.Bundle{
+		IK:      x3dh.EncodePublicKey(ikPub),
+		SPK:     x3dh.EncodePublicKey(spkPub),
+		SPKID:   1,
+		Ed25519: hex.EncodeToString(edPub),
+		Sig:     hex.EncodeToString(ed25519.Sign(edPriv, spkPub[:])),
+	}
+	aliceIK, _, _ := x3dh.GenKeyPair()
+
+	aliceX3DH, msg, err := x3dh.InitiateSession(aliceIK, bundle, []byte("hello"))
+	if err != nil {
+		t.Fatalf("InitiateSession failed: %v", err)
+	}
+	keys := &x3dh.ResponderKeys{Identity: ik, SignedPreKeys: map[uint32]*ecdh.PrivateKey{1: spk}}
+	bobX3DH, _, err := x3dh.AcceptSession(keys, msg)
+	if err != nil {
+		t.Fatalf("AcceptSession failed: %v", err)
+	}
+
+	if alice, err = NewInitiator(aliceX3DH.Key, aliceX3DH.AD, spkPub); err != nil {
+		t.Fatalf("NewInitiator failed: %v", err)
+	}
+	if bob, err = NewResponder(bobX3DH.Key, bobX3DH.AD, spk); err != nil {
+		t.Fatalf("NewResponder failed: %v", err)
+	}
+	return alice, bob
+}
+
+func mustEncrypt(t *testing.T, s *Session, text string) *Message {
+	t.Helper()
+	m, err := s.Encrypt([]byte(text))
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	return m
+}
+
+func mustDecrypt(t *testing.T, s *Session, m *Message, want string) {
+	t.Helper()
+	got, err := s.Decrypt(m)
+	if err != nil {
+		t.Fatalf("Decrypt failed: %v", err)
+	}
+	if string(got) != want {
+		t.Fatalf("plaintext mismatch: got %q, want %q", got, want)
+	}
+}
+
+func TestRatchet_Conversation(t *testing.T) {
+	alice, bob := newPair(t)
+	if _, err := bob.Encrypt([]byte("too early")); !errors.Is(err, ErrNoSendingChain) {
+		t.Fatalf("expected ErrNoSendingChain, got %v", err)
+	}
+	mustDecrypt(t, bob, mustEncrypt(t, alice, "a1"), "a1")
+	mustDecrypt(t, bob, mustEncrypt(t, alice, "a2"), "a2")
+	mustDecrypt(t, alice, mustEncrypt(t, bob, "b1"), "b1")
+	mustDecrypt(t, bob, mustEncrypt(t, alice, "a3"), "a3")
+	mustDecrypt(t, alice, mustEncrypt(t, bob, "b2"), "b2")
+}
+
+func TestRatchet_OutOfOrder(t *testing.T) {
+	alice, bob := newPair(t)
+	m1 := mustEncrypt(t, alice, "1")
+	m2 := mustEncrypt(t, alice, "2")
+	m3 := mustEncrypt(t, alice, "3")
+	mustDecrypt(t, bob, m3, "3")
+	reply := mustEncrypt(t, bob, "r")
+	mustDecrypt(t, alice, reply, "r")
+	m4 := mustEncrypt(t, alice, "4")
+	mustDecrypt(t, bob, m4, "4")
+	mustDecrypt(t, bob, m1, "1")
+	mustDecrypt(t, bob, m2, "2")
+
+	if _, err := bob.Decrypt(m2); err == nil {
+		t.Fatal("replayed message should not decrypt")
+	}
+}
+
+func TestRatchet_SkipLimit(t *testing.T) {
+	alice, bob := newPair(t)
+	mustDecrypt(t, bob, mustEncrypt(t, alice, "first"), "first")
+	var last *Message
+	for i := 0; i < MaxSkip+2; i++ {
+		last = mustEncrypt(t, alice, "x")
+	}
+	if _, err := bob.Decrypt(last); !errors.Is(err, ErrTooManySkipped) {
+		t.Fatalf("expected ErrTooManySkipped, got %v", err)
+	}
+}
+
+func TestRatchet_TamperedMessageKeepsState(t *testing.T) {
+	alice, bob := newPair(t)
+	m := mustEncrypt(t, alice, "secret")
+	bad := *m
+	bad.Ciphertext = hex.EncodeToString(make([]byte, 32))
+	if _, err := bob.Decrypt(&bad); err == nil {
+		t.Fatal("tampered message should not decrypt")
+	}
+	mustDecrypt(t, bob, m, "secret")
+}
+
+func TestRatchet_Serialization(t *testing.T) {
+	alice, bob := newPair(t)
+	mustDecrypt(t, bob, mustEncrypt(t, alice, "a1"), "a1")
+	skipped := mustEncrypt(t, alice, "a2")
+	mustDecrypt(t, bob, mustEncrypt(t, alice, "a3"), "a3")
+
+	data, err := json.Marshal(bob)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	var restored Session
+	if err := json.Unmarshal(data, &restored); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	mustDecrypt(t, &restored, skipped, "a2")
+	mustDecrypt(t, alice, mustEncrypt(t, &restored, "b1"), "b1")
+}
@@ -0,0 +1,99 @@
+// internal/user/contacts.go
+package user
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Contact is someone the user has exchanged messages with.
+type Contact struct {
+	// Devices maps each of the contact's devices to the identity key
+	// (hex X25519) pinned the first time a message was exchanged with it.
+	Devices  map[string]string `json:"devices,omitempty"`
+	LastSeen time.Time         `json:"last_seen"`
+}
+
+// Contacts maps user names to what is known about them.
+type Contacts map[string]*Contact
+
+// LoadContacts reads a contacts file. A missing file means no contacts yet.
+func LoadContacts(path string) (Contacts, error) {
+	blob, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return make(Contacts), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	contacts := make(Contacts)
+	if err := json.Unmarshal(blob, &contacts); err != nil {
+		return nil, fmt.Errorf("invalid contacts file %s: %v", path, err)
+	}
+	return contacts, nil
+}
+
+// Save writes the contacts to path, creating its directory if needed.
+func (c Contacts) Save(path string) error {
+	blob, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, blob, 0600)
+}
+
+// Names returns the contacts' user names in order.
+func (c Contacts) Names() []string {
+	names := make([]string, 0, len(c))
+	for name := range c {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (c Contacts) get(name string) *Contact {
+	contact := c[name]
+	if contact == nil {
+		contact = &Contact{}
+		c[name] = contact
+	}
+	return contact
+}
+
+// Check returns ErrIdentityChanged if a contact's device has an identity
+// key other than ik pinned. It does not pin ik.
+func (c Contacts) Check(name, device, ik string) error {
+	if contact := c[name]; contact != nil {
+		if pinned, ok := contact.Devices[device]; ok && pinned != ik {
+			return fmt.Errorf("%w: %s device %s", ErrIdentityChanged, name, device)
+		}
+	}
+	return nil
+}
+
+// Pin records ik as the identity key of a contact's device on first use. It
+// returns ErrIdentityChanged if the device already has a different key.
+func (c Contacts) Pin(name, device, ik string) error {
+	if err := c.Check(name, device, ik); err != nil {
+		return err
+	}
+	contact := c.get(name)
+	if contact.Devices == nil {
+		contact.Devices = make(map[string]string)
+	}
+	contact.Devices[device] = ik
+	return nil
+}
+
+// Seen notes that a message was exchanged with name at the given time.
+func (c Contacts) Seen(name string, at time.Time) {
+	c.get(name).LastSeen = at
+}
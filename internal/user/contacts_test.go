@@ -0,0 +1,52 @@
+package user
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestContacts_Pin(t *testing.T) {
+	contacts := make(Contacts)
+	if err := contacts.Pin("bob", "default", "aa"); err != nil {
+		t.Fatalf("first Pin failed: %v", err)
+	}
+	if err := contacts.Pin("bob", "default", "aa"); err != nil {
+		t.Fatalf("Pin with the same key failed: %v", err)
+	}
+	if err := contacts.Pin("bob", "phone", "bb"); err != nil {
+		t.Fatalf("Pin of a second device failed: %v", err)
+	}
+	if err := contacts.Pin("bob", "default", "cc"); !errors.Is(err, ErrIdentityChanged) {
+		t.Fatalf("expected ErrIdentityChanged, got %v", err)
+	}
+	if contacts["bob"].Devices["default"] != "aa" {
+		t.Fatal("a changed key must not replace the pinned one")
+	}
+}
+
+func TestContacts_SaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dave", "contacts.json")
+	empty, err := LoadContacts(path)
+	if err != nil || len(empty) != 0 {
+		t.Fatalf("missing file should mean no contacts, got %v, %v", empty, err)
+	}
+
+	contacts := make(Contacts)
+	contacts.Pin("carol", "default", "aa")
+	contacts.Seen("alice", time.Unix(1700000000, 0))
+	if err := contacts.Save(path); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	loaded, err := LoadContacts(path)
+	if err != nil {
+		t.Fatalf("LoadContacts failed: %v", err)
+	}
+	if names := loaded.Names(); len(names) != 2 || names[0] != "alice" || names[1] != "carol" {
+		t.Fatalf("unexpected contacts %v", names)
+	}
+	if loaded["carol"].Devices["default"] != "aa" || loaded["alice"].LastSeen.Unix() != 1700000000 {
+		t.Fatalf("contacts did not round-trip: %+v", loaded)
+	}
+}
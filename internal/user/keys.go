@@ -0,0 +1,111 @@
+// internal/user/keys.go
+package user
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"x3dh-demo/internal/keystore"
+	"x3dh-demo/internal/x3dh"
+)
+
+// newIdentity generates a fresh identity key and Ed25519 signing key.
+func newIdentity() (*keystore.Identity, error) {
+	ik, _, err := x3dh.GenKeyPair()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate identity key: %v", err)
+	}
+	_, edPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate Ed25519 key: %v", err)
+	}
+	return &keystore.Identity{Key: ik, Signing: edPriv}, nil
+}
+
+// addSPK generates a new signed prekey, makes it current and returns its id.
+func addSPK(store keystore.KeyStore) (uint32, error) {
+	priv, _, err := x3dh.GenKeyPair()
+	if err != nil {
+		return 0, fmt.Errorf("failed to generate signed prekey: %v", err)
+	}
+	return store.AddSignedPreKey(&keystore.SignedPreKey{Key: priv, CreatedAt: time.Now()})
+}
+
+// generateOTKs creates n new one-time prekeys, stores their private halves
+// and returns the public halves ready for upload.
+func generateOTKs(store keystore.KeyStore, n int) ([]x3dh.OneTimePreKey, error) {
+	privs := make([]*ecdh.PrivateKey, n)
+	for i := range privs {
+		priv, _, err := x3dh.GenKeyPair()
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate one-time prekey: %v", err)
+		}
+		privs[i] = priv
+	}
+	ids, err := store.AddOneTimePreKeys(privs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store one-time prekeys: %v", err)
+	}
+	otks := make([]x3dh.OneTimePreKey, n)
+	for i, priv := range privs {
+		otks[i] = x3dh.OneTimePreKey{ID: ids[i], Key: x3dh.EncodePublicKey(x3dh.PublicKey(priv))}
+	}
+	return otks, nil
+}
+
+// deviceBundle assembles the device's public bundle around the current
+// SPK, signing the SPK with the Ed25519 key.
+func deviceBundle(store keystore.KeyStore) (x3dh.Bundle, error) {
+	id, err := store.Identity()
+	if err != nil {
+		return x3dh.Bundle{}, err
+	}
+	spkID, spk, err := store.CurrentSignedPreKey()
+	if err != nil {
+		return x3dh.Bundle{}, err
+	}
+	spkPub := x3dh.PublicKey(spk.Key)
+	return x3dh.Bundle{
+		IK:      x3dh.EncodePublicKey(x3dh.PublicKey(id.Key)),
+		SPK:     x3dh.EncodePublicKey(spkPub),
+		SPKID:   spkID,
+		Ed25519: hex.EncodeToString(id.Signing.Public().(ed25519.PublicKey)),
+		Sig:     hex.EncodeToString(ed25519.Sign(id.Signing, spkPub[:])),
+	}, nil
+}
+
+// responderKeys returns the private keys needed to accept msg: the identity
+// and the prekeys it names. A prekey the store does not hold is left out,
+// so that AcceptSession reports it as unknown; a one-time prekey that was
+// already used is reported with keystore.ErrUsedOneTimePreKey.
+func responderKeys(store keystore.KeyStore, msg *x3dh.InitialMessage) (*x3dh.ResponderKeys, error) {
+	id, err := store.Identity()
+	if err != nil {
+		return nil, err
+	}
+	keys := &x3dh.ResponderKeys{
+		Identity:       id.Key,
+		SignedPreKeys:  make(map[uint32]*ecdh.PrivateKey, 1),
+		OneTimePreKeys: make(map[uint32]*ecdh.PrivateKey, 1),
+	}
+	spk, err := store.SignedPreKey(msg.SPKID)
+	if err == nil {
+		keys.SignedPreKeys[msg.SPKID] = spk.Key
+	} else if !errors.Is(err, keystore.ErrNotFound) {
+		return nil, err
+	}
+	if msg.OTKID != 0 {
+		otk, err := store.OneTimePreKey(msg.OTKID)
+		if err == nil {
+			keys.OneTimePreKeys[msg.OTKID] = otk
+		} else if !errors.Is(err, keystore.ErrNotFound) {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
@@ -0,0 +1,46 @@
+package user
+
+import (
+	"errors"
+	"testing"
+
+	"x3dh-demo/internal/keystore"
+	"x3dh-demo/internal/x3dh"
+)
+
+func TestKeys_Bundle(t *testing.T) {
+	carol := &User{Name: "carol", Store: keystore.NewMemory()}
+	if _, err := carol.Identity(); !errors.Is(err, ErrNoKeys) {
+		t.Fatalf("expected ErrNoKeys, got %v", err)
+	}
+	if err := carol.Init(); err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+	otks, err := generateOTKs(carol.Store, 3)
+	if err != nil {
+		t.Fatalf("generateOTKs failed: %v", err)
+	}
+	if otks[0].ID != 1 || otks[2].ID != 3 {
+		t.Fatalf("unexpected OTK ids %d..%d", otks[0].ID, otks[2].ID)
+	}
+	bundle, err := deviceBundle(carol.Store)
+	if err != nil {
+		t.Fatalf("deviceBundle failed: %v", err)
+	}
+	if err := x3dh.ValidateBundle(&bundle); err != nil {
+		t.Fatalf("bundle does not validate: %v", err)
+	}
+
+	// Only the prekeys a message names are looked up.
+	keys, err := responderKeys(carol.Store, &x3dh.InitialMessage{SPKID: bundle.SPKID, OTKID: 2})
+	if err != nil {
+		t.Fatalf("responderKeys failed: %v", err)
+	}
+	if keys.SignedPreKeys[bundle.SPKID] == nil || keys.OneTimePreKeys[2] == nil || len(keys.OneTimePreKeys) != 1 {
+		t.Fatalf("unexpected responder keys %+v", keys)
+	}
+	keys, err = responderKeys(carol.Store, &x3dh.InitialMessage{SPKID: 7, OTKID: 9})
+	if err != nil || len(keys.SignedPreKeys) != 0 || len(keys.OneTimePreKeys) != 0 {
+		t.Fatalf("unknown prekeys should be left out, got %+v, %v", keys, err)
+	}
+}
@@ -0,0 +1,99 @@
+// internal/user/sessions.go
+package user
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"x3dh-demo/internal/keystore"
+	"x3dh-demo/internal/ratchet"
+)
+
+// maxSessions is how many sessions are kept per peer device. Two devices
+// that start a handshake with each other at the same time end up with two
+// sessions; keeping a few lets either one be used until they settle.
+const maxSessions = 3
+
+// addSession makes session the current one for addr, dropping the oldest
+// beyond maxSessions.
+func addSession(store keystore.KeyStore, addr string, session *keystore.Session) error {
+	list, err := store.Sessions(addr)
+	if err != nil {
+		return err
+	}
+	list = append([]*keystore.Session{session}, list...)
+	if len(list) > maxSessions {
+		list = list[:maxSessions]
+	}
+	return store.SetSessions(addr, list)
+}
+
+// hasSession reports whether one of the sessions with addr was accepted
+// from the handshake with the ephemeral key ek.
+func hasSession(store keystore.KeyStore, addr, ek string) (bool, error) {
+	list, err := store.Sessions(addr)
+	if err != nil {
+		return false, err
+	}
+	for _, session := range list {
+		if session.Handshake == ek {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// useSession moves the i-th session of list to the front and stores the list.
+func useSession(store keystore.KeyStore, addr string, list []*keystore.Session, i int) error {
+	session := list[i]
+	list = append([]*keystore.Session{session}, append(list[:i:i], list[i+1:]...)...)
+	return store.SetSessions(addr, list)
+}
+
+// encrypt encrypts plaintext with the current session of addr. It returns
+// nil if there is no session that can send yet.
+func encrypt(store keystore.KeyStore, addr string, plaintext []byte) (*keystore.Session, json.RawMessage, error) {
+	list, err := store.Sessions(addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i, session := range list {
+		msg, err := session.Ratchet.Encrypt(plaintext)
+		if errors.Is(err, ratchet.ErrNoSendingChain) {
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := useSession(store, addr, list, i); err != nil {
+			return nil, nil, err
+		}
+		data, err := json.Marshal(msg)
+		return session, data, err
+	}
+	return nil, nil, nil
+}
+
+// decrypt tries each session of addr on a ratchet message and makes the
+// first that succeeds the current one.
+func decrypt(store keystore.KeyStore, addr string, data json.RawMessage) (*keystore.Session, []byte, error) {
+	var msg ratchet.Message
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, nil, fmt.Errorf("invalid ratchet message: %v", err)
+	}
+	list, err := store.Sessions(addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(list) == 0 {
+		return nil, nil, fmt.Errorf("%w %s", ErrNoSession, addr)
+	}
+	for i, session := range list {
+		var plaintext []byte
+		if plaintext, err = session.Ratchet.Decrypt(&msg); err == nil {
+			return session, plaintext, useSession(store, addr, list, i)
+		}
+	}
+	return nil, nil, err
+}
@@ -0,0 +1,628 @@
+// internal/user/user.go
+//
+// Package user is the client side of the relay for one device of one user:
+// it keeps the device's contacts and, in a keystore.KeyStore, its keys and
+// sessions, registers its bundle, and sends and receives messages. The
+// first message to a peer device is an X3DH handshake that starts a Double
+// Ratchet session; later ones continue it. It works for any user name; the
+// alice and bob programs, the x3dh command and the chat are frontends to it.
+package user
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"x3dh-demo/internal/client"
+	"x3dh-demo/internal/keystore"
+	"x3dh-demo/internal/ratchet"
+	"x3dh-demo/internal/x3dh"
+)
+
+var (
+	// ErrNoKeys is returned when the device has no keys yet.
+	ErrNoKeys = errors.New("no keys found: run init first")
+	// ErrKeysExist is returned by Init when the device already has keys.
+	ErrKeysExist = errors.New("keys already exist")
+	// ErrUnknownUser is returned when sending to a user with no registered devices.
+	ErrUnknownUser = errors.New("user has no registered devices")
+	// ErrIdentityChanged is returned when a contact's device presents an
+	// identity key other than the one pinned for it.
+	ErrIdentityChanged = errors.New("identity key changed")
+	// ErrNoSession is returned for a session message from a device there is
+	// no session with.
+	ErrNoSession = errors.New("no session with")
+)
+
+// defaultDevice is the relay's name for the device a user has when none is named.
+const defaultDevice = "default"
+
+// User is one device of a user, talking to the relay at Server.
+type User struct {
+	Name   string
+	Device string // empty for the user's default device
+	Server string // relay URL without a trailing slash
+
+	// ContactsFile records the identity keys pinned for each contact.
+	// Pinning is off when it is empty.
+	ContactsFile string
+
+	// Store holds the device's keys and sessions. When it is nil, a
+	// keystore.File over KeyFile and SessionsFile, unlocked with
+	// Passphrase, is made on first use.
+	Store        keystore.KeyStore
+	KeyFile      string
+	SessionsFile string // empty to start every message over with an X3DH handshake
+	// Passphrase unlocks the files of the default store; see keystore.File.
+	Passphrase func(create bool) ([]byte, error)
+
+	// Client talks to the relay. New sets one up for Server; otherwise
+	// one is made on first use.
+	Client *client.Client
+
+	mu sync.Mutex // serializes Send and Open, which advance sessions
+}
+
+// Dir returns the directory under keyDir that holds the keys and contacts
+// of a user's device: keyDir/{name} for the default device and
+// keyDir/{name}/{device} for the others.
+func Dir(keyDir, name, device string) string {
+	if device == "" || device == defaultDevice {
+		return filepath.Join(keyDir, name)
+	}
+	return filepath.Join(keyDir, name, device)
+}
+
+// New returns the user's device with its files in Dir(keyDir, name, device).
+func New(server, keyDir, name, device string) *User {
+	dir := Dir(keyDir, name, device)
+	return &User{
+		Name:         name,
+		Device:       device,
+		Server:       server,
+		KeyFile:      filepath.Join(dir, "keys.json"),
+		ContactsFile: filepath.Join(dir, "contacts.json"),
+		SessionsFile: filepath.Join(dir, "sessions.json"),
+		Client:       client.New(server),
+	}
+}
+
+// deviceAddress returns the mailbox address of a user's device: the bare
+// user name for the default device, {name}/{device} otherwise.
+func deviceAddress(name, device string) string {
+	if device == "" || device == defaultDevice {
+		return name
+	}
+	return name + "/" + device
+}
+
+// Address returns the device's mailbox address on the relay.
+func (u *User) Address() string {
+	return deviceAddress(u.Name, u.Device)
+}
+
+// Relay returns the client for the relay, set up to log in as the device
+// once it has keys.
+func (u *User) Relay() *client.Client {
+	if u.Client == nil {
+		u.Client = client.New(u.Server)
+	}
+	if id, err := u.Identity(); err == nil {
+		u.Client.SetIdentity(u.Address(), id.Signing)
+	}
+	return u.Client
+}
+
+// store returns the device's key store, making the file store if none was set.
+func (u *User) store() keystore.KeyStore {
+	if u.Store == nil {
+		u.Store = &keystore.File{KeyFile: u.KeyFile, SessionsFile: u.SessionsFile, Passphrase: u.Passphrase}
+	}
+	return u.Store
+}
+
+// keepsSessions reports whether handshakes start ratchet sessions: always
+// with a store that was set explicitly, and with the file store only if
+// there is a file for them.
+func (u *User) keepsSessions() bool {
+	if f, ok := u.store().(*keystore.File); ok {
+		return f.SessionsFile != ""
+	}
+	return true
+}
+
+// SigningKey returns the device's Ed25519 public key in hex, the key another
+// device of the user approves with ApproveDevice.
+func (u *User) SigningKey() (string, error) {
+	id, err := u.Identity()
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id.Signing.Public().(ed25519.PublicKey)), nil
+}
+
+// ApproveDevice lets the user's device named device log in with the hex
+// Ed25519 key edKey. Only the user's first device may log in without
+// approval; the relay turns the others away until one already logged in
+// approves them.
+func (u *User) ApproveDevice(device, edKey string) error {
+	if _, err := u.Identity(); err != nil {
+		return err
+	}
+	if err := u.Relay().ApproveDevice(context.Background(), device, edKey); err != nil {
+		return fmt.Errorf("failed to approve device %s: %v", device, err)
+	}
+	return nil
+}
+
+// CountOTKs asks the relay how many of the device's one-time prekeys are left.
+func (u *User) CountOTKs() (int64, error) {
+	return u.Relay().CountOTKs(context.Background(), u.Address())
+}
+
+// Identity returns the device's identity, or ErrNoKeys if it has none yet.
+func (u *User) Identity() (*keystore.Identity, error) {
+	id, err := u.store().Identity()
+	if errors.Is(err, keystore.ErrNotFound) {
+		return nil, ErrNoKeys
+	}
+	return id, err
+}
+
+// Init generates and stores new keys for the device: an identity and a
+// first signed prekey. It returns ErrKeysExist rather than overwriting
+// existing ones.
+func (u *User) Init() error {
+	if _, err := u.Identity(); err == nil {
+		return fmt.Errorf("%w in %s", ErrKeysExist, u.KeyFile)
+	} else if !errors.Is(err, ErrNoKeys) {
+		return err
+	}
+	id, err := newIdentity()
+	if err != nil {
+		return err
+	}
+	if err := u.store().SetIdentity(id); err != nil {
+		return err
+	}
+	_, err = addSPK(u.store())
+	return err
+}
+
+// ChangePassphrase re-encrypts the device's keys and sessions under a new
+// passphrase. An empty one stores them unencrypted. It only works with the
+// file store.
+func (u *User) ChangePassphrase(pass []byte) error {
+	f, ok := u.store().(*keystore.File)
+	if !ok {
+		return fmt.Errorf("the key store of %s has no passphrase", u.Address())
+	}
+	return f.ChangePassphrase(pass)
+}
+
+// Register uploads the device's bundle and numOTKs new one-time prekeys and
+// returns how many prekeys the relay now holds. Registering again replaces
+// the bundle. The relay only accepts it signed with the Ed25519 key pinned
+// for the device; a new identity key is accepted, and the one-time prekeys
+// published under the old one are discarded.
+func (u *User) Register(numOTKs int) (int64, error) {
+	if _, err := u.Identity(); err != nil {
+		return 0, err
+	}
+	store := u.store()
+	// Key files that were only ever used to send have no SPK yet.
+	if _, _, err := store.CurrentSignedPreKey(); errors.Is(err, keystore.ErrNotFound) {
+		if _, err := addSPK(store); err != nil {
+			return 0, err
+		}
+	} else if err != nil {
+		return 0, err
+	}
+	// The private halves are stored first: a published key whose private
+	// half is lost can never be used.
+	otks, err := generateOTKs(store, numOTKs)
+	if err != nil {
+		return 0, err
+	}
+	bundle, err := deviceBundle(store)
+	if err != nil {
+		return 0, err
+	}
+	if err := u.Relay().Register(context.Background(), bundle); err != nil {
+		return 0, fmt.Errorf("failed to register bundle: %v", err)
+	}
+	// One-time prekeys are optional; without them initiators fall back to 3-DH.
+	if len(otks) == 0 {
+		return u.CountOTKs()
+	}
+	count, err := u.Relay().UploadOTKs(context.Background(), otks)
+	if err != nil {
+		return 0, fmt.Errorf("failed to upload one-time prekeys: %v", err)
+	}
+	return count, nil
+}
+
+// Replenish uploads batch new one-time prekeys if fewer than threshold are
+// left on the relay. It returns the number uploaded and the pool size.
+func (u *User) Replenish(batch, threshold int) (int, int64, error) {
+	if _, err := u.Identity(); err != nil {
+		return 0, 0, err
+	}
+	count, err := u.CountOTKs()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to count one-time prekeys: %v", err)
+	}
+	if count >= int64(threshold) || batch <= 0 {
+		return 0, count, nil
+	}
+	otks, err := generateOTKs(u.store(), batch)
+	if err != nil {
+		return 0, 0, err
+	}
+	count, err = u.Relay().UploadOTKs(context.Background(), otks)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to upload one-time prekeys: %v", err)
+	}
+	return len(otks), count, nil
+}
+
+// RotateSPK replaces the device's signed prekey and re-registers its bundle.
+// The previous SPK is kept for grace so initial messages that reference it
+// can still be read. It returns the old and new SPK ids.
+func (u *User) RotateSPK(grace time.Duration) (uint32, uint32, error) {
+	if _, err := u.Identity(); err != nil {
+		return 0, 0, err
+	}
+	store := u.store()
+	oldID, _, err := store.CurrentSignedPreKey()
+	if err == nil {
+		err = store.RetireSignedPreKey(oldID, time.Now().Add(grace))
+	}
+	if err != nil && !errors.Is(err, keystore.ErrNotFound) {
+		return 0, 0, err
+	}
+	// Store first: the relay must never advertise an SPK we cannot decrypt with.
+	newID, err := addSPK(store)
+	if err != nil {
+		return 0, 0, err
+	}
+	bundle, err := deviceBundle(store)
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := u.Relay().Register(context.Background(), bundle); err != nil {
+		return 0, 0, fmt.Errorf("failed to upload rotated bundle: %v", err)
+	}
+	return oldID, newID, nil
+}
+
+// Sent describes a message delivered to one of the recipient's devices.
+// Session is set when the message started a new session with an X3DH
+// handshake and nil when it continued an existing one.
+type Sent struct {
+	Device       string
+	PeerIdentity [32]byte
+	Session      *x3dh.Session
+}
+
+// Send queues plaintext for every device of the recipient. A device with
+// an established session gets a message of that session; any other gets an
+// X3DH handshake that carries plaintext and, when sessions are kept, starts
+// a new session. The user names are bound into the associated data. A
+// device whose identity key differs from the pinned one gets nothing and
+// Send returns ErrIdentityChanged. When some devices fail, the others still
+// get the message: Send returns those it reached, with their contact and
+// session state saved, together with the errors of the rest.
+func (u *User) Send(to string, plaintext []byte) ([]Sent, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	id, err := u.Identity()
+	if err != nil {
+		return nil, err
+	}
+	devices, err := u.Relay().Devices(context.Background(), to)
+	if errors.Is(err, client.ErrNotFound) {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownUser, to)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list devices of %s: %v", to, err)
+	}
+	contacts, err := u.Contacts()
+	if err != nil {
+		return nil, err
+	}
+
+	sent := make([]Sent, 0, len(devices))
+	var errs []error
+	for _, device := range devices {
+		s, err := u.sendTo(id.Key, contacts, to, device, plaintext)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		sent = append(sent, *s)
+	}
+	if len(sent) > 0 {
+		contacts.Seen(to, time.Now())
+		errs = append(errs, u.saveContacts(contacts))
+	}
+	return sent, errors.Join(errs...)
+}
+
+// sendTo queues plaintext for one of the recipient's devices. A new
+// session is stored, and the device's identity key pinned in contacts, only
+// once the relay has accepted the handshake.
+func (u *User) sendTo(ik *ecdh.PrivateKey, contacts Contacts, to, device string, plaintext []byte) (*Sent, error) {
+	addr := deviceAddress(to, device)
+	sent := &Sent{Device: device}
+	var msg *x3dh.InitialMessage
+	var bundle *x3dh.Bundle
+	var started *keystore.Session
+	session, data, err := encrypt(u.store(), addr, plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt for %s: %v", addr, err)
+	}
+	if session != nil {
+		msg = &x3dh.InitialMessage{Ratchet: data}
+		sent.PeerIdentity, _ = x3dh.DecodePublicKey(session.PeerIdentity)
+	} else {
+		bundle, err = u.Relay().FetchBundle(context.Background(), to, device)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch bundle of %s: %v", addr, err)
+		}
+		if err := contacts.Check(to, device, bundle.IK); err != nil {
+			return nil, err
+		}
+		sent.Session, msg, err = x3dh.InitiateSession(ik, bundle, plaintext, []byte(u.Name), []byte(to))
+		if err != nil {
+			return nil, fmt.Errorf("failed to establish session with %s: %v", addr, err)
+		}
+		sent.PeerIdentity = sent.Session.PeerIdentity
+		if u.keepsSessions() {
+			if started, msg.Ratchet, err = startSession(addr, bundle, sent.Session); err != nil {
+				return nil, err
+			}
+		}
+	}
+	msg.Sender = u.Name
+	if u.Device != defaultDevice {
+		msg.SenderDevice = u.Device
+	}
+	if err := u.Relay().Send(context.Background(), addr, msg, 0); err != nil {
+		return nil, fmt.Errorf("failed to send to %s: %v", addr, err)
+	}
+	if bundle == nil {
+		return sent, nil
+	}
+	if started != nil {
+		if err := addSession(u.store(), addr, started); err != nil {
+			return nil, fmt.Errorf("failed to save session with %s: %v", addr, err)
+		}
+	}
+	return sent, contacts.Pin(to, device, bundle.IK)
+}
+
+// startSession seeds a ratchet from a completed handshake with the device at
+// addr and returns it for storing. The first ratchet message it returns
+// carries nothing; it gives the responder the initiator's ratchet key so
+// that both sides can send.
+func startSession(addr string, bundle *x3dh.Bundle, handshake *x3dh.Session) (*keystore.Session, json.RawMessage, error) {
+	spk, err := x3dh.DecodePublicKey(bundle.SPK)
+	if err != nil {
+		return nil, nil, err
+	}
+	r, err := ratchet.NewInitiator(handshake.Key, handshake.AD, spk)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to start session with %s: %v", addr, err)
+	}
+	first, err := r.Encrypt(nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := json.Marshal(first)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &keystore.Session{PeerIdentity: bundle.IK, Ratchet: r, Started: time.Now()}, data, nil
+}
+
+// acceptSession seeds a ratchet from a handshake accepted from the device at
+// addr, reads the handshake's first ratchet message with it and returns it
+// for storing.
+func acceptSession(addr string, msg *x3dh.InitialMessage, handshake *x3dh.Session, spk *ecdh.PrivateKey) (*keystore.Session, error) {
+	r, err := ratchet.NewResponder(handshake.Key, handshake.AD, spk)
+	if err != nil {
+		return nil, err
+	}
+	var first ratchet.Message
+	if err := json.Unmarshal(msg.Ratchet, &first); err != nil {
+		return nil, fmt.Errorf("failed to start session with %s: invalid ratchet message: %v", addr, err)
+	}
+	if _, err := r.Decrypt(&first); err != nil {
+		return nil, fmt.Errorf("failed to start session with %s: %w", addr, err)
+	}
+	return &keystore.Session{PeerIdentity: msg.AliceIK, Handshake: msg.AliceEKa, Ratchet: r, Started: time.Now()}, nil
+}
+
+// Received is a decrypted message. Session is set for an X3DH handshake and
+// nil for a later message of an established session.
+type Received struct {
+	Message      *x3dh.InitialMessage
+	Plaintext    []byte
+	PeerIdentity [32]byte
+	Session      *x3dh.Session
+	Left         int64 // messages still waiting in the mailbox
+}
+
+// Receive fetches, decrypts and acknowledges the oldest message in the
+// device's mailbox. It returns nil if the mailbox is empty. A message that
+// fails to decrypt is not acknowledged, so the relay delivers it again after
+// its lease runs out, except a handshake that is rejected for good: one
+// naming a one-time prekey that was already used, reported with
+// keystore.ErrUsedOneTimePreKey, and one from a contact's device whose
+// identity key is not the pinned one, reported with ErrIdentityChanged.
+// Both are acknowledged.
+func (u *User) Receive() (*Received, error) {
+	if _, err := u.Identity(); err != nil {
+		return nil, err
+	}
+	delivery, err := u.Relay().Fetch(context.Background(), 0)
+	if err != nil || delivery == nil {
+		return nil, err
+	}
+	msg := &delivery.Message
+	received, err := u.Open(msg)
+	if errors.Is(err, keystore.ErrUsedOneTimePreKey) || errors.Is(err, ErrIdentityChanged) {
+		if ackErr := u.Relay().Ack(context.Background(), msg.ID); ackErr != nil {
+			return nil, fmt.Errorf("failed to acknowledge message %s: %v", msg.ID, ackErr)
+		}
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	received.Left = delivery.MessagesLeft
+	// Only now tell the relay it may delete the message.
+	if err := u.Relay().Ack(context.Background(), msg.ID); err != nil {
+		return received, fmt.Errorf("failed to acknowledge message %s: %v", msg.ID, err)
+	}
+	return received, nil
+}
+
+// Open decrypts a delivered message without acknowledging it: either an
+// X3DH handshake, which also starts a session if it carries a ratchet
+// message and sessions are kept, or a later message of such a session.
+// A handshake must carry the identity key pinned for the sender's device,
+// or it is rejected with ErrIdentityChanged; the key of a device not seen
+// before is pinned.
+//
+// Accepting a handshake saves the session, then the contacts, and deletes
+// the one-time prekey it used last. If any step fails, the message can be
+// opened again when it is delivered again: the session it already started
+// is recognized by the handshake's ephemeral key and kept as it is.
+func (u *User) Open(msg *x3dh.InitialMessage) (*Received, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	store := u.store()
+	from := deviceAddress(msg.Sender, msg.SenderDevice)
+	received := &Received{Message: msg}
+	contacts, err := u.Contacts()
+	if err != nil {
+		return nil, err
+	}
+
+	if msg.AliceIK == "" {
+		if len(msg.Ratchet) == 0 {
+			return nil, fmt.Errorf("message %s from %s is empty", msg.ID, from)
+		}
+		session, plaintext, err := decrypt(store, from, msg.Ratchet)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt message %s from %s: %w", msg.ID, from, err)
+		}
+		received.Plaintext = plaintext
+		received.PeerIdentity, _ = x3dh.DecodePublicKey(session.PeerIdentity)
+		contacts.Seen(msg.Sender, time.Now())
+		if err := u.saveContacts(contacts); err != nil {
+			return received, err
+		}
+		return received, nil
+	}
+
+	responder, err := responderKeys(store, msg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt message %s from %s: %w", msg.ID, from, err)
+	}
+	session, plaintext, err := x3dh.AcceptSession(responder, msg, []byte(msg.Sender), []byte(u.Name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt message %s from %s: %w", msg.ID, from, err)
+	}
+	received.Plaintext, received.Session, received.PeerIdentity = plaintext, session, session.PeerIdentity
+	// Anyone can name a contact as the sender; only the pinned identity key
+	// proves it is them.
+	device := msg.SenderDevice
+	if device == "" {
+		device = defaultDevice
+	}
+	if err := contacts.Pin(msg.Sender, device, msg.AliceIK); err != nil {
+		return nil, fmt.Errorf("rejected message %s from %s: %w", msg.ID, from, err)
+	}
+	if u.keepsSessions() && len(msg.Ratchet) > 0 {
+		started, err := hasSession(store, from, msg.AliceEKa)
+		if err != nil {
+			return nil, err
+		}
+		if !started {
+			accepted, err := acceptSession(from, msg, session, responder.SignedPreKeys[msg.SPKID])
+			if err != nil {
+				return nil, err
+			}
+			if err := addSession(store, from, accepted); err != nil {
+				return nil, fmt.Errorf("failed to save session with %s: %v", from, err)
+			}
+		}
+	}
+	contacts.Seen(msg.Sender, time.Now())
+	if err := u.saveContacts(contacts); err != nil {
+		return nil, err
+	}
+	if msg.OTKID != 0 {
+		if err := store.DeleteOneTimePreKey(msg.OTKID); err != nil {
+			return nil, fmt.Errorf("failed to delete one-time prekey %d: %v", msg.OTKID, err)
+		}
+	}
+	return received, nil
+}
+
+// Contacts returns the device's contacts, or an empty set when pinning is off.
+func (u *User) Contacts() (Contacts, error) {
+	if u.ContactsFile == "" {
+		return make(Contacts), nil
+	}
+	return LoadContacts(u.ContactsFile)
+}
+
+// ForgetContact removes a contact and the sessions with their devices, so
+// that new identity keys are pinned the next time a message is sent to them.
+// It reports whether the contact existed.
+func (u *User) ForgetContact(name string) (bool, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	contacts, err := u.Contacts()
+	if err != nil {
+		return false, err
+	}
+	if _, ok := contacts[name]; !ok {
+		return false, nil
+	}
+	delete(contacts, name)
+	addrs, err := u.store().SessionAddresses()
+	if err != nil {
+		return true, err
+	}
+	for _, addr := range addrs {
+		if addr == name || strings.HasPrefix(addr, name+"/") {
+			if err := u.store().SetSessions(addr, nil); err != nil {
+				return true, err
+			}
+		}
+	}
+	return true, u.saveContacts(contacts)
+}
+
+func (u *User) saveContacts(contacts Contacts) error {
+	if u.ContactsFile == "" {
+		return nil
+	}
+	if err := contacts.Save(u.ContactsFile); err != nil {
+		return fmt.Errorf("failed to save contacts: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,524 @@
+package user
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"x3dh-demo/internal/keystore"
+	"x3dh-demo/internal/x3dh"
+)
+
+// fakeRelay is just enough of the relay API for the client: it checks that
+// owner-only calls carry a token but does not verify signatures.
+type fakeRelay struct {
+	mu        sync.Mutex
+	bundles   map[string]x3dh.Bundle
+	otks      map[string][]x3dh.OneTimePreKey
+	mailboxes map[string][]x3dh.InitialMessage
+	full      map[string]bool // mailboxes that turn every message away
+	nextID    int
+}
+
+func newFakeRelay(t *testing.T, full ...string) *httptest.Server {
+	f := &fakeRelay{
+		bundles:   make(map[string]x3dh.Bundle),
+		otks:      make(map[string][]x3dh.OneTimePreKey),
+		mailboxes: make(map[string][]x3dh.InitialMessage),
+		full:      make(map[string]bool),
+	}
+	for _, addr := range full {
+		f.full[addr] = true
+	}
+	srv := httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func (f *fakeRelay) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	route, addr := r.Method+" "+parts[0], parts[1]
+	authorized := r.Header.Get("Authorization") == "Bearer token:"+addr
+	reply := func(v interface{}) { json.NewEncoder(w).Encode(v) }
+
+	switch route {
+	case "POST auth":
+		kind, who, _ := strings.Cut(addr, "/")
+		if kind == "challenge" {
+			reply(x3dh.AuthChallenge{Nonce: "nonce", ExpiresIn: 60})
+		} else {
+			reply(x3dh.AuthToken{Token: "token:" + who, ExpiresIn: 300})
+		}
+	case "POST register":
+		var b x3dh.Bundle
+		if !authorized || json.NewDecoder(r.Body).Decode(&b) != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		f.bundles[addr] = b
+	case "POST otks":
+		var otks []x3dh.OneTimePreKey
+		if !authorized || json.NewDecoder(r.Body).Decode(&otks) != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		f.otks[addr] = append(f.otks[addr], otks...)
+		reply(map[string]int{"count": len(f.otks[addr])})
+	case "GET otks":
+		reply(map[string]int{"count": len(f.otks[addr])})
+	case "GET devices":
+		var devices []string
+		for a := range f.bundles {
+			if user, device, ok := strings.Cut(a, "/"); user == addr && ok {
+				devices = append(devices, device)
+			} else if a == addr {
+				devices = append(devices, defaultDevice)
+			}
+		}
+		if len(devices) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		reply(map[string][]string{"devices": devices})
+	case "GET bundle":
+		addr = strings.TrimSuffix(addr, "/"+defaultDevice)
+		b, ok := f.bundles[addr]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if pool := f.otks[addr]; len(pool) > 0 {
+			b.OTK, b.OTKID = pool[0].Key, pool[0].ID
+			f.otks[addr] = pool[1:]
+		}
+		reply(b)
+	case "POST send":
+		if f.full[addr] {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Retry-After", "60")
+			w.WriteHeader(http.StatusTooManyRequests)
+			reply(map[string]string{"code": "mailbox_full", "error": "Mailbox is full"})
+			return
+		}
+		var msg x3dh.InitialMessage
+		json.NewDecoder(r.Body).Decode(&msg)
+		f.nextID++
+		msg.ID = fmt.Sprint(f.nextID)
+		f.mailboxes[addr] = append(f.mailboxes[addr], msg)
+	case "GET messages":
+		queue := f.mailboxes[addr]
+		if !authorized || len(queue) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		reply(map[string]interface{}{"message": queue[0], "messages_left": len(queue) - 1})
+	case "DELETE messages":
+		i := strings.LastIndex(addr, "/")
+		mailbox, id := addr[:i], addr[i+1:]
+		queue := f.mailboxes[mailbox]
+		if r.Header.Get("Authorization") != "Bearer token:"+mailbox || len(queue) == 0 || queue[0].ID != id {
+			http.NotFound(w, r)
+			return
+		}
+		f.mailboxes[mailbox] = queue[1:]
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestSendReceive(t *testing.T) {
+	srv := newFakeRelay(t)
+	dir := t.TempDir()
+	carol := New(srv.URL, dir, "carol", "")
+	carolPhone := New(srv.URL, dir, "carol", "phone")
+	dave := New(srv.URL, dir, "dave", "")
+	for _, u := range []*User{carol, carolPhone, dave} {
+		if err := u.Init(); err != nil {
+			t.Fatalf("Init %s failed: %v", u.Address(), err)
+		}
+	}
+	if err := carol.Init(); !errors.Is(err, ErrKeysExist) {
+		t.Fatalf("expected ErrKeysExist, got %v", err)
+	}
+	for _, u := range []*User{carol, carolPhone} {
+		if count, err := u.Register(2); err != nil || count != 2 {
+			t.Fatalf("Register %s returned %d, %v", u.Address(), count, err)
+		}
+	}
+
+	if _, err := dave.Send("erin", []byte("hi")); !errors.Is(err, ErrUnknownUser) {
+		t.Fatalf("expected ErrUnknownUser, got %v", err)
+	}
+	sent, err := dave.Send("carol", []byte("hello carol"))
+	if err != nil || len(sent) != 2 {
+		t.Fatalf("Send returned %d deliveries, %v", len(sent), err)
+	}
+
+	for _, u := range []*User{carol, carolPhone} {
+		received, err := u.Receive()
+		if err != nil || received == nil {
+			t.Fatalf("Receive on %s returned %v, %v", u.Address(), received, err)
+		}
+		if string(received.Plaintext) != "hello carol" || received.Message.Sender != "dave" || received.Message.OTKID == 0 {
+			t.Fatalf("unexpected message on %s: %+v", u.Address(), received.Message)
+		}
+		if again, err := u.Receive(); err != nil || again != nil {
+			t.Fatalf("message was not acknowledged: %v, %v", again, err)
+		}
+	}
+
+	contacts, err := dave.Contacts()
+	if err != nil || len(contacts["carol"].Devices) != 2 {
+		t.Fatalf("expected both of carol's devices pinned, got %+v, %v", contacts["carol"], err)
+	}
+	if seen, _ := carol.Contacts(); seen["dave"] == nil {
+		t.Fatal("receiving should record the sender as a contact")
+	}
+}
+
+func TestSend_IdentityChanged(t *testing.T) {
+	srv := newFakeRelay(t)
+	dir := t.TempDir()
+	carol := New(srv.URL, dir, "carol", "")
+	dave := New(srv.URL, dir, "dave", "")
+	// Without sessions every message is a handshake against a fresh bundle.
+	dave.SessionsFile = ""
+	for _, u := range []*User{carol, dave} {
+		if err := u.Init(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := carol.Register(1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dave.Send("carol", []byte("first")); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+
+	// Carol starts over with new keys.
+	os.Remove(carol.KeyFile)
+	carol = New(srv.URL, dir, "carol", "")
+	if err := carol.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := carol.Register(1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dave.Send("carol", []byte("second")); !errors.Is(err, ErrIdentityChanged) {
+		t.Fatalf("expected ErrIdentityChanged, got %v", err)
+	}
+	if found, err := dave.ForgetContact("carol"); !found || err != nil {
+		t.Fatalf("ForgetContact returned %v, %v", found, err)
+	}
+	if _, err := dave.Send("carol", []byte("third")); err != nil {
+		t.Fatalf("Send after forgetting failed: %v", err)
+	}
+}
+
+func TestSend_PartialFailure(t *testing.T) {
+	srv := newFakeRelay(t, "carol/phone")
+	dir := t.TempDir()
+	carol := New(srv.URL, dir, "carol", "")
+	carolPhone := New(srv.URL, dir, "carol", "phone")
+	dave := New(srv.URL, dir, "dave", "")
+	for _, u := range []*User{carol, carolPhone, dave} {
+		if err := u.Init(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, u := range []*User{carol, carolPhone} {
+		if _, err := u.Register(1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The phone's mailbox is full; the other device still gets the message.
+	sent, err := dave.Send("carol", []byte("hello"))
+	if err == nil || !strings.Contains(err.Error(), "carol/phone") {
+		t.Fatalf("expected an error for the phone, got %v", err)
+	}
+	if len(sent) != 1 || sent[0].Device != defaultDevice {
+		t.Fatalf("expected delivery to the default device only, got %+v", sent)
+	}
+	contacts, err := dave.Contacts()
+	if err != nil || len(contacts["carol"].Devices) != 1 || contacts["carol"].Devices[defaultDevice] == "" {
+		t.Fatalf("only the device reached should be pinned, got %+v, %v", contacts["carol"], err)
+	}
+	if list, _ := dave.store().Sessions("carol/phone"); len(list) != 0 {
+		t.Fatalf("a session was kept with the device that was not reached: %d", len(list))
+	}
+	if received, err := carol.Receive(); err != nil || received == nil || string(received.Plaintext) != "hello" {
+		t.Fatalf("Receive returned %+v, %v", received, err)
+	}
+}
+
+func TestReceive_UsedOneTimePreKey(t *testing.T) {
+	srv := newFakeRelay(t)
+	dir := t.TempDir()
+	carol := New(srv.URL, dir, "carol", "")
+	dave := New(srv.URL, dir, "dave", "")
+	for _, u := range []*User{carol, dave} {
+		if err := u.Init(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := carol.Register(1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dave.Send("carol", []byte("hello")); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	received := receive(t, carol, "hello")
+	otkID := received.Message.OTKID
+	if otkID == 0 {
+		t.Fatal("handshake did not use a one-time prekey")
+	}
+	if _, err := carol.store().OneTimePreKey(otkID); !errors.Is(err, keystore.ErrUsedOneTimePreKey) {
+		t.Fatalf("one-time prekey should be deleted after use, got %v", err)
+	}
+
+	// The same handshake delivered again is rejected and dropped.
+	replay := *received.Message
+	if err := dave.Relay().Send(context.Background(), "carol", &replay, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := carol.Receive(); !errors.Is(err, keystore.ErrUsedOneTimePreKey) {
+		t.Fatalf("expected ErrUsedOneTimePreKey, got %v", err)
+	}
+	if again, err := carol.Receive(); err != nil || again != nil {
+		t.Fatalf("rejected message was not acknowledged: %v, %v", again, err)
+	}
+}
+
+func TestReceive_Impersonation(t *testing.T) {
+	srv := newFakeRelay(t)
+	dir := t.TempDir()
+	carol := New(srv.URL, dir, "carol", "")
+	dave := New(srv.URL, dir, "dave", "")
+	// Another identity that claims to be dave.
+	mallory := New(srv.URL, t.TempDir(), "dave", "")
+	for _, u := range []*User{carol, dave, mallory} {
+		if err := u.Init(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := carol.Register(2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dave.Send("carol", []byte("hello")); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	receive(t, carol, "hello")
+	pinned := contactsOf(t, carol)["dave"].Devices[defaultDevice]
+	if pinned == "" {
+		t.Fatal("receiving a handshake should pin the sender's identity key")
+	}
+
+	if _, err := mallory.Send("carol", []byte("it's me, dave")); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if received, err := carol.Receive(); !errors.Is(err, ErrIdentityChanged) {
+		t.Fatalf("expected ErrIdentityChanged, got %+v, %v", received, err)
+	}
+	if again, err := carol.Receive(); err != nil || again != nil {
+		t.Fatalf("rejected message was not acknowledged: %v, %v", again, err)
+	}
+	if got := contactsOf(t, carol)["dave"].Devices[defaultDevice]; got != pinned {
+		t.Fatalf("pinned key changed to %s", got)
+	}
+	list, err := carol.store().Sessions("dave")
+	if err != nil || len(list) != 1 || list[0].PeerIdentity != pinned {
+		t.Fatalf("expected only the session with the real dave, got %d sessions, %v", len(list), err)
+	}
+}
+
+// contactsOf loads the contacts of u.
+func contactsOf(t *testing.T, u *User) Contacts {
+	t.Helper()
+	contacts, err := u.Contacts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return contacts
+}
+
+// sessionFailStore is a key store that cannot save sessions while fail is set.
+type sessionFailStore struct {
+	*keystore.Memory
+	fail bool
+}
+
+func (s *sessionFailStore) SetSessions(addr string, list []*keystore.Session) error {
+	if s.fail {
+		return errors.New("disk full")
+	}
+	return s.Memory.SetSessions(addr, list)
+}
+
+func TestOpen_SaveFails(t *testing.T) {
+	srv := newFakeRelay(t)
+	dir := t.TempDir()
+	store := &sessionFailStore{Memory: keystore.NewMemory()}
+	carol := New(srv.URL, dir, "carol", "")
+	carol.Store = store
+	dave := New(srv.URL, dir, "dave", "")
+	for _, u := range []*User{carol, dave} {
+		if err := u.Init(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := carol.Register(2); err != nil {
+		t.Fatal(err)
+	}
+
+	// The session cannot be saved: the message stays in the mailbox and is
+	// read once it can be.
+	if _, err := dave.Send("carol", []byte("hello")); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	store.fail = true
+	if received, err := carol.Receive(); err == nil || errors.Is(err, keystore.ErrUsedOneTimePreKey) {
+		t.Fatalf("expected the session save to fail, got %+v, %v", received, err)
+	}
+	store.fail = false
+	received := receive(t, carol, "hello")
+	if _, err := store.OneTimePreKey(received.Message.OTKID); !errors.Is(err, keystore.ErrUsedOneTimePreKey) {
+		t.Fatalf("one-time prekey should be deleted once the handshake is accepted, got %v", err)
+	}
+
+	// The session is saved but the contacts are not: the message is read
+	// again without starting a second session.
+	if err := dave.store().SetSessions("carol", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dave.Send("carol", []byte("again")); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	contactsFile := carol.ContactsFile
+	carol.ContactsFile = filepath.Join(contactsFile, "not-a-directory")
+	if received, err := carol.Receive(); err == nil {
+		t.Fatalf("expected the contacts save to fail, got %+v", received)
+	}
+	carol.ContactsFile = contactsFile
+	receive(t, carol, "again")
+	if list, _ := store.Sessions("dave"); len(list) != 2 {
+		t.Fatalf("expected one session per handshake, got %d", len(list))
+	}
+}
+
+// receive fetches one message for u and checks its text.
+func receive(t *testing.T, u *User, want string) *Received {
+	t.Helper()
+	received, err := u.Receive()
+	if err != nil || received == nil {
+		t.Fatalf("Receive on %s returned %v, %v", u.Address(), received, err)
+	}
+	if string(received.Plaintext) != want {
+		t.Fatalf("%s received %q, want %q", u.Address(), received.Plaintext, want)
+	}
+	return received
+}
+
+func TestSessions(t *testing.T) {
+	srv := newFakeRelay(t)
+	dir := t.TempDir()
+	carol := New(srv.URL, dir, "carol", "")
+	dave := New(srv.URL, dir, "dave", "laptop")
+	for _, u := range []*User{carol, dave} {
+		if err := u.Init(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := u.Register(1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The first message is a handshake that also starts a session.
+	if sent, err := dave.Send("carol", []byte("hi carol")); err != nil || sent[0].Session == nil {
+		t.Fatalf("first Send should start a session: %+v, %v", sent, err)
+	}
+	if r := receive(t, carol, "hi carol"); r.Session == nil || r.Message.SenderDevice != "laptop" {
+		t.Fatalf("expected a handshake from dave's laptop, got %+v", r.Message)
+	}
+
+	// Carol answers within the session, without fetching a bundle.
+	if sent, err := carol.Send("dave", []byte("hi dave")); err != nil || sent[0].Session != nil {
+		t.Fatalf("reply should continue the session: %+v, %v", sent, err)
+	}
+	r := receive(t, dave, "hi dave")
+	if r.Session != nil || r.Message.AliceIK != "" {
+		t.Fatalf("reply should be a session message, got %+v", r.Message)
+	}
+	if id, _ := carol.Identity(); r.PeerIdentity != x3dh.PublicKey(id.Key) {
+		t.Fatal("session message should report carol's identity")
+	}
+	if _, err := dave.Send("carol", []byte("how are you?")); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, carol, "how are you?")
+
+	// Sessions survive a restart.
+	carol = New(srv.URL, dir, "carol", "")
+	if _, err := carol.Send("dave", []byte("fine")); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, dave, "fine")
+
+	// A session message from a stranger cannot be read.
+	erin := New(srv.URL, dir, "erin", "")
+	if err := erin.Init(); err != nil {
+		t.Fatal(err)
+	}
+	_, err := erin.Open(&x3dh.InitialMessage{Sender: "dave", Ratchet: json.RawMessage(`{"header":{"dh":"00"}}`)})
+	if !errors.Is(err, ErrNoSession) {
+		t.Fatalf("expected ErrNoSession, got %v", err)
+	}
+}
+
+func TestSessions_CrossedHandshakes(t *testing.T) {
+	srv := newFakeRelay(t)
+	dir := t.TempDir()
+	carol := New(srv.URL, dir, "carol", "")
+	dave := New(srv.URL, dir, "dave", "")
+	for _, u := range []*User{carol, dave} {
+		if err := u.Init(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := u.Register(2); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Both start a session before seeing the other's handshake.
+	if _, err := carol.Send("dave", []byte("from carol")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dave.Send("carol", []byte("from dave")); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, carol, "from dave")
+	receive(t, dave, "from carol")
+
+	// Each now sends with the other's session; both must still be readable.
+	for i := 0; i < 2; i++ {
+		if _, err := carol.Send("dave", []byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		receive(t, dave, "ping")
+		if _, err := dave.Send("carol", []byte("pong")); err != nil {
+			t.Fatal(err)
+		}
+		receive(t, carol, "pong")
+	}
+}
@@ -2,13 +2,33 @@
 package x3dh
 
 import (
+	"bytes"
 	"crypto/ecdh"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
 )
 
+// KDFInfo is the application-specific info string bound into every key
+// derived by KDF. Peers must use the same value to arrive at the same key.
+const KDFInfo = "x3dh-demo"
+
+// kdfPrefix is F from the X3DH spec: 32 0xFF bytes prepended to the DH
+// outputs so the KDF input can never collide with an XEdDSA signature input.
+var kdfPrefix = [32]byte{
+	0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+	0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+	0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+	0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+}
+
 // GenKeyPair creates an X25519 key pair and returns (private, public[32], error)
 // This function is optimized for MPU devices with limited resources.
 func GenKeyPair() (*ecdh.PrivateKey, [32]byte, error) {
@@ -37,7 +57,40 @@ func DH(priv *ecdh.PrivateKey, pub32 *[32]byte) (out [32]byte, err error) {
 	return out, nil
 }
 
+// KDF derives a 32-byte session key from the DH outputs, in order, using
+// HKDF-SHA256 with the X3DH prefix F, a zero salt and KDFInfo.
 func KDF(parts ...[32]byte) (out [32]byte) {
+	key, err := DeriveKey(KDFInfo, len(out), parts...)
+	if err != nil {
+		// HKDF-SHA256 can always produce 32 bytes.
+		panic(err)
+	}
+	copy(out[:], key)
+	return
+}
+
+// DeriveKey runs the X3DH key derivation over the DH outputs with a custom
+// info string and output length (at most 255*32 bytes).
+func DeriveKey(info string, length int, parts ...[32]byte) ([]byte, error) {
+	if length <= 0 {
+		return nil, fmt.Errorf("invalid key length: %d", length)
+	}
+	ikm := make([]byte, 0, len(kdfPrefix)+len(parts)*32)
+	ikm = append(ikm, kdfPrefix[:]...)
+	for _, p := range parts {
+		ikm = append(ikm, p[:]...)
+	}
+	salt := make([]byte, sha256.Size)
+	out := make([]byte, length)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, ikm, salt, []byte(info)), out); err != nil {
+		return nil, fmt.Errorf("failed to derive key: %v", err)
+	}
+	return out, nil
+}
+
+// LegacyKDF is the original derivation: a bare SHA-256 over the DH outputs.
+// It is kept only for compatibility with keys derived by older builds.
+func LegacyKDF(parts ...[32]byte) (out [32]byte) {
 	h := sha256.New()
 	for _, p := range parts {
 		h.Write(p[:])
@@ -46,6 +99,55 @@ func KDF(parts ...[32]byte) (out [32]byte) {
 	return
 }
 
+// AssociatedData builds the X3DH associated data AD = IKa || IKb, followed by
+// any extra identity info (e.g. user names). Each info item is prefixed with
+// its 2-byte big-endian length so distinct inputs never encode the same way.
+func AssociatedData(ikA, ikB [32]byte, info ...[]byte) []byte {
+	size := 64
+	for _, item := range info {
+		size += 2 + len(item)
+	}
+	ad := make([]byte, 0, size)
+	ad = append(ad, ikA[:]...)
+	ad = append(ad, ikB[:]...)
+	for _, item := range info {
+		ad = binary.BigEndian.AppendUint16(ad, uint16(len(item)))
+		ad = append(ad, item...)
+	}
+	return ad
+}
+
+// Encrypt seals plaintext with ChaCha20-Poly1305 under key, authenticating ad.
+// It returns the random nonce and the ciphertext.
+func Encrypt(key [32]byte, plaintext, ad []byte) (nonce, ciphertext []byte, err error) {
+	aead, err := chacha20poly1305.New(key[:])
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create AEAD: %v", err)
+	}
+	nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, fmt.Errorf("failed to generate nonce: %v", err)
+	}
+	return nonce, aead.Seal(nil, nonce, plaintext, ad), nil
+}
+
+// Decrypt opens a ciphertext produced by Encrypt. It fails if the key, nonce
+// or associated data differ from the ones used for encryption.
+func Decrypt(key [32]byte, nonce, ciphertext, ad []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(key[:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AEAD: %v", err)
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("invalid nonce size: %d", len(nonce))
+	}
+	plaintext, err := aead.Open(nil, nonce, ciphertext, ad)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt: %v", err)
+	}
+	return plaintext, nil
+}
+
 // encode32 converts a [32]byte public key to hex string for JSON serialization.
 func encode32(pk [32]byte) string { 
 	return hex.EncodeToString(pk[:]) 
@@ -66,12 +168,32 @@ func decode32(s string) ([32]byte, error) {
 	return out, nil
 }
 
+var (
+	// ErrMalformedKey is returned for a key that is not 32 hex-encoded bytes.
+	ErrMalformedKey = errors.New("invalid public key format")
+	// ErrLowOrderPoint is returned for an X25519 public key of order 1, 2, 4
+	// or 8. DH with such a key yields a value the attacker knows in advance.
+	ErrLowOrderPoint = errors.New("low-order X25519 point")
+)
+
+// lowOrderProbe is a fixed X25519 scalar. Clamping clears the cofactor, so
+// multiplying any low-order point by it gives the all-zero output that
+// crypto/ecdh refuses; this catches every encoding of those points.
+var lowOrderProbe, _ = ecdh.X25519().NewPrivateKey(bytes.Repeat([]byte{0x42}, 32))
+
 // ValidatePublicKey checks if a hex string represents a valid X25519 public key.
 // Useful for input validation in MPU applications.
 func ValidatePublicKey(hexKey string) error {
-	_, err := decode32(hexKey)
+	raw, err := decode32(hexKey)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformedKey, err)
+	}
+	pub, err := ecdh.X25519().NewPublicKey(raw[:])
 	if err != nil {
-		return fmt.Errorf("invalid public key format: %v", err)
+		return fmt.Errorf("%w: %v", ErrMalformedKey, err)
+	}
+	if _, err := lowOrderProbe.ECDH(pub); err != nil {
+		return ErrLowOrderPoint
 	}
 	return nil
 }
@@ -1,6 +1,9 @@
 package x3dh
 
 import (
+	"bytes"
+	"encoding/hex"
+	"errors"
 	"testing"
 )
 
@@ -52,23 +55,23 @@ func TestDH(t *testing.T) {
 	}
 }
 
-func TestKDF(t *testing.T) {
+func TestLegacyKDF(t *testing.T) {
 	data1 := [32]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32}
 	data2 := [32]byte{33, 34, 35, 36, 37, 38, 39, 40, 41, 42, 43, 44, 45, 46, 47, 48, 49, 50, 51, 52, 53, 54, 55, 56, 57, 58, 59, 60, 61, 62, 63, 64}
-	result1 := KDF(data1)
+	result1 := LegacyKDF(data1)
 	if result1 == [32]byte{} {
-		t.Fatal("KDF result should not be zero")
+		t.Fatal("LegacyKDF result should not be zero")
 	}
-	result2 := KDF(data1, data2)
+	result2 := LegacyKDF(data1, data2)
 	if result2 == [32]byte{} {
-		t.Fatal("KDF result should not be zero")
+		t.Fatal("LegacyKDF result should not be zero")
 	}
 	if result1 == result2 {
-		t.Fatal("KDF results should be different for different inputs")
+		t.Fatal("LegacyKDF results should be different for different inputs")
 	}
-	result3 := KDF(data1, data2)
+	result3 := LegacyKDF(data1, data2)
 	if result2 != result3 {
-		t.Fatal("KDF should be deterministic")
+		t.Fatal("LegacyKDF should be deterministic")
 	}
 }
 
@@ -105,6 +108,28 @@ func TestValidatePublicKey(t *testing.T) {
 	}
 }
 
+func TestValidatePublicKey_LowOrder(t *testing.T) {
+	ff := "ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff"
+	lowOrder := []string{
+		"0000000000000000000000000000000000000000000000000000000000000000",
+		"0100000000000000000000000000000000000000000000000000000000000000",
+		"e0eb7a7c3b41b8ae1656e3faf19fc46ada098deb9c32b1fd866205165f49b800",
+		"5f9c95bca3508c24b1d0b1559c83ef5b04445cc4581c8e86d8224eddd09f1157",
+		"ec" + ff + "7f", // p-1
+		"ed" + ff + "7f", // p, non-canonical 0
+		"ee" + ff + "7f", // p+1, non-canonical 1
+		"0000000000000000000000000000000000000000000000000000000000000080", // high bit set
+	}
+	for _, k := range lowOrder {
+		if err := ValidatePublicKey(k); !errors.Is(err, ErrLowOrderPoint) {
+			t.Errorf("%s: expected ErrLowOrderPoint, got %v", k, err)
+		}
+	}
+	if err := ValidatePublicKey("zz"); !errors.Is(err, ErrMalformedKey) {
+		t.Fatalf("expected ErrMalformedKey, got %v", err)
+	}
+}
+
 func TestGetKeyFingerprint(t *testing.T) {
 	key := [32]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32}
 	fingerprint := GetKeyFingerprint(key)
@@ -123,7 +148,7 @@ func BenchmarkGenKeyPair(b *testing.B) {
 
 func BenchmarkDH(b *testing.B) {
 	priv1, pub1, _ := GenKeyPair()
-	priv2, _ , _ := GenKeyPair()
+	priv2, _, _ := GenKeyPair()
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		_, _ = DH(priv1, &pub1)
@@ -186,22 +211,102 @@ func TestDecode32_WrongLength(t *testing.T) {
 	}
 }
 
-func TestKDF_ZeroInputs(t *testing.T) {
-	result := KDF()
+func TestLegacyKDF_ZeroInputs(t *testing.T) {
+	result := LegacyKDF()
 	if result == [32]byte{} {
-		t.Fatal("KDF with zero inputs should not return zero array")
+		t.Fatal("LegacyKDF with zero inputs should not return zero array")
 	}
 }
 
-func TestKDF_ManyInputs(t *testing.T) {
+func TestLegacyKDF_ManyInputs(t *testing.T) {
 	var inputs [10][32]byte
 	for i := range inputs {
 		for j := range inputs[i] {
 			inputs[i][j] = byte(i + j)
 		}
 	}
-	result := KDF(inputs[:]...)
+	result := LegacyKDF(inputs[:]...)
 	if result == [32]byte{} {
-		t.Fatal("KDF with many inputs should not return zero array")
+		t.Fatal("LegacyKDF with many inputs should not return zero array")
+	}
+}
+
+func TestKDF_Vector(t *testing.T) {
+	data1 := [32]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32}
+	data2 := [32]byte{33, 34, 35, 36, 37, 38, 39, 40, 41, 42, 43, 44, 45, 46, 47, 48, 49, 50, 51, 52, 53, 54, 55, 56, 57, 58, 59, 60, 61, 62, 63, 64}
+	// HKDF-SHA256(salt = 32 zero bytes, ikm = F || data1 || data2, info = "x3dh-demo")
+	expected := "923fd788da7014b6d734ce83c0a751672dd5b2b389623536bbec21d6a21c7234"
+	result := KDF(data1, data2)
+	if got := hex.EncodeToString(result[:]); got != expected {
+		t.Fatalf("KDF mismatch: got %s, expected %s", got, expected)
+	}
+	if result == LegacyKDF(data1, data2) {
+		t.Fatal("KDF should differ from LegacyKDF")
+	}
+}
+
+func TestDeriveKey_Length(t *testing.T) {
+	data := [32]byte{1, 2, 3}
+	key64, err := DeriveKey(KDFInfo, 64, data)
+	if err != nil {
+		t.Fatalf("DeriveKey failed: %v", err)
+	}
+	if len(key64) != 64 {
+		t.Fatalf("expected 64 bytes, got %d", len(key64))
+	}
+	key32 := KDF(data)
+	if !bytes.Equal(key64[:32], key32[:]) {
+		t.Fatal("DeriveKey output should extend the KDF output")
+	}
+	if _, err := DeriveKey(KDFInfo, 0, data); err == nil {
+		t.Fatal("DeriveKey should error on zero length")
 	}
-} 
\ No newline at end of file
+	if _, err := DeriveKey(KDFInfo, 255*32+1, data); err == nil {
+		t.Fatal("DeriveKey should error when length exceeds the HKDF limit")
+	}
+}
+
+func TestDeriveKey_InfoSeparation(t *testing.T) {
+	data := [32]byte{1, 2, 3}
+	a, _ := DeriveKey("app-a", 32, data)
+	b, _ := DeriveKey("app-b", 32, data)
+	if bytes.Equal(a, b) {
+		t.Fatal("different info strings should yield different keys")
+	}
+}
+
+func TestAssociatedData(t *testing.T) {
+	ikA := [32]byte{1}
+	ikB := [32]byte{2}
+	ad := AssociatedData(ikA, ikB)
+	if len(ad) != 64 || !bytes.Equal(ad[:32], ikA[:]) || !bytes.Equal(ad[32:], ikB[:]) {
+		t.Fatal("AD should be IKa || IKb")
+	}
+	if bytes.Equal(AssociatedData(ikA, ikB, []byte("ab"), []byte("c")), AssociatedData(ikA, ikB, []byte("a"), []byte("bc"))) {
+		t.Fatal("AD info items should be unambiguous")
+	}
+}
+
+func TestEncryptDecrypt_AssociatedData(t *testing.T) {
+	key := [32]byte{7}
+	ad := AssociatedData([32]byte{1}, [32]byte{2}, []byte("alice"), []byte("bob"))
+	nonce, ct, err := Encrypt(key, []byte("hello"), ad)
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	pt, err := Decrypt(key, nonce, ct, ad)
+	if err != nil {
+		t.Fatalf("Decrypt failed: %v", err)
+	}
+	if string(pt) != "hello" {
+		t.Fatalf("plaintext mismatch: %q", pt)
+	}
+	// A substituted identity key must be detected.
+	badAD := AssociatedData([32]byte{3}, [32]byte{2}, []byte("alice"), []byte("bob"))
+	if _, err := Decrypt(key, nonce, ct, badAD); err == nil {
+		t.Fatal("Decrypt should fail with different associated data")
+	}
+	if _, err := Decrypt(key, nonce[:4], ct, ad); err == nil {
+		t.Fatal("Decrypt should fail with a short nonce")
+	}
+}
@@ -0,0 +1,286 @@
+// internal/x3dh/session.go
+package x3dh
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrInvalidSignature is returned when a bundle's SPK signature does not verify.
+	ErrInvalidSignature = errors.New("SPK signature verification failed")
+	// ErrUnknownSignedPreKey is returned when an initial message names a
+	// signed prekey the responder no longer (or never) held.
+	ErrUnknownSignedPreKey = errors.New("unknown signed prekey")
+	// ErrUnknownOneTimePreKey is returned when an initial message names a
+	// one-time prekey the responder does not hold.
+	ErrUnknownOneTimePreKey = errors.New("unknown one-time prekey")
+	// ErrMissingOTKID is returned for a one-time prekey published without an id.
+	ErrMissingOTKID = errors.New("one-time prekey has no id")
+	// ErrMalformedSignature is returned for a signature that is not 64 hex-encoded bytes.
+	ErrMalformedSignature = errors.New("invalid signature encoding")
+)
+
+// BundleError names the bundle field that failed ValidateBundle.
+type BundleError struct {
+	Field string // JSON name of the field
+	Err   error
+}
+
+func (e *BundleError) Error() string { return e.Field + ": " + e.Err.Error() }
+
+func (e *BundleError) Unwrap() error { return e.Err }
+
+// ResponderKeys holds the private keys the responder needs to accept a session.
+// Prekeys are keyed by the id published alongside each public key.
+// SignedPreKeys holds the current SPK plus any retired ones still inside
+// their grace period; OneTimePreKeys may be empty.
+type ResponderKeys struct {
+	Identity       *ecdh.PrivateKey
+	SignedPreKeys  map[uint32]*ecdh.PrivateKey
+	OneTimePreKeys map[uint32]*ecdh.PrivateKey
+}
+
+// Session is the result of a completed X3DH handshake.
+type Session struct {
+	// Key is the shared secret SK derived from the DH outputs.
+	Key [32]byte
+	// AD is the associated data bound to the initial ciphertext.
+	AD []byte
+	// PeerIdentity is the other party's X25519 identity key.
+	PeerIdentity [32]byte
+}
+
+// EncodePublicKey converts a public key to the hex form used on the wire.
+func EncodePublicKey(pk [32]byte) string {
+	return encode32(pk)
+}
+
+// DecodePublicKey parses a hex-encoded 32-byte public key.
+func DecodePublicKey(s string) ([32]byte, error) {
+	return decode32(s)
+}
+
+// PublicKey returns the 32-byte X25519 public key of priv.
+func PublicKey(priv *ecdh.PrivateKey) (out [32]byte) {
+	copy(out[:], priv.PublicKey().Bytes())
+	return
+}
+
+// VerifyBundle checks the Ed25519 signature over the bundle's signed prekey.
+func VerifyBundle(b *Bundle) error {
+	edPub, err := hex.DecodeString(b.Ed25519)
+	if err != nil || len(edPub) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid Ed25519 public key")
+	}
+	sig, err := hex.DecodeString(b.Sig)
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return fmt.Errorf("invalid SPK signature encoding")
+	}
+	spk, err := decode32(b.SPK)
+	if err != nil {
+		return fmt.Errorf("invalid SPK: %v", err)
+	}
+	if !ed25519.Verify(ed25519.PublicKey(edPub), spk[:], sig) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// ValidateBundle checks everything a directory can check about a bundle
+// before publishing it: every X25519 key is well formed and not a low-order
+// point, the Ed25519 key and signature are well formed, and the signature
+// over the SPK verifies. Errors are *BundleError wrapping one of the
+// sentinel errors of this package.
+func ValidateBundle(b *Bundle) error {
+	keys := []struct{ field, key string }{{"ik", b.IK}, {"spk", b.SPK}}
+	if b.OTK != "" {
+		if b.OTKID == 0 {
+			return &BundleError{Field: "otk_id", Err: ErrMissingOTKID}
+		}
+		keys = append(keys, struct{ field, key string }{"otk", b.OTK})
+	}
+	for _, k := range keys {
+		if err := ValidatePublicKey(k.key); err != nil {
+			return &BundleError{Field: k.field, Err: err}
+		}
+	}
+	if edPub, err := hex.DecodeString(b.Ed25519); err != nil || len(edPub) != ed25519.PublicKeySize {
+		return &BundleError{Field: "ed25519", Err: ErrMalformedKey}
+	}
+	if sig, err := hex.DecodeString(b.Sig); err != nil || len(sig) != ed25519.SignatureSize {
+		return &BundleError{Field: "sig", Err: ErrMalformedSignature}
+	}
+	if err := VerifyBundle(b); err != nil {
+		return &BundleError{Field: "sig", Err: err}
+	}
+	return nil
+}
+
+// InitiateSession runs the initiator side of X3DH against peer's bundle:
+// it verifies the SPK signature, performs DH1..DH4 in spec order (DH1..DH3
+// if the bundle carries no one-time prekey), derives the session key and
+// encrypts plaintext as the initial message. The info items are appended to
+// the associated data and must match what the responder passes to
+// AcceptSession. The caller fills in msg.Sender.
+func InitiateSession(myIdentity *ecdh.PrivateKey, peer *Bundle, plaintext []byte, info ...[]byte) (*Session, *InitialMessage, error) {
+	if myIdentity == nil {
+		return nil, nil, fmt.Errorf("identity key is nil")
+	}
+	if err := VerifyBundle(peer); err != nil {
+		return nil, nil, err
+	}
+	ikB, err := decode32(peer.IK)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid peer identity key: %v", err)
+	}
+	spkB, err := decode32(peer.SPK)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid peer signed prekey: %v", err)
+	}
+	var otkB [32]byte
+	var otkID uint32
+	hasOTK := peer.OTK != ""
+	if hasOTK {
+		if peer.OTKID == 0 {
+			return nil, nil, fmt.Errorf("peer %w", ErrMissingOTKID)
+		}
+		if otkB, err = decode32(peer.OTK); err != nil {
+			return nil, nil, fmt.Errorf("invalid peer one-time prekey: %v", err)
+		}
+		otkID = peer.OTKID
+	}
+
+	ek, ekPub, err := GenKeyPair()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// DH1 = DH(IKa, SPKb), DH2 = DH(EKa, IKb), DH3 = DH(EKa, SPKb), DH4 = DH(EKa, OTKb)
+	dh1, err := DH(myIdentity, &spkB)
+	if err != nil {
+		return nil, nil, fmt.Errorf("DH1 failed: %v", err)
+	}
+	dh2, err := DH(ek, &ikB)
+	if err != nil {
+		return nil, nil, fmt.Errorf("DH2 failed: %v", err)
+	}
+	dh3, err := DH(ek, &spkB)
+	if err != nil {
+		return nil, nil, fmt.Errorf("DH3 failed: %v", err)
+	}
+	dhs := [][32]byte{dh1, dh2, dh3}
+	if hasOTK {
+		dh4, err := DH(ek, &otkB)
+		if err != nil {
+			return nil, nil, fmt.Errorf("DH4 failed: %v", err)
+		}
+		dhs = append(dhs, dh4)
+	}
+
+	ikA := PublicKey(myIdentity)
+	s := &Session{
+		Key:          KDF(dhs...),
+		AD:           AssociatedData(ikA, ikB, info...),
+		PeerIdentity: ikB,
+	}
+	nonce, ciphertext, err := Encrypt(s.Key, plaintext, s.AD)
+	if err != nil {
+		return nil, nil, err
+	}
+	msg := &InitialMessage{
+		AliceIK:    encode32(ikA),
+		AliceEKa:   encode32(ekPub),
+		SPKID:      peer.SPKID,
+		OTKID:      otkID,
+		Nonce:      hex.EncodeToString(nonce),
+		Ciphertext: hex.EncodeToString(ciphertext),
+	}
+	return s, msg, nil
+}
+
+// AcceptSession runs the responder side of X3DH for an incoming initial
+// message and returns the session together with the decrypted plaintext.
+func AcceptSession(myKeys *ResponderKeys, msg *InitialMessage, info ...[]byte) (*Session, []byte, error) {
+	if myKeys == nil || myKeys.Identity == nil {
+		return nil, nil, fmt.Errorf("responder keys are incomplete")
+	}
+	spk := myKeys.SignedPreKeys[msg.SPKID]
+	if spk == nil {
+		return nil, nil, fmt.Errorf("%w: id %d", ErrUnknownSignedPreKey, msg.SPKID)
+	}
+	var otk *ecdh.PrivateKey
+	if msg.OTKID != 0 {
+		otk = myKeys.OneTimePreKeys[msg.OTKID]
+		if otk == nil {
+			return nil, nil, fmt.Errorf("%w: id %d", ErrUnknownOneTimePreKey, msg.OTKID)
+		}
+	}
+	ikA, err := decode32(msg.AliceIK)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid initiator identity key: %v", err)
+	}
+	ekA, err := decode32(msg.AliceEKa)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid initiator ephemeral key: %v", err)
+	}
+	nonce, err := hex.DecodeString(msg.Nonce)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid nonce encoding: %v", err)
+	}
+	ciphertext, err := hex.DecodeString(msg.Ciphertext)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid ciphertext encoding: %v", err)
+	}
+
+	// Mirror of the initiator: the DH outputs must be fed to the KDF in the same order.
+	dh1, err := DH(spk, &ikA)
+	if err != nil {
+		return nil, nil, fmt.Errorf("DH1 failed: %v", err)
+	}
+	dh2, err := DH(myKeys.Identity, &ekA)
+	if err != nil {
+		return nil, nil, fmt.Errorf("DH2 failed: %v", err)
+	}
+	dh3, err := DH(spk, &ekA)
+	if err != nil {
+		return nil, nil, fmt.Errorf("DH3 failed: %v", err)
+	}
+	dhs := [][32]byte{dh1, dh2, dh3}
+	if otk != nil {
+		dh4, err := DH(otk, &ekA)
+		if err != nil {
+			return nil, nil, fmt.Errorf("DH4 failed: %v", err)
+		}
+		dhs = append(dhs, dh4)
+	}
+
+	s := &Session{
+		Key:          KDF(dhs...),
+		AD:           AssociatedData(ikA, PublicKey(myKeys.Identity), info...),
+		PeerIdentity: ikA,
+	}
+	plaintext, err := Decrypt(s.Key, nonce, ciphertext, s.AD)
+	if err != nil {
+		return nil, nil, err
+	}
+	return s, plaintext, nil
+}
+
+// AuthPayload is the exact byte string signed to answer a server challenge.
+// The prefix keeps these signatures from being mistaken for SPK signatures.
+func AuthPayload(user, nonce string) []byte {
+	return []byte("x3dh-demo-auth:" + user + ":" + nonce)
+}
+
+// SignChallenge answers a server challenge for user with the Ed25519 identity key.
+func SignChallenge(edPriv ed25519.PrivateKey, user, nonce string) AuthResponse {
+	return AuthResponse{
+		Nonce:     nonce,
+		Ed25519:   hex.EncodeToString(edPriv.Public().(ed25519.PublicKey)),
+		Signature: hex.EncodeToString(ed25519.Sign(edPriv, AuthPayload(user, nonce))),
+	}
+}
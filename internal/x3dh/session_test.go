@@ -0,0 +1,214 @@
+package x3dh
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+// newResponder generates a full set of responder keys and the matching bundle.
+func newResponder(t *testing.T) (*ResponderKeys, *Bundle) {
+	t.Helper()
+	ik, ikPub, err := GenKeyPair()
+	if err != nil {
+		t.Fatalf("GenKeyPair failed: %v", err)
+	}
+	spk, spkPub, err := GenKeyPair()
+	if err != nil {
+		t.Fatalf("GenKeyPair failed: %v", err)
+	}
+	otk, otkPub, err := GenKeyPair()
+	if err != nil {
+		t.Fatalf("GenKeyPair failed: %v", err)
+	}
+	edPub, edPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("ed25519.GenerateKey failed: %v", err)
+	}
+	keys := &ResponderKeys{
+		Identity:       ik,
+		SignedPreKeys:  map[uint32]*ecdh.PrivateKey{1: spk},
+		OneTimePreKeys: map[uint32]*ecdh.PrivateKey{1: otk},
+	}
+	bundle := &Bundle{
+		IK:      EncodePublicKey(ikPub),
+		SPK:     EncodePublicKey(spkPub),
+		SPKID:   1,
+		OTK:     EncodePublicKey(otkPub),
+		OTKID:   1,
+		Ed25519: hex.EncodeToString(edPub),
+		Sig:     hex.EncodeToString(ed25519.Sign(edPriv, spkPub[:])),
+	}
+	return keys, bundle
+}
+
+func TestSession_RoundTrip(t *testing.T) {
+	bobKeys, bobBundle := newResponder(t)
+	alice, _, err := GenKeyPair()
+	if err != nil {
+		t.Fatalf("GenKeyPair failed: %v", err)
+	}
+	info := [][]byte{[]byte("alice"), []byte("bob")}
+
+	aliceSession, msg, err := InitiateSession(alice, bobBundle, []byte("hi bob"), info...)
+	if err != nil {
+		t.Fatalf("InitiateSession failed: %v", err)
+	}
+	bobSession, plaintext, err := AcceptSession(bobKeys, msg, info...)
+	if err != nil {
+		t.Fatalf("AcceptSession failed: %v", err)
+	}
+	if string(plaintext) != "hi bob" {
+		t.Fatalf("plaintext mismatch: %q", plaintext)
+	}
+	if aliceSession.Key != bobSession.Key {
+		t.Fatal("session keys should match")
+	}
+	if string(aliceSession.AD) != string(bobSession.AD) {
+		t.Fatal("associated data should match")
+	}
+	if bobSession.PeerIdentity != PublicKey(alice) {
+		t.Fatal("responder should learn the initiator's identity key")
+	}
+}
+
+func TestInitiateSession_BadSignature(t *testing.T) {
+	_, bobBundle := newResponder(t)
+	_, otherBundle := newResponder(t)
+	bobBundle.Sig = otherBundle.Sig
+	alice, _, _ := GenKeyPair()
+	_, _, err := InitiateSession(alice, bobBundle, []byte("hi"))
+	if !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("expected ErrInvalidSignature, got %v", err)
+	}
+}
+
+func TestAcceptSession_WrongInfo(t *testing.T) {
+	bobKeys, bobBundle := newResponder(t)
+	alice, _, _ := GenKeyPair()
+	_, msg, err := InitiateSession(alice, bobBundle, []byte("hi"), []byte("alice"), []byte("bob"))
+	if err != nil {
+		t.Fatalf("InitiateSession failed: %v", err)
+	}
+	if _, _, err := AcceptSession(bobKeys, msg, []byte("mallory"), []byte("bob")); err == nil {
+		t.Fatal("AcceptSession should fail when the identity info differs")
+	}
+}
+
+func TestAcceptSession_SubstitutedIdentity(t *testing.T) {
+	bobKeys, bobBundle := newResponder(t)
+	alice, _, _ := GenKeyPair()
+	_, mallory, _ := GenKeyPair()
+	_, msg, err := InitiateSession(alice, bobBundle, []byte("hi"))
+	if err != nil {
+		t.Fatalf("InitiateSession failed: %v", err)
+	}
+	msg.AliceIK = EncodePublicKey(mallory)
+	if _, _, err := AcceptSession(bobKeys, msg); err == nil {
+		t.Fatal("AcceptSession should fail with a substituted identity key")
+	}
+}
+
+func TestSession_WithoutOneTimePreKey(t *testing.T) {
+	bobKeys, bobBundle := newResponder(t)
+	bobBundle.OTK = ""
+	bobBundle.OTKID = 0
+	alice, _, _ := GenKeyPair()
+
+	aliceSession, msg, err := InitiateSession(alice, bobBundle, []byte("hi"))
+	if err != nil {
+		t.Fatalf("InitiateSession failed: %v", err)
+	}
+	if msg.OTKID != 0 {
+		t.Fatalf("expected no OTK id, got %d", msg.OTKID)
+	}
+	bobSession, plaintext, err := AcceptSession(bobKeys, msg)
+	if err != nil {
+		t.Fatalf("AcceptSession failed: %v", err)
+	}
+	if string(plaintext) != "hi" || aliceSession.Key != bobSession.Key {
+		t.Fatal("3-DH handshake should agree on the session key")
+	}
+}
+
+func TestAcceptSession_UnknownOneTimePreKey(t *testing.T) {
+	bobKeys, bobBundle := newResponder(t)
+	alice, _, _ := GenKeyPair()
+	_, msg, err := InitiateSession(alice, bobBundle, []byte("hi"))
+	if err != nil {
+		t.Fatalf("InitiateSession failed: %v", err)
+	}
+	msg.OTKID = 42
+	if _, _, err := AcceptSession(bobKeys, msg); !errors.Is(err, ErrUnknownOneTimePreKey) {
+		t.Fatalf("expected ErrUnknownOneTimePreKey, got %v", err)
+	}
+	// Claiming no OTK was used changes the derived key, so decryption fails.
+	msg.OTKID = 0
+	if _, _, err := AcceptSession(bobKeys, msg); err == nil {
+		t.Fatal("AcceptSession should fail when the OTK is silently dropped")
+	}
+}
+
+func TestInitiateSession_OneTimePreKeyWithoutID(t *testing.T) {
+	_, bobBundle := newResponder(t)
+	bobBundle.OTKID = 0
+	alice, _, _ := GenKeyPair()
+	if _, _, err := InitiateSession(alice, bobBundle, []byte("hi")); err == nil {
+		t.Fatal("InitiateSession should reject an OTK without an id")
+	}
+}
+
+func TestAcceptSession_RotatedSignedPreKey(t *testing.T) {
+	bobKeys, bobBundle := newResponder(t)
+	alice, _, _ := GenKeyPair()
+	// Alice fetched the bundle before Bob rotated his SPK.
+	_, msg, err := InitiateSession(alice, bobBundle, []byte("in flight"))
+	if err != nil {
+		t.Fatalf("InitiateSession failed: %v", err)
+	}
+	newSPK, _, _ := GenKeyPair()
+	bobKeys.SignedPreKeys[2] = newSPK
+
+	if _, _, err := AcceptSession(bobKeys, msg); err != nil {
+		t.Fatalf("old SPK should still work during the grace period: %v", err)
+	}
+	delete(bobKeys.SignedPreKeys, 1)
+	if _, _, err := AcceptSession(bobKeys, msg); !errors.Is(err, ErrUnknownSignedPreKey) {
+		t.Fatalf("expected ErrUnknownSignedPreKey, got %v", err)
+	}
+}
+
+func TestValidateBundle(t *testing.T) {
+	_, good := newResponder(t)
+	if err := ValidateBundle(good); err != nil {
+		t.Fatalf("valid bundle rejected: %v", err)
+	}
+
+	zero := "0000000000000000000000000000000000000000000000000000000000000000"
+	tests := []struct {
+		name   string
+		mutate func(b *Bundle)
+		field  string
+		want   error
+	}{
+		{"empty ik", func(b *Bundle) { b.IK = "" }, "ik", ErrMalformedKey},
+		{"low-order spk", func(b *Bundle) { b.SPK = zero }, "spk", ErrLowOrderPoint},
+		{"low-order otk", func(b *Bundle) { b.OTK = zero }, "otk", ErrLowOrderPoint},
+		{"otk without id", func(b *Bundle) { b.OTKID = 0 }, "otk_id", ErrMissingOTKID},
+		{"short ed25519", func(b *Bundle) { b.Ed25519 = "abcd" }, "ed25519", ErrMalformedKey},
+		{"empty sig", func(b *Bundle) { b.Sig = "" }, "sig", ErrMalformedSignature},
+		{"wrong sig", func(b *Bundle) { b.Sig = hex.EncodeToString(make([]byte, ed25519.SignatureSize)) }, "sig", ErrInvalidSignature},
+	}
+	for _, tc := range tests {
+		b := *good
+		tc.mutate(&b)
+		err := ValidateBundle(&b)
+		var be *BundleError
+		if !errors.As(err, &be) || be.Field != tc.field || !errors.Is(err, tc.want) {
+			t.Errorf("%s: got %v, want %s: %v", tc.name, err, tc.field, tc.want)
+		}
+	}
+}
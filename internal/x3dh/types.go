@@ -1,17 +1,79 @@
 package x3dh
 
+import "encoding/json"
+
+// Bundle is the set of public keys a user publishes so others can start a
+// session with them while they are offline. SPKID changes every time the
+// signed prekey is rotated. OTK is optional: when the one-time prekey pool
+// is exhausted it is empty and OTKID is 0. Device names the device the
+// bundle belongs to; it is filled in by the relay when the bundle is fetched.
 type Bundle struct {
+	Device  string `json:"device,omitempty"`
 	IK      string `json:"ik"`
 	SPK     string `json:"spk"`
-	OTK     string `json:"otk"`
+	SPKID   uint32 `json:"spk_id"`
+	OTK     string `json:"otk,omitempty"`
+	OTKID   uint32 `json:"otk_id,omitempty"`
 	Ed25519 string `json:"ed25519"`
 	Sig     string `json:"sig"`
 }
 
+// InitialMessage is the first message of a session. SPKID and OTKID name
+// the responder's prekeys the initiator used; an OTKID of 0 means no
+// one-time prekey was used and only DH1..DH3 went into the key derivation.
+// ID is assigned by the relay when the message is queued; the recipient
+// uses it to acknowledge delivery. ExpiresAt is the Unix time, set by the
+// relay, after which an undelivered message is discarded.
+//
+// Ratchet optionally carries a Double Ratchet message (see package ratchet),
+// which the relay passes through untouched. Next to the X3DH fields it
+// starts a ratchet session; on its own, with the X3DH fields empty, it is a
+// later message of that session. SenderDevice tells the recipient which of
+// the sender's devices to answer.
 type InitialMessage struct {
+	ID         string `json:"id,omitempty"`
+	ExpiresAt  int64  `json:"expires_at,omitempty"`
 	AliceIK    string `json:"alice_ik"`
 	AliceEKa   string `json:"alice_eka"`
+	SPKID      uint32 `json:"spk_id"`
+	OTKID      uint32 `json:"otk_id,omitempty"`
 	Nonce      string `json:"nonce"`
 	Ciphertext string `json:"ciphertext"`
 	Sender     string `json:"sender"`
-} 
\ No newline at end of file
+
+	SenderDevice string          `json:"sender_device,omitempty"`
+	Ratchet      json.RawMessage `json:"ratchet,omitempty"`
+}
+
+// OneTimePreKey is a single published one-time prekey. Ids are assigned by
+// the owner, are unique per user and are never 0.
+type OneTimePreKey struct {
+	ID  uint32 `json:"id"`
+	Key string `json:"key"`
+}
+
+// AuthChallenge is issued by the server; the client proves ownership of
+// its Ed25519 identity key by signing AuthPayload(user, Nonce).
+type AuthChallenge struct {
+	Nonce     string `json:"nonce"`
+	ExpiresIn int    `json:"expires_in"` // seconds
+}
+
+// AuthResponse answers an AuthChallenge.
+type AuthResponse struct {
+	Nonce     string `json:"nonce"`
+	Ed25519   string `json:"ed25519"`
+	Signature string `json:"signature"`
+}
+
+// AuthToken is a short-lived bearer token for the owner-only endpoints.
+type AuthToken struct {
+	Token     string `json:"token"`
+	ExpiresIn int    `json:"expires_in"` // seconds
+}
+
+// DeviceApproval lets a new device of a user log in with the hex Ed25519
+// key it names. It is sent by a device of the same user that is logged in.
+type DeviceApproval struct {
+	Ed25519 string `json:"ed25519"`
+}